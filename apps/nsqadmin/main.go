@@ -49,6 +49,7 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.String("http-client-tls-root-ca-file", "", "path to CA file for the HTTP client")
 	flagSet.String("http-client-tls-cert", "", "path to certificate file for the HTTP client")
 	flagSet.String("http-client-tls-key", "", "path to key file for the HTTP client")
+	flagSet.String("http-client-auth-secret", "", "bearer secret sent by the HTTP client to nsqd and nsqlookupd (needed when nsqd has --auth-http-address, unless the --http-client-tls-cert is authorized)")
 
 	flagSet.String("allow-config-from-cidr", opts.AllowConfigFromCIDR, "A CIDR from which to allow HTTP requests to the /config endpoint")
 	flagSet.String("acl-http-header", opts.AclHttpHeader, "HTTP header to check for authenticated admin users")
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
 	"syscall"
@@ -82,6 +83,15 @@ func (p *program) Start() error {
 		logFatal("failed to persist metadata - %s", err)
 	}
 	// 8. 在单独的 go routine 中启动 nsqd.Main 方法
+	if opts.AuthFile != "" {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				p.nsqd.ReloadAuthFile()
+			}
+		}()
+	}
 	go func() {
 		err := p.nsqd.Main() //开始监听服务
 		if err != nil {
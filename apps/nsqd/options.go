@@ -117,6 +117,14 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
+	flagSet.String("auth-file", opts.AuthFile, "path to a JSON file of authorizations by secret or TLS common name, checked before any auth server (reloaded on SIGHUP)")
+	flagSet.String("auth-jwt-hmac-key-file", opts.AuthJWTHMACKeyFile, "path to the HMAC key of the JWTs accepted as AUTH secrets (HS256, HS384, HS512)")
+	authJWTPublicKeyFiles := app.StringArray{}
+	flagSet.Var(&authJWTPublicKeyFiles, "auth-jwt-public-key-file", "path to a PEM file of RSA/ECDSA public keys of the JWTs accepted as AUTH secrets (may be given multiple times)")
+	flagSet.String("auth-jwt-issuer", opts.AuthJWTIssuer, "issuer (iss claim) required of JWT AUTH secrets")
+	flagSet.String("auth-jwt-audience", opts.AuthJWTAudience, "audience (aud claim) required of JWT AUTH secrets")
+	flagSet.Duration("auth-http-hedge-delay", opts.AuthHTTPHedgeDelay, "duration to wait for an auth server before also querying the next one")
+	flagSet.Duration("auth-stale-ttl", opts.AuthStaleTTL, "duration an expired auth server response is still used while no auth server can be reached (0 to disable)")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	lookupdTCPAddrs := app.StringArray{}
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
@@ -129,6 +137,17 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Int64("disk-soft-limit", opts.DiskSoftLimit, "free bytes on the data-path volume below which to warn (0 to disable)")
+	flagSet.Int64("disk-hard-limit", opts.DiskHardLimit, "free bytes on the data-path volume below which to reject publishes (0 to disable)")
+	flagSet.Duration("disk-check-interval", opts.DiskCheckInterval, "duration between checks of the data-path volume free space")
+	flagSet.Bool("auto-create-topics", opts.AutoCreateTopics, "create topics on their first publish, subscription or HTTP call (channels of an existing topic are always created on their first subscription)")
+	autoCreateTopicPatterns := app.StringArray{}
+	flagSet.Var(&autoCreateTopicPatterns, "auto-create-topic-pattern", "regex of the topic names still created implicitly with --auto-create-topics=false (may be given multiple times)")
+	flagSet.Duration("channel-idle-timeout", opts.ChannelIdleTimeout, "duration without clients after which a durable channel is deleted or paused (0 to disable)")
+	flagSet.Duration("topic-idle-timeout", opts.TopicIdleTimeout, "duration without channels nor publishes after which a durable topic is deleted or paused (0 to disable)")
+	flagSet.String("idle-action", opts.IdleAction, "what to do with idle topics and channels (delete, pause)")
+	flagSet.Duration("idle-warning-period", opts.IdleWarningPeriod, "duration before an idle topic or channel expires during which /stats shows its expiry")
+	flagSet.Duration("idle-check-interval", opts.IdleCheckInterval, "duration between checks of idle topics and channels")
 
 	// msg and command options
 	flagSet.Duration("msg-timeout", opts.MsgTimeout, "default duration to wait before auto-requeing a message")
@@ -136,6 +155,8 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.Duration("dedupe-window", opts.DedupeWindow, "duration a publish dedupe key is remembered per topic (0 to disable)")
+	flagSet.Int("max-dedupe-keys", opts.MaxDedupeKeys, "maximum number of publish dedupe keys remembered per topic")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
@@ -145,6 +166,12 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Duration("min-output-buffer-timeout", opts.MinOutputBufferTimeout, "minimum client configurable duration of time between flushing to a client")
 	flagSet.Duration("output-buffer-timeout", opts.OutputBufferTimeout, "default duration of time between flushing data to clients")
 	flagSet.Int("max-channel-consumers", opts.MaxChannelConsumers, "maximum channel consumer connection count per nsqd instance (default 0, i.e., unlimited)")
+	flagSet.Duration("http-consumer-session-timeout", opts.HTTPConsumerSessionTimeout, "duration after which an idle HTTP consumer session (/sub) expires and its in-flight messages are requeued")
+	webSocketAllowedOrigins := app.StringArray{}
+	flagSet.Var(&webSocketAllowedOrigins, "websocket-allowed-origin", "origin (scheme://host[:port]) of the browser pages allowed to open a WebSocket besides nsqd's own, * for any (may be given multiple times)")
+	pushAllowedHosts := app.StringArray{}
+	flagSet.Var(&pushAllowedHosts, "push-allowed-host", "host (or host:port) push subscriptions may POST to (may be given multiple times, none disables push subscriptions)")
+	flagSet.Int("max-push-concurrency", opts.MaxPushConcurrency, "maximum number of concurrent requests of a push subscription")
 
 	// statsd integration options
 	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon for pushing stats")
@@ -152,6 +179,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Bool("statsd-mem-stats", opts.StatsdMemStats, "toggle sending memory and GC stats to statsd")
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement)")
 	flagSet.Int("statsd-udp-packet-size", opts.StatsdUDPPacketSize, "the size in bytes of statsd UDP packets")
+	flagSet.Bool("statsd-tags", opts.StatsdTags, "send topic, channel and host as DogStatsD tags instead of in the stat names")
 
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
@@ -60,6 +60,32 @@ func (a *Authorization) IsAllowed(topic, channel string) bool {
 	return false
 }
 
+// IsAdminAllowed returns whether the authorization grants the "admin"
+// permission on topic and, if not empty, channel. Options of nsqd itself are
+// administered with an empty topic
+func (a *Authorization) IsAdminAllowed(topic, channel string) bool {
+	if !a.HasPermission("admin") {
+		return false
+	}
+
+	topicRegex := regexp.MustCompile(a.Topic)
+
+	if !topicRegex.MatchString(topic) {
+		return false
+	}
+
+	if channel == "" {
+		return true
+	}
+	for _, c := range a.Channels {
+		channelRegex := regexp.MustCompile(c)
+		if channelRegex.MatchString(channel) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *State) IsAllowed(topic, channel string) bool {
 	for _, aa := range a.Authorizations {
 		if aa.IsAllowed(topic, channel) {
@@ -69,6 +95,15 @@ func (a *State) IsAllowed(topic, channel string) bool {
 	return false
 }
 
+func (a *State) IsAdminAllowed(topic, channel string) bool {
+	for _, aa := range a.Authorizations {
+		if aa.IsAdminAllowed(topic, channel) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *State) IsExpired() bool {
 	if a.Expires.Before(time.Now()) {
 		return true
@@ -76,17 +111,89 @@ func (a *State) IsExpired() bool {
 	return false
 }
 
-func QueryAnyAuthd(authd []string, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
+// validate checks the permissions, regexes and TTL of an auth state
+func (a *State) validate() error {
+	for _, auth := range a.Authorizations {
+		for _, p := range auth.Permissions {
+			switch p {
+			case "subscribe", "publish", "admin":
+			default:
+				return fmt.Errorf("unknown permission %s", p)
+			}
+		}
+
+		if _, err := regexp.Compile(auth.Topic); err != nil {
+			return fmt.Errorf("unable to compile topic %q %s", auth.Topic, err)
+		}
+
+		for _, channel := range auth.Channels {
+			if _, err := regexp.Compile(channel); err != nil {
+				return fmt.Errorf("unable to compile channel %q %s", channel, err)
+			}
+		}
+	}
+
+	if a.TTL <= 0 {
+		return fmt.Errorf("invalid TTL %d (must be >0)", a.TTL)
+	}
+	return nil
+}
+
+// ErrUnavailable is returned by QueryAnyAuthd when no auth server answered
+var ErrUnavailable = errors.New("Unable to access auth server")
+
+// QueryAnyAuthd queries the auth servers in order, starting the query of the
+// next one when the previous fails or has not answered after hedgeDelay, and
+// returns the first auth state received. If none is, the error of an auth
+// server denying the request takes precedence over ErrUnavailable
+func QueryAnyAuthd(authd []string, hedgeDelay time.Duration, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
 	connectTimeout time.Duration, requestTimeout time.Duration) (*State, error) {
-	for _, a := range authd {
+	type result struct {
+		authState *State
+		err       error
+	}
+	// buffered so that the queries still running when returning can finish
+	results := make(chan result, len(authd))
+	query := func(a string) {
 		authState, err := QueryAuthd(a, remoteIP, tlsEnabled, commonName, authSecret, connectTimeout, requestTimeout)
 		if err != nil {
 			log.Printf("Error: failed auth against %s %s", a, err)
-			continue
 		}
-		return authState, nil
+		results <- result{authState, err}
+	}
+
+	err := ErrUnavailable
+	var started, running int
+	start := func() {
+		go query(authd[started])
+		started++
+		running++
+	}
+	if len(authd) > 0 {
+		start()
+	}
+	for running > 0 {
+		var hedge <-chan time.Time
+		if started < len(authd) {
+			hedge = time.After(hedgeDelay)
+		}
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.authState, nil
+			}
+			if statusErr, ok := r.err.(http_api.StatusErr); ok && statusErr.Code < 500 {
+				err = r.err
+			}
+			if started < len(authd) {
+				start()
+			}
+		case <-hedge:
+			start()
+		}
 	}
-	return nil, errors.New("Unable to access auth server")
+	return nil, err
 }
 
 func QueryAuthd(authd string, remoteIP string, tlsEnabled bool, commonName string, authSecret string,
@@ -110,28 +217,8 @@ func QueryAuthd(authd string, remoteIP string, tlsEnabled bool, commonName strin
 	}
 
 	// validation on response
-	for _, auth := range authState.Authorizations {
-		for _, p := range auth.Permissions {
-			switch p {
-			case "subscribe", "publish":
-			default:
-				return nil, fmt.Errorf("unknown permission %s", p)
-			}
-		}
-
-		if _, err := regexp.Compile(auth.Topic); err != nil {
-			return nil, fmt.Errorf("unable to compile topic %q %s", auth.Topic, err)
-		}
-
-		for _, channel := range auth.Channels {
-			if _, err := regexp.Compile(channel); err != nil {
-				return nil, fmt.Errorf("unable to compile channel %q %s", channel, err)
-			}
-		}
-	}
-
-	if authState.TTL <= 0 {
-		return nil, fmt.Errorf("invalid TTL %d (must be >0)", authState.TTL)
+	if err := authState.validate(); err != nil {
+		return nil, err
 	}
 
 	authState.Expires = time.Now().Add(time.Duration(authState.TTL) * time.Second)
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// minimum number of entries before expired ones are pruned
+const minCachePrune = 1024
+
+type cacheKey struct {
+	remoteIP   string
+	tlsEnabled bool
+	commonName string
+	secret     string
+}
+
+// Cache holds the auth states returned by authd until they expire, and for
+// staleTTL after that as a fallback while no authd can be reached
+type Cache struct {
+	staleTTL time.Duration
+
+	sync.Mutex
+	states    map[cacheKey]*State
+	nextPrune int
+}
+
+func NewCache(staleTTL time.Duration) *Cache {
+	return &Cache{
+		staleTTL:  staleTTL,
+		states:    make(map[cacheKey]*State),
+		nextPrune: minCachePrune,
+	}
+}
+
+// Get returns the unexpired auth state of a client
+func (c *Cache) Get(remoteIP string, tlsEnabled bool, commonName string, secret string) (*State, bool) {
+	c.Lock()
+	state, ok := c.states[cacheKey{remoteIP, tlsEnabled, commonName, secret}]
+	c.Unlock()
+	if !ok || state.IsExpired() {
+		return nil, false
+	}
+	return state, true
+}
+
+// GetStale returns a copy of the auth state of a client that expired less
+// than staleTTL ago, valid for its TTL again (but no longer than staleTTL
+// after it expired)
+func (c *Cache) GetStale(remoteIP string, tlsEnabled bool, commonName string, secret string) (*State, bool) {
+	c.Lock()
+	state, ok := c.states[cacheKey{remoteIP, tlsEnabled, commonName, secret}]
+	c.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	staleUntil := state.Expires.Add(c.staleTTL)
+	if !now.Before(staleUntil) {
+		return nil, false
+	}
+	stale := *state
+	stale.Expires = now.Add(time.Duration(state.TTL) * time.Second)
+	if stale.Expires.After(staleUntil) {
+		stale.Expires = staleUntil
+	}
+	return &stale, true
+}
+
+// Set caches the auth state of a client
+func (c *Cache) Set(remoteIP string, tlsEnabled bool, commonName string, secret string, state *State) {
+	c.Lock()
+	defer c.Unlock()
+	c.states[cacheKey{remoteIP, tlsEnabled, commonName, secret}] = state
+
+	if len(c.states) < c.nextPrune {
+		return
+	}
+	now := time.Now()
+	for k, s := range c.states {
+		if !now.Before(s.Expires.Add(c.staleTTL)) {
+			delete(c.states, k)
+		}
+	}
+	c.nextPrune = 2 * len(c.states)
+	if c.nextPrune < minCachePrune {
+		c.nextPrune = minCachePrune
+	}
+}
+
+// Remove forgets the auth state of a client, eg. once an auth server denies it
+func (c *Cache) Remove(remoteIP string, tlsEnabled bool, commonName string, secret string) {
+	c.Lock()
+	delete(c.states, cacheKey{remoteIP, tlsEnabled, commonName, secret})
+	c.Unlock()
+}
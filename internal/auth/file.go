@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// File is a static authorization file, mapping the secrets sent with AUTH
+// and the TLS common names of clients to auth states, in the schema an authd
+// responds with:
+//
+//	{
+//	    "secrets": {
+//	        "<secret>": {"ttl": 3600, "identity": "...", "authorizations": [...]}
+//	    },
+//	    "common_names": {
+//	        "<common name>": {"ttl": 3600, "identity": "...", "authorizations": [...]}
+//	    }
+//	}
+type File struct {
+	Secrets     map[string]State `json:"secrets"`
+	CommonNames map[string]State `json:"common_names"`
+}
+
+// LoadFile reads and validates the authorization file at path
+func LoadFile(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s - %s", path, err)
+	}
+
+	for _, state := range f.Secrets {
+		if err := state.validate(); err != nil {
+			// secrets are not logged
+			return nil, fmt.Errorf("invalid authorizations for a secret - %s", err)
+		}
+	}
+	for commonName, state := range f.CommonNames {
+		if err := state.validate(); err != nil {
+			return nil, fmt.Errorf("invalid authorizations for common name %q - %s", commonName, err)
+		}
+	}
+	return &f, nil
+}
+
+// Lookup returns the auth state of a client, by its secret first and then
+// by its TLS common name
+func (f *File) Lookup(tlsEnabled bool, commonName string, authSecret string) (*State, bool) {
+	state, ok := f.Secrets[authSecret]
+	if !ok && tlsEnabled && commonName != "" {
+		state, ok = f.CommonNames[commonName]
+	}
+	if !ok {
+		return nil, false
+	}
+	state.Expires = time.Now().Add(time.Duration(state.TTL) * time.Second)
+	return &state, true
+}
@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	// hash functions of the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// JWTVerifier validates AUTH secrets that are JSON Web Tokens signed with an
+// HMAC secret or by the private key of one of a set of RSA or ECDSA public
+// keys, so that clients are authorized without querying an authd.
+//
+// The claims of a token map to an auth state: "sub" is the identity,
+// "identity_url" the identity URL, "authorizations" the authorizations (as
+// returned by an authd) and "exp", which is required, the expiry of the
+// state.
+type JWTVerifier struct {
+	hmacKey    []byte
+	publicKeys []crypto.PublicKey
+	issuer     string
+	audience   string
+}
+
+// curves of the ECDSA algorithms, whose hash goes with the curve size
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject        string          `json:"sub"`
+	Issuer         string          `json:"iss"`
+	Audience       interface{}     `json:"aud"`
+	ExpiresAt      *float64        `json:"exp"`
+	NotBefore      *float64        `json:"nbf"`
+	IdentityURL    string          `json:"identity_url"`
+	Authorizations []Authorization `json:"authorizations"`
+}
+
+// NewJWTVerifier loads the HMAC key and the PEM encoded public keys (or
+// certificates) tokens are verified with. The "iss" and "aud" claims of the
+// tokens must match issuer and audience, if not empty.
+func NewJWTVerifier(hmacKeyFile string, publicKeyFiles []string, issuer string, audience string) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	if hmacKeyFile != "" {
+		key, err := ioutil.ReadFile(hmacKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.hmacKey = []byte(strings.TrimSpace(string(key)))
+		if len(v.hmacKey) == 0 {
+			return nil, fmt.Errorf("empty HMAC key in %s", hmacKeyFile)
+		}
+	}
+
+	for _, fileName := range publicKeyFiles {
+		keys, err := loadPublicKeys(fileName)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKeys = append(v.publicKeys, keys...)
+	}
+
+	if v.hmacKey == nil && len(v.publicKeys) == 0 {
+		return nil, errors.New("no JWT keys")
+	}
+	return v, nil
+}
+
+// loadPublicKeys reads the RSA and ECDSA public keys of a PEM file
+func loadPublicKeys(fileName string) ([]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s in %s - %s", block.Type, fileName, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported %T in %s", key, fileName)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key in %s", fileName)
+	}
+	return keys, nil
+}
+
+// IsJWT returns whether an AUTH secret has the form of a JWT
+func IsJWT(secret string) bool {
+	return strings.Count(secret, ".") == 2
+}
+
+// Verify checks the signature and claims of token, returning the auth state
+// it grants until it expires
+func (v *JWTVerifier) Verify(token string) (*State, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header - %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature - %s", err)
+	}
+	err = v.verifySignature(header.Alg, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims - %s", err)
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	expires := time.Unix(int64(*claims.ExpiresAt), 0)
+	if !now.Before(expires) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("invalid issuer %q", claims.Issuer)
+	}
+	if v.audience != "" && !hasAudience(claims.Audience, v.audience) {
+		return nil, errors.New("invalid audience")
+	}
+
+	state := &State{
+		TTL:            int(expires.Sub(now) / time.Second),
+		Authorizations: claims.Authorizations,
+		Identity:       claims.Subject,
+		IdentityURL:    claims.IdentityURL,
+		Expires:        expires,
+	}
+	if state.TTL == 0 {
+		// expires within the second
+		state.TTL = 1
+	}
+	err = state.validate()
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience returns whether the "aud" claim, a string or an array of
+// strings, includes audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *JWTVerifier) verifySignature(alg string, signed string, signature []byte) error {
+	// HS256, RS384, ES512...
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if v.hmacKey == nil {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		mac := hmac.New(hash.New, v.hmacKey)
+		mac.Write([]byte(signed))
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return nil
+		}
+		return errors.New("invalid signature")
+	case "RS", "PS", "ES":
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	for _, key := range v.publicKeys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				if rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+					return nil
+				}
+			case "PS":
+				if rsa.VerifyPSS(key, hash, digest, signature, nil) == nil {
+					return nil
+				}
+			}
+		case *ecdsa.PublicKey:
+			if key.Curve.Params().Name != ecdsaCurves[alg] {
+				continue
+			}
+			// r and s, each the size of the curve
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"nsq/internal/test"
+)
+
+func jwtSigned(alg string) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	return base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+}
+
+func jwtSignHMAC(alg string, key []byte) string {
+	signed := jwtSigned(alg)
+	mac := hmac.New(crypto.SHA256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func jwtSignECDSA(t *testing.T, alg string, hash crypto.Hash, key *ecdsa.PrivateKey) string {
+	signed := jwtSigned(alg)
+	h := hash.New()
+	h.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	test.Nil(t, err)
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifierECDSA(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.Nil(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	test.Nil(t, err)
+	v := &JWTVerifier{publicKeys: []crypto.PublicKey{&p256.PublicKey, &p384.PublicKey}}
+
+	state, err := v.Verify(jwtSignECDSA(t, "ES256", crypto.SHA256, p256))
+	test.Nil(t, err)
+	test.Equal(t, "alice", state.Identity)
+	_, err = v.Verify(jwtSignECDSA(t, "ES384", crypto.SHA384, p384))
+	test.Nil(t, err)
+
+	// the curve must be the one of the algorithm
+	_, err = v.Verify(jwtSignECDSA(t, "ES384", crypto.SHA384, p256))
+	test.NotNil(t, err)
+	_, err = v.Verify(jwtSignECDSA(t, "ES512", crypto.SHA512, p384))
+	test.NotNil(t, err)
+}
+
+func TestJWTVerifierRejects(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	test.Nil(t, err)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	v := &JWTVerifier{publicKeys: []crypto.PublicKey{&key.PublicKey}}
+
+	valid := jwtSignECDSA(t, "ES256", crypto.SHA256, key)
+	_, err = v.Verify(valid)
+	test.Nil(t, err)
+
+	for _, token := range []string{
+		// unsigned
+		jwtSigned("none") + ".",
+		jwtSigned("ES256") + ".",
+		// signed with the public key as an HMAC secret
+		jwtSignHMAC("HS256", pemBytes),
+		jwtSignHMAC("HS256", der),
+		// malformed signatures
+		valid[:len(valid)-4],
+		valid + "AAAA",
+		valid + "!",
+		jwtSigned("ES256") + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 64)),
+		// malformed tokens
+		jwtSigned("ES256"),
+		"e30.e30.e30.e30",
+	} {
+		_, err = v.Verify(token)
+		test.NotNil(t, err)
+	}
+}
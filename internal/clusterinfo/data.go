@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"nsq/internal/http_api"
 	"nsq/internal/lg"
@@ -629,6 +630,51 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 	return topicStatsList, channelStatsMap, nil
 }
 
+// GetNSQDChannelPeek returns the next n messages queued in a channel, and its
+// in-flight and deferred messages, on each of the given producers
+func (c *ClusterInfo) GetNSQDChannelPeek(producers Producers, topicName string, channelName string, n int) ([]*ChannelPeek, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var peeks []*ChannelPeek
+	var errs []error
+
+	for _, p := range producers {
+		wg.Add(1)
+		go func(p *Producer) {
+			defer wg.Done()
+
+			addr := p.HTTPAddress()
+			endpoint := fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=%s&n=%d", addr,
+				url.QueryEscape(topicName), url.QueryEscape(channelName), n)
+			c.logf("CI: querying nsqd %s", endpoint)
+
+			var resp ChannelPeek
+			err := c.client.GETV1(endpoint, &resp)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			resp.Node = addr
+			resp.Hostname = p.Hostname
+			peeks = append(peeks, &resp)
+		}(p)
+	}
+	wg.Wait()
+
+	if len(errs) == len(producers) && len(producers) > 0 {
+		return nil, fmt.Errorf("Failed to query any nsqd: %s", ErrList(errs))
+	}
+
+	sort.Slice(peeks, func(i, j int) bool { return peeks[i].Node < peeks[j].Node })
+
+	if len(errs) > 0 {
+		return peeks, ErrList(errs)
+	}
+	return peeks, nil
+}
+
 // TombstoneNodeForTopic tombstones the given node for the given topic on all the given nsqlookupd
 // and deletes the topic from the node
 func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHTTPAddrs []string) error {
@@ -834,6 +880,71 @@ func (c *ClusterInfo) EmptyChannel(topicName string, channelName string, lookupd
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/empty", qs)
 }
 
+// DeleteMessage discards an in-flight or deferred message of a channel
+func (c *ClusterInfo) DeleteMessage(topicName string, channelName string, id string, node string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s&id=%s", url.QueryEscape(topicName), url.QueryEscape(channelName), url.QueryEscape(id))
+	return c.messageActionHelper(topicName, node, lookupdHTTPAddrs, nsqdHTTPAddrs, "message/delete", qs)
+}
+
+// RequeueMessage moves an in-flight or deferred message of a channel back to
+// its queue after timeout (immediately if 0)
+func (c *ClusterInfo) RequeueMessage(topicName string, channelName string, id string, timeout time.Duration, node string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s&id=%s", url.QueryEscape(topicName), url.QueryEscape(channelName), url.QueryEscape(id))
+	if timeout == 0 {
+		return c.messageActionHelper(topicName, node, lookupdHTTPAddrs, nsqdHTTPAddrs, "message/requeue", qs)
+	}
+	qs += fmt.Sprintf("&timeout=%d", timeout/time.Millisecond)
+	return c.messageActionHelper(topicName, node, lookupdHTTPAddrs, nsqdHTTPAddrs, "message/reschedule", qs)
+}
+
+// messageActionHelper performs a message action on node, or if empty on every
+// producer of the topic, it succeeds if the message was found on any of them
+func (c *ClusterInfo) messageActionHelper(topicName string, node string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string, uri string, qs string) error {
+	var errs []error
+
+	producers, err := c.GetTopicProducers(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs)
+	if err != nil {
+		pe, ok := err.(PartialErr)
+		if !ok {
+			return err
+		}
+		errs = append(errs, pe.Errors()...)
+	}
+
+	if node != "" {
+		var selected Producers
+		for _, p := range producers {
+			if p.HTTPAddress() == node {
+				selected = append(selected, p)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("node %s is not a producer of topic %s", node, topicName)
+		}
+		producers = selected
+	}
+
+	var ok bool
+	for _, p := range producers {
+		endpoint := fmt.Sprintf("http://%s/%s?%s", p.HTTPAddress(), uri, qs)
+		c.logf("CI: querying nsqd %s", endpoint)
+		err := c.client.POSTV1(endpoint)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ok = true
+	}
+
+	if !ok {
+		return fmt.Errorf("Failed to %s on any nsqd: %s", uri, ErrList(errs))
+	}
+	if node != "" && len(errs) > 0 {
+		return ErrList(errs)
+	}
+	return nil
+}
+
 func (c *ClusterInfo) actionHelper(topicName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string, uri string, qs string) error {
 	var errs []error
 
@@ -92,6 +92,13 @@ func (p *Producer) IsInconsistent(numLookupd int) bool {
 	return len(p.RemoteAddresses) != numLookupd
 }
 
+// QueueQuota is the quota an nsqd topic or channel is configured with
+type QueueQuota struct {
+	MaxDepth       int64  `json:"max_depth,omitempty"`
+	MaxBytes       int64  `json:"max_bytes,omitempty"`
+	OverflowPolicy string `json:"overflow_policy,omitempty"`
+}
+
 type TopicStats struct {
 	Node         string          `json:"node"`
 	Hostname     string          `json:"hostname"`
@@ -104,6 +111,11 @@ type TopicStats struct {
 	Channels     []*ChannelStats `json:"channels"`
 	Paused       bool            `json:"paused"`
 
+	DepthBytes         int64      `json:"depth_bytes"`
+	QuotaRejectedCount int64      `json:"quota_rejected_count"`
+	QuotaDroppedCount  int64      `json:"quota_dropped_count"`
+	Config             QueueQuota `json:"config"`
+
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
 
@@ -113,6 +125,9 @@ func (t *TopicStats) Add(a *TopicStats) {
 	t.MemoryDepth += a.MemoryDepth
 	t.BackendDepth += a.BackendDepth
 	t.MessageCount += a.MessageCount
+	t.DepthBytes += a.DepthBytes
+	t.QuotaRejectedCount += a.QuotaRejectedCount
+	t.QuotaDroppedCount += a.QuotaDroppedCount
 	if a.Paused {
 		t.Paused = a.Paused
 	}
@@ -158,6 +173,12 @@ type ChannelStats struct {
 	Clients       []*ClientStats  `json:"clients"`
 	Paused        bool            `json:"paused"`
 
+	DepthBytes        int64      `json:"depth_bytes"`
+	QuotaDroppedCount int64      `json:"quota_dropped_count"`
+	Config            QueueQuota `json:"config"`
+
+	OldestMessageAge time.Duration `json:"oldest_message_age"`
+
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
 
@@ -172,6 +193,11 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.TimeoutCount += a.TimeoutCount
 	c.MessageCount += a.MessageCount
 	c.ClientCount += a.ClientCount
+	c.DepthBytes += a.DepthBytes
+	c.QuotaDroppedCount += a.QuotaDroppedCount
+	if a.OldestMessageAge > c.OldestMessageAge {
+		c.OldestMessageAge = a.OldestMessageAge
+	}
 	if a.Paused {
 		c.Paused = a.Paused
 	}
@@ -237,6 +263,28 @@ func (c *ClientStats) HasSampleRate() bool {
 	return c.SampleRate > 0
 }
 
+// PeekMessage is a message returned by the nsqd peek endpoints
+type PeekMessage struct {
+	ID        string            `json:"id"`
+	Body      []byte            `json:"body"`
+	Timestamp int64             `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	ClientID  int64             `json:"client_id,omitempty"`
+	Deadline  int64             `json:"deadline,omitempty"`
+	DeliverAt int64             `json:"deliver_at,omitempty"`
+}
+
+// ChannelPeek holds the messages peeked at in a channel on one nsqd
+type ChannelPeek struct {
+	Node     string        `json:"node"`
+	Hostname string        `json:"hostname"`
+	Memory   []PeekMessage `json:"memory"`
+	Backend  []PeekMessage `json:"backend"`
+	InFlight []PeekMessage `json:"in_flight"`
+	Deferred []PeekMessage `json:"deferred"`
+}
+
 type ChannelStatsList []*ChannelStats
 
 func (c ChannelStatsList) Len() int      { return len(c) }
@@ -3,6 +3,7 @@ package http_api
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -32,6 +33,9 @@ func NewDeadlineTransport(connectTimeout time.Duration, requestTimeout time.Dura
 
 type Client struct {
 	c *http.Client
+
+	// AuthSecret, when set, is sent as the bearer token of every request
+	AuthSecret string
 }
 //要管理HTTP客户端的头域、重定向策略、整体超时和其他设置，创建一个Client
 //要管理代理、TLS配置、keep-alive、压缩和其他设置，则创建一个Transport
@@ -47,6 +51,17 @@ func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeo
 	}
 }
 
+// StatusErr is the error of a V1 request answered with a status other than 200
+type StatusErr struct {
+	Code   int
+	Status string
+	Body   []byte
+}
+
+func (e StatusErr) Error() string {
+	return fmt.Sprintf("got response %s %q", e.Status, e.Body)
+}
+
 // GETV1 is a helper function to perform a V1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) GETV1(endpoint string, v interface{}) error {
@@ -57,6 +72,9 @@ retry:
 	}
 
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	if c.AuthSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AuthSecret)
+	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -70,13 +88,13 @@ retry:
 	}
 	if resp.StatusCode != 200 {
 		if resp.StatusCode == 403 && !strings.HasPrefix(endpoint, "https") {
-			endpoint, err = httpsEndpoint(endpoint, body)
-			if err != nil {
-				return err
+			// retry over HTTPS if required, otherwise it is denied
+			if httpsURL, err := httpsEndpoint(endpoint, body); err == nil {
+				endpoint = httpsURL
+				goto retry
 			}
-			goto retry
 		}
-		return fmt.Errorf("got response %s %q", resp.Status, body)
+		return StatusErr{resp.StatusCode, resp.Status, body}
 	}
 	err = json.Unmarshal(body, &v)
 	if err != nil {
@@ -96,6 +114,9 @@ retry:
 	}
 
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	if c.AuthSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AuthSecret)
+	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -129,6 +150,9 @@ func httpsEndpoint(endpoint string, body []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if forbiddenResp.HTTPSPort == 0 {
+		return "", errors.New("no HTTPS port")
+	}
 
 	u, err := url.Parse(endpoint)
 	if err != nil {
@@ -0,0 +1,165 @@
+// Package prometheus writes metrics in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/)
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+type Quantile struct {
+	Quantile float64
+	Value    float64
+}
+
+type sample struct {
+	suffix string
+	labels []Label
+	value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+// Encoder collects samples and groups them by metric name, as the format
+// requires all samples of a metric to be written together
+type Encoder struct {
+	prefix   string
+	families []*family
+	index    map[string]*family
+}
+
+func NewEncoder(prefix string) *Encoder {
+	return &Encoder{
+		prefix: prefix,
+		index:  make(map[string]*family),
+	}
+}
+
+func (e *Encoder) Gauge(name string, help string, value float64, labels ...Label) {
+	f := e.family(name, help, "gauge")
+	f.samples = append(f.samples, sample{"", labels, value})
+}
+
+func (e *Encoder) Counter(name string, help string, value float64, labels ...Label) {
+	f := e.family(name, help, "counter")
+	f.samples = append(f.samples, sample{"", labels, value})
+}
+
+// Summary adds the quantiles and the observation count of a summary, the sum
+// is not tracked by nsq's quantile streams so it is left out
+func (e *Encoder) Summary(name string, help string, quantiles []Quantile, count uint64, labels ...Label) {
+	f := e.family(name, help, "summary")
+	for _, q := range quantiles {
+		ql := append(labels[:len(labels):len(labels)], Label{"quantile", formatFloat(q.Quantile)})
+		f.samples = append(f.samples, sample{"", ql, q.Value})
+	}
+	f.samples = append(f.samples, sample{"_count", labels, float64(count)})
+}
+
+// LatencyQuantiles converts the percentiles of an nsq quantile stream (in
+// nanoseconds) to quantiles in seconds
+func LatencyQuantiles(percentiles []map[string]float64) []Quantile {
+	quantiles := make([]Quantile, 0, len(percentiles))
+	for _, p := range percentiles {
+		quantiles = append(quantiles, Quantile{Quantile: p["quantile"], Value: p["value"] / 1e9})
+	}
+	return quantiles
+}
+
+// Bool returns the value of a gauge telling whether b holds
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Runtime adds the goroutine and memory stats of the Go runtime
+func (e *Encoder) Runtime() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	e.Gauge("go_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine()))
+	e.Gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects))
+	e.Gauge("go_memstats_heap_idle_bytes", "Heap bytes waiting to be used.", float64(ms.HeapIdle))
+	e.Gauge("go_memstats_heap_inuse_bytes", "Heap bytes in use.", float64(ms.HeapInuse))
+	e.Gauge("go_memstats_heap_released_bytes", "Heap bytes released to the OS.", float64(ms.HeapReleased))
+	e.Gauge("go_memstats_next_gc_bytes", "Heap size of the next garbage collection.", float64(ms.NextGC))
+	e.Counter("go_memstats_gc_runs_total", "Number of completed garbage collections.", float64(ms.NumGC))
+}
+
+func (e *Encoder) family(name string, help string, typ string) *family {
+	if !strings.HasPrefix(name, "go_") {
+		name = e.prefix + name
+	}
+	f, ok := e.index[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		e.index[name] = f
+		e.families = append(e.families, f)
+	}
+	return f
+}
+
+// Bytes returns the metrics sorted by name
+func (e *Encoder) Bytes() []byte {
+	var buf bytes.Buffer
+
+	families := make([]*family, len(e.families))
+	copy(families, e.families)
+	sort.SliceStable(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(f.name)
+			buf.WriteString(s.suffix)
+			if len(s.labels) > 0 {
+				buf.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(&buf, "%s=\"%s\"", l.Name, escapeLabelValue(l.Value))
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(formatFloat(s.value))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
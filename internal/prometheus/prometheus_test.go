@@ -0,0 +1,68 @@
+package prometheus
+
+import (
+	"testing"
+
+	"nsq/internal/test"
+)
+
+func TestEncoderEscaping(t *testing.T) {
+	e := NewEncoder("nsq_")
+	e.Gauge("depth", "Help with a \\ and a\nnewline.", 1,
+		Label{"topic", `a "quoted" \ name` + "\nwith a newline"})
+
+	test.Equal(t, `# HELP nsq_depth Help with a \\ and a\nnewline.
+# TYPE nsq_depth gauge
+nsq_depth{topic="a \"quoted\" \\ name\nwith a newline"} 1
+`, string(e.Bytes()))
+}
+
+func TestEncoderLabels(t *testing.T) {
+	e := NewEncoder("nsq_")
+	topic := Label{"topic", "t"}
+	channel := Label{"channel", "c"}
+	e.Counter("messages_total", "Messages.", 3, topic, channel)
+	e.Gauge("topics", "Topics.", 2)
+	e.Counter("messages_total", "Messages.", 1.5, Label{"topic", "u"})
+	e.Gauge("go_goroutines", "Goroutines.", 1e21)
+
+	// grouped and sorted by name, the go_ metrics are not prefixed
+	test.Equal(t, `# HELP go_goroutines Goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 1e+21
+# HELP nsq_messages_total Messages.
+# TYPE nsq_messages_total counter
+nsq_messages_total{topic="t",channel="c"} 3
+nsq_messages_total{topic="u"} 1.5
+# HELP nsq_topics Topics.
+# TYPE nsq_topics gauge
+nsq_topics 2
+`, string(e.Bytes()))
+}
+
+func TestEncoderSummary(t *testing.T) {
+	e := NewEncoder("nsq_")
+	labels := make([]Label, 1, 2)
+	labels[0] = Label{"topic", "t"}
+	quantiles := LatencyQuantiles([]map[string]float64{
+		{"quantile": 0.5, "value": 2e6},
+		{"quantile": 0.99, "value": 1.5e9},
+	})
+	e.Summary("latency_seconds", "Latency.", quantiles, 7, labels...)
+	e.Summary("latency_seconds", "Latency.", nil, 0, Label{"topic", "u"})
+
+	// the quantile label is not written to the caller's labels
+	test.Equal(t, Label{}, labels[:2][1])
+	test.Equal(t, `# HELP nsq_latency_seconds Latency.
+# TYPE nsq_latency_seconds summary
+nsq_latency_seconds{topic="t",quantile="0.5"} 0.002
+nsq_latency_seconds{topic="t",quantile="0.99"} 1.5
+nsq_latency_seconds_count{topic="t"} 7
+nsq_latency_seconds_count{topic="u"} 0
+`, string(e.Bytes()))
+}
+
+func TestBool(t *testing.T) {
+	test.Equal(t, float64(1), Bool(true))
+	test.Equal(t, float64(0), Bool(false))
+}
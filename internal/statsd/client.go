@@ -3,11 +3,14 @@ package statsd
 import (
 	"fmt"
 	"io"
+	"strings"
 )
 
 type Client struct {
 	w      io.Writer
 	prefix string
+	tagged bool
+	tags   []string
 }
 
 func NewClient(w io.Writer, prefix string) *Client {
@@ -17,6 +20,33 @@ func NewClient(w io.Writer, prefix string) *Client {
 	}
 }
 
+// NewTaggedClient returns a client that sends tags (in "name:value" form) with
+// every stat, in the DogStatsD format
+func NewTaggedClient(w io.Writer, prefix string, tags ...string) *Client {
+	return &Client{
+		w:      w,
+		prefix: prefix,
+		tagged: true,
+		tags:   tags,
+	}
+}
+
+// With returns a client that writes to the same writer, appending prefix to
+// the stat prefix and adding tags (ignored by an untagged client)
+func (c *Client) With(prefix string, tags ...string) *Client {
+	return &Client{
+		w:      c.w,
+		prefix: c.prefix + prefix,
+		tagged: c.tagged,
+		tags:   append(c.tags[:len(c.tags):len(c.tags)], tags...),
+	}
+}
+
+// Tagged returns whether the client sends tags
+func (c *Client) Tagged() bool {
+	return c.tagged
+}
+
 func (c *Client) Incr(stat string, count int64) error {
 	return c.send(stat, "%d|c", count)
 }
@@ -34,7 +64,11 @@ func (c *Client) Gauge(stat string, value int64) error {
 }
 
 func (c *Client) send(stat string, format string, value int64) error {
-	format = fmt.Sprintf("%s%s:%s\n", c.prefix, stat, format)
+	var tags string
+	if c.tagged && len(c.tags) > 0 {
+		tags = "|#" + strings.Replace(strings.Join(c.tags, ","), "%", "%%", -1)
+	}
+	format = fmt.Sprintf("%s%s:%s%s\n", c.prefix, stat, format, tags)
 	_, err := fmt.Fprintf(c.w, format, value)
 	return err
 }
@@ -0,0 +1,51 @@
+package statsd
+
+import (
+	"bytes"
+	"testing"
+
+	"nsq/internal/test"
+	"nsq/internal/writers"
+)
+
+func TestClient(t *testing.T) {
+	var buf bytes.Buffer
+	client := NewClient(&buf, "nsq.host_4151.")
+	client.With("topic.t1.").Gauge("depth", 5)
+	client.Incr("mem.gc_runs", 2)
+	test.Equal(t, "nsq.host_4151.topic.t1.depth:5|g\nnsq.host_4151.mem.gc_runs:2|c\n", buf.String())
+}
+
+func TestTaggedClient(t *testing.T) {
+	var buf bytes.Buffer
+	client := NewTaggedClient(&buf, "nsq.", "host:127.0.0.1:4151")
+	client.With("channel.", "topic:t1", "channel:c1").Gauge("depth", 5)
+	client.With("topic.", "topic:t1").Incr("message_count", 3)
+	client.Gauge("mem.heap_objects", 7)
+	test.Equal(t, "nsq.channel.depth:5|g|#host:127.0.0.1:4151,topic:t1,channel:c1\n"+
+		"nsq.topic.message_count:3|c|#host:127.0.0.1:4151,topic:t1\n"+
+		"nsq.mem.heap_objects:7|g|#host:127.0.0.1:4151\n", buf.String())
+}
+
+type packetWriter struct {
+	packets []string
+}
+
+func (w *packetWriter) Write(p []byte) (int, error) {
+	w.packets = append(w.packets, string(p))
+	return len(p), nil
+}
+
+func TestClientBatching(t *testing.T) {
+	pw := &packetWriter{}
+	bw := writers.NewBoundaryBufferedWriter(pw, 64)
+	client := NewTaggedClient(bw, "nsq.", "host:h")
+	for i := 0; i < 5; i++ {
+		client.Gauge("topic.depth", int64(i)) // 28 bytes each, 2 per packet
+	}
+	bw.Flush()
+
+	test.Equal(t, 3, len(pw.packets))
+	test.Equal(t, "nsq.topic.depth:0|g|#host:h\nnsq.topic.depth:1|g|#host:h\n", pw.packets[0])
+	test.Equal(t, "nsq.topic.depth:4|g|#host:h\n", pw.packets[2])
+}
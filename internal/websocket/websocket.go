@@ -0,0 +1,368 @@
+// Package websocket is a minimal RFC 6455 implementation exposing a WebSocket
+// as a net.Conn carrying a byte stream: the payloads of the data frames read
+// are concatenated and each Write is sent as one binary frame.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const maxControlPayload = 125
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// Conn is a WebSocket connection
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+
+	// read state of the current frame
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	writeLock     sync.Mutex
+	closeSentOnce sync.Once // a single close frame is sent
+	closeOnce     sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool) *Conn {
+	return &Conn{
+		conn:     conn,
+		br:       br,
+		isServer: isServer,
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUpgrade returns whether req asks for a WebSocket upgrade
+func IsUpgrade(req *http.Request) bool {
+	return headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// IsSameOrigin returns whether req was sent from a page of the server it is
+// sent to, or by a client other than a browser (which sends no Origin)
+func IsSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// Upgrade completes the WebSocket handshake of req and hijacks its
+// connection, responding with an error status if it is not a valid upgrade
+func Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if req.Method != "GET" || !IsUpgrade(req) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the http.Server may have set deadlines for the request
+	conn.SetDeadline(time.Time{})
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(resp))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, true), nil
+}
+
+// Dial opens a WebSocket to path on the HTTP server at addr
+func Dial(addr string, path string, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", path, addr, key)
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, ErrBadHandshake
+	}
+	conn.SetDeadline(time.Time{})
+	return newConn(conn, br, false), nil
+}
+
+// Read reads the payload of the data frames received, answering pings and
+// returning io.EOF once a close frame is received
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next data frame, handling the control
+// frames before it
+func (c *Conn) nextFrame() error {
+	var header [2]byte
+	_, err := io.ReadFull(c.br, header[:])
+	if err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&0x80 != 0
+	if c.masked != c.isServer {
+		// clients must mask their frames, servers must not
+		c.writeClose(1002)
+		return errors.New("websocket: bad frame masking")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if err != nil {
+		return err
+	}
+	if length < 0 {
+		c.writeClose(1002)
+		return errors.New("websocket: bad frame length")
+	}
+	if c.masked {
+		_, err = io.ReadFull(c.br, c.mask[:])
+		if err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > maxControlPayload {
+			c.writeClose(1002)
+			return errors.New("websocket: control frame too big")
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(c.br, payload)
+		if err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+		}
+		switch opcode {
+		case opClose:
+			code := 1000
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.writeClose(code)
+			return io.EOF
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		c.writeClose(1002)
+		return fmt.Errorf("websocket: unknown opcode %d", opcode)
+	}
+}
+
+// Write sends p as one binary frame
+func (c *Conn) Write(p []byte) (int, error) {
+	err := c.writeFrame(opBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		buf = append(buf, maskBit|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(length))
+	default:
+		buf = append(buf, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(length))
+	}
+
+	if c.isServer {
+		buf = append(buf, payload...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i&3])
+		}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *Conn) writeClose(code int) {
+	c.closeSentOnce.Do(func() {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], uint16(code))
+		c.writeFrame(opClose, payload[:])
+	})
+}
+
+// Close sends a close frame (best effort) and closes the connection
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeClose(1000)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEcho(t *testing.T) {
+	done := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = io.Copy(conn, conn)
+		conn.Close()
+		done <- err
+	}))
+	defer ts.Close()
+
+	conn, err := Dial(strings.TrimPrefix(ts.URL, "http://"), "/", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello "))
+	conn.writeFrame(opPing, []byte("ping"))
+	conn.Write([]byte(strings.Repeat("x", 70000)))
+
+	buf := make([]byte, 70006)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello "+strings.Repeat("x", 70000) {
+		t.Fatalf("unexpected echo %.20q...", buf)
+	}
+
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not see the close")
+	}
+}
+
+func TestIsSameOrigin(t *testing.T) {
+	for origin, expected := range map[string]bool{
+		"":                          true,
+		"http://nsqd.example:4151":  true,
+		"https://NSQD.example:4151": true,
+		"http://nsqd.example":       false,
+		"http://evil.example:4151":  false,
+		"null":                      false,
+	} {
+		req := httptest.NewRequest("GET", "http://nsqd.example:4151/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if IsSameOrigin(req) != expected {
+			t.Fatalf("IsSameOrigin with Origin %q should be %v", origin, expected)
+		}
+	}
+}
+
+func TestBadHandshake(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upgrade(w, r)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+}
@@ -13,12 +13,14 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
 	"nsq/internal/clusterinfo"
 	"nsq/internal/http_api"
 	"nsq/internal/lg"
+	"nsq/internal/prometheus"
 	"nsq/internal/protocol"
 	"nsq/internal/version"
 
@@ -61,6 +63,7 @@ func NewHTTPServer(ctx *Context) *httpServer {
 
 	client := http_api.NewClient(ctx.nsqadmin.httpClientTLSConfig, ctx.nsqadmin.getOpts().HTTPClientConnectTimeout,
 		ctx.nsqadmin.getOpts().HTTPClientRequestTimeout)
+	client.AuthSecret = ctx.nsqadmin.getOpts().HTTPClientAuthSecret
 
 	router := httprouter.New()
 	router.HandleMethodNotAllowed = true
@@ -81,6 +84,7 @@ func NewHTTPServer(ctx *Context) *httpServer {
 
 	router.Handle("GET", bp("/"), http_api.Decorate(s.indexHandler, log))
 	router.Handle("GET", bp("/ping"), http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Handle("GET", bp("/metrics"), http_api.Decorate(s.metricsHandler, log, http_api.PlainText))
 
 	router.Handle("GET", bp("/topics"), http_api.Decorate(s.indexHandler, log))
 	router.Handle("GET", bp("/topics/:topic"), http_api.Decorate(s.indexHandler, log))
@@ -102,11 +106,13 @@ func NewHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", bp("/api/topics"), http_api.Decorate(s.topicsHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/topics/:topic"), http_api.Decorate(s.topicHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.channelHandler, log, http_api.V1))
+	router.Handle("GET", bp("/api/topics/:topic/:channel/peek"), http_api.Decorate(s.channelPeekHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/nodes"), http_api.Decorate(s.nodesHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/nodes/:node"), http_api.Decorate(s.nodeHandler, log, http_api.V1))
 	router.Handle("POST", bp("/api/topics"), http_api.Decorate(s.createTopicChannelHandler, log, http_api.V1))
 	router.Handle("POST", bp("/api/topics/:topic"), http_api.Decorate(s.topicActionHandler, log, http_api.V1))
 	router.Handle("POST", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.channelActionHandler, log, http_api.V1))
+	router.Handle("POST", bp("/api/topics/:topic/:channel/messages/:id"), http_api.Decorate(s.messageActionHandler, log, http_api.V1))
 	router.Handle("DELETE", bp("/api/nodes/:node"), http_api.Decorate(s.tombstoneNodeForTopicHandler, log, http_api.V1))
 	router.Handle("DELETE", bp("/api/topics/:topic"), http_api.Decorate(s.deleteTopicHandler, log, http_api.V1))
 	router.Handle("DELETE", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.deleteChannelHandler, log, http_api.V1))
@@ -319,6 +325,53 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps
 	}{channelStats[channelName], maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) channelPeekHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	topicName := ps.ByName("topic")
+	channelName := ps.ByName("channel")
+
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	n := 10
+	if v, err := reqParams.Get("n"); err == nil {
+		n, err = strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, http_api.Err{400, "INVALID_N"}
+		}
+	}
+
+	producers, err := s.ci.GetTopicProducers(topicName,
+		s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topic producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+	peeks, err := s.ci.GetNSQDChannelPeek(producers, topicName, channelName, n)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to peek channel - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	return struct {
+		Nodes   []*clusterinfo.ChannelPeek `json:"nodes"`
+		Message string                     `json:"message"`
+	}{peeks, maybeWarnMsg(messages)}, nil
+}
+
 func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
@@ -621,6 +674,70 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 	}{maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) messageActionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	topicName := ps.ByName("topic")
+	channelName := ps.ByName("channel")
+	id := ps.ByName("id")
+
+	var body struct {
+		Action  string `json:"action"`
+		Node    string `json:"node"`
+		Timeout int64  `json:"timeout"` // ms, for "reschedule"
+	}
+
+	if !s.isAuthorizedAdminRequest(req) {
+		return nil, http_api.Err{403, "FORBIDDEN"}
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+
+	switch body.Action {
+	case "delete":
+		err = s.ci.DeleteMessage(topicName, channelName, id, body.Node,
+			s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+			s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+
+		s.notifyAdminMessageAction("delete_message", topicName, channelName, body.Node, id, req)
+	case "requeue":
+		err = s.ci.RequeueMessage(topicName, channelName, id, 0, body.Node,
+			s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+			s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+
+		s.notifyAdminMessageAction("requeue_message", topicName, channelName, body.Node, id, req)
+	case "reschedule":
+		if body.Timeout <= 0 {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+		err = s.ci.RequeueMessage(topicName, channelName, id,
+			time.Duration(body.Timeout)*time.Millisecond, body.Node,
+			s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+			s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+
+		s.notifyAdminMessageAction("reschedule_message", topicName, channelName, body.Node, id, req)
+	default:
+		return nil, http_api.Err{400, "INVALID_ACTION"}
+	}
+
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to %s message - %s", body.Action, err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	return struct {
+		Message string `json:"message"`
+	}{maybeWarnMsg(messages)}, nil
+}
+
 type counterStats struct {
 	Node         string `json:"node"`
 	TopicName    string `json:"topic_name"`
@@ -675,6 +792,76 @@ func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps
 	}{stats, maybeWarnMsg(messages)}, nil
 }
 
+// metricsHandler serves the stats of every nsqd in the cluster in the
+// Prometheus text format, labeled by node
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	e := prometheus.NewEncoder("nsqadmin_")
+
+	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses, s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	if err != nil {
+		if _, ok := err.(clusterinfo.PartialErr); !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+	}
+	e.Gauge("nodes", "Number of nsqd nodes.", float64(len(producers)))
+
+	var topicStats []*clusterinfo.TopicStats
+	failed := 0
+	if len(producers) > 0 {
+		topicStats, _, err = s.ci.GetNSQDStats(producers, "", "", false)
+		if err != nil {
+			pe, ok := err.(clusterinfo.PartialErr)
+			if !ok {
+				s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
+				return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+			}
+			s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+			failed = len(pe.Errors())
+		}
+	}
+	e.Gauge("node_errors", "Number of nsqd nodes that failed to return their stats.", float64(failed))
+
+	for _, t := range topicStats {
+		node := prometheus.Label{Name: "node", Value: t.Node}
+		topic := prometheus.Label{Name: "topic", Value: t.TopicName}
+
+		e.Gauge("topic_depth", "Number of messages queued in the topic.", float64(t.Depth), node, topic)
+		e.Gauge("topic_backend_depth", "Number of messages queued on disk in the topic.", float64(t.BackendDepth), node, topic)
+		e.Gauge("topic_paused", "Whether the topic is paused.", prometheus.Bool(t.Paused), node, topic)
+		e.Counter("topic_messages_total", "Messages published to the topic.", float64(t.MessageCount), node, topic)
+		if t.E2eProcessingLatency != nil {
+			e.Summary("topic_e2e_processing_latency_seconds", "End to end processing latency of the topic's channels.",
+				prometheus.LatencyQuantiles(t.E2eProcessingLatency.Percentiles), uint64(t.E2eProcessingLatency.Count), node, topic)
+		}
+
+		for _, c := range t.Channels {
+			channel := prometheus.Label{Name: "channel", Value: c.ChannelName}
+
+			e.Gauge("channel_depth", "Number of messages queued in the channel.", float64(c.Depth), node, topic, channel)
+			e.Gauge("channel_backend_depth", "Number of messages queued on disk in the channel.", float64(c.BackendDepth), node, topic, channel)
+			e.Gauge("channel_in_flight", "Number of messages in flight in the channel.", float64(c.InFlightCount), node, topic, channel)
+			e.Gauge("channel_deferred", "Number of deferred messages in the channel.", float64(c.DeferredCount), node, topic, channel)
+			e.Gauge("channel_clients", "Number of clients subscribed to the channel.", float64(c.ClientCount), node, topic, channel)
+			e.Gauge("channel_paused", "Whether the channel is paused.", prometheus.Bool(c.Paused), node, topic, channel)
+			e.Gauge("channel_oldest_message_age_seconds", "Age of the oldest message queued in the channel.",
+				c.OldestMessageAge.Seconds(), node, topic, channel)
+			e.Counter("channel_messages_total", "Messages queued to the channel.", float64(c.MessageCount), node, topic, channel)
+			e.Counter("channel_requeued_total", "Messages requeued in the channel.", float64(c.RequeueCount), node, topic, channel)
+			e.Counter("channel_timed_out_total", "Messages timed out in the channel.", float64(c.TimeoutCount), node, topic, channel)
+			if c.E2eProcessingLatency != nil {
+				e.Summary("channel_e2e_processing_latency_seconds", "End to end processing latency of the channel.",
+					prometheus.LatencyQuantiles(c.E2eProcessingLatency.Percentiles), uint64(c.E2eProcessingLatency.Count), node, topic, channel)
+			}
+		}
+	}
+
+	e.Runtime()
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	return e.Bytes(), nil
+}
+
 func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
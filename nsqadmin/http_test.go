@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -211,6 +212,34 @@ func TestHTTPTopicGET(t *testing.T) {
 	test.Equal(t, false, ts.Paused)
 }
 
+func TestHTTPMetricsGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_metrics_get" + strconv.Itoa(int(time.Now().Unix()))
+	nsqds[0].GetTopic(topicName).GetChannel("ch")
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/metrics", nsqadmin1.RealHTTPAddr())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	node := nsqds[0].RealHTTPAddr().String()
+	metrics := string(body)
+	test.Equal(t, true, strings.Contains(metrics, "nsqadmin_nodes 1\n"))
+	test.Equal(t, true, strings.Contains(metrics,
+		fmt.Sprintf("nsqadmin_channel_depth{node=%q,topic=%q,channel=\"ch\"} 0\n", node, topicName)))
+}
+
 func TestHTTPNodesGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -284,6 +313,45 @@ func TestHTTPChannelGET(t *testing.T) {
 	test.Equal(t, 0, len(cs.Clients))
 }
 
+func TestHTTPChannelPeekGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_channel_peek_get" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.PutMessage(nsqd.NewMessage(topic.GenerateID(), []byte("1234")))
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics/%s/ch/peek?n=5", nsqadmin1.RealHTTPAddr(), topicName)
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var doc struct {
+		Nodes []struct {
+			Node   string `json:"node"`
+			Memory []struct {
+				Body []byte `json:"body"`
+			} `json:"memory"`
+		} `json:"nodes"`
+	}
+	err = json.Unmarshal(body, &doc)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(doc.Nodes))
+	test.Equal(t, 1, len(doc.Nodes[0].Memory))
+	test.Equal(t, []byte("1234"), doc.Nodes[0].Memory[0].Body)
+	test.Equal(t, int64(1), channel.Depth())
+}
+
 func TestHTTPNodesSingleGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -559,6 +627,46 @@ func TestHTTPEmptyChannelPOST(t *testing.T) {
 	test.Equal(t, int64(0), channel.Depth())
 }
 
+func TestHTTPMessageActionPOST(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_message_action_post" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := nsqd.NewMessage(topic.GenerateID(), []byte("1234"))
+	channel.StartDeferredTimeout(msg, time.Hour)
+
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, int64(0), channel.Depth())
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics/%s/ch/messages/%s", nsqadmin1.RealHTTPAddr(), topicName, msg.ID)
+	body, _ := json.Marshal(map[string]interface{}{
+		"action": "requeue",
+	})
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	test.Equal(t, int64(1), channel.Depth())
+
+	// no longer deferred
+	body, _ = json.Marshal(map[string]interface{}{
+		"action": "delete",
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 502, resp.StatusCode)
+	resp.Body.Close()
+}
+
 func TestHTTPconfig(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
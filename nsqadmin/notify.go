@@ -14,6 +14,7 @@ type AdminAction struct {
 	Topic     string `json:"topic"`
 	Channel   string `json:"channel,omitempty"`
 	Node      string `json:"node,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
 	Timestamp int64  `json:"timestamp"`
 	User      string `json:"user,omitempty"`
 	RemoteIP  string `json:"remote_ip"`
@@ -39,6 +40,11 @@ func basicAuthUser(req *http.Request) string {
 }
 
 func (s *httpServer) notifyAdminAction(action, topic, channel, node string, req *http.Request) {
+	s.notifyAdminMessageAction(action, topic, channel, node, "", req)
+}
+
+// notifyAdminMessageAction notifies of an action on a single message
+func (s *httpServer) notifyAdminMessageAction(action, topic, channel, node, messageID string, req *http.Request) {
 	if s.ctx.nsqadmin.getOpts().NotificationHTTPEndpoint == "" {
 		return
 	}
@@ -59,6 +65,7 @@ func (s *httpServer) notifyAdminAction(action, topic, channel, node string, req
 		Topic:     topic,
 		Channel:   channel,
 		Node:      node,
+		MessageID: messageID,
 		Timestamp: time.Now().Unix(),
 		User:      basicAuthUser(req),
 		RemoteIP:  req.RemoteAddr,
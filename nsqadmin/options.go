@@ -33,6 +33,7 @@ type Options struct {
 	HTTPClientTLSRootCAFile         string `flag:"http-client-tls-root-ca-file"`
 	HTTPClientTLSCert               string `flag:"http-client-tls-cert"`
 	HTTPClientTLSKey                string `flag:"http-client-tls-key"`
+	HTTPClientAuthSecret            string `flag:"http-client-auth-secret"`
 
 	AllowConfigFromCIDR string `flag:"allow-config-from-cidr"`
 
@@ -39,6 +39,7 @@ var metricType = function(key) {
         'timeout_count':          'counter',
         'message_count':          'counter',
         'clients':                'gauge',
+        'oldest_message_age':     'gauge',
         '*_bytes':                'gauge',
         'gc_pause_*':             'gauge',
         'gc_runs':                'counter',
@@ -1,4 +1,5 @@
 var $ = require('jquery');
+var _ = require('underscore');
 
 window.jQuery = $;
 var bootstrap = require('bootstrap'); //eslint-disable-line no-unused-vars
@@ -9,13 +10,17 @@ var AppState = require('../app_state');
 
 var BaseView = require('./base');
 
+var peekTemplate = require('./channel_peek.hbs');
+
 var ChannelView = BaseView.extend({
     className: 'channel container-fluid',
 
     template: require('./spinner.hbs'),
 
     events: {
-        'click .channel-actions button': 'channelAction'
+        'click .channel-actions button': 'channelAction',
+        'click .channel-peek button': 'peekMessages',
+        'click .message-actions button': 'messageAction'
     },
 
     initialize: function() {
@@ -55,7 +60,81 @@ var ChannelView = BaseView.extend({
                     .fail(this.handleAJAXError.bind(this));
             }
         }.bind(this));
+    },
+
+    peekMessages: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        var count = $(e.currentTarget).data('count');
+        $.get(this.model.url() + '/peek', {'n': count})
+            .done(function(data) {
+                var queues = [
+                    ['in_flight', 'in-flight'],
+                    ['deferred', 'deferred'],
+                    ['memory', 'memory'],
+                    ['backend', 'disk']
+                ];
+                var nodes = _.map(data['nodes'] || [], function(node) {
+                    var messages = [];
+                    _.each(queues, function(q) {
+                        _.each(node[q[0]] || [], function(msg) {
+                            messages.push({
+                                'queue': q[1],
+                                'id': msg['id'],
+                                'published': new Date(msg['timestamp'] / 1000000).toISOString(),
+                                'attempts': msg['attempts'],
+                                'body': decodeBody(msg['body']),
+                                'pending': q[0] === 'in_flight' || q[0] === 'deferred'
+                            });
+                        });
+                    });
+                    node['hostname_port'] = node['hostname'] + ':' + node['node'].split(':').pop();
+                    node['messages'] = messages;
+                    node['count'] = messages.length;
+                    return node;
+                });
+                this.$('.channel-peek-results').html(peekTemplate({
+                    'nodes': nodes,
+                    'message': data['message'],
+                    'isAdmin': this.model.get('isAdmin')
+                }));
+            }.bind(this))
+            .fail(this.handleAJAXError.bind(this));
+    },
+
+    messageAction: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        var action = $(e.currentTarget).data('action');
+        var cell = $(e.currentTarget).closest('.message-actions');
+        var id = cell.data('id');
+        var txt = 'Are you sure you want to <strong>' +
+            action + '</strong> message <em>' + id + '</em>?';
+        bootbox.confirm(txt, function(result) {
+            if (result !== true) {
+                return;
+            }
+            $.post(this.model.url() + '/messages/' + encodeURIComponent(id),
+                JSON.stringify({'action': action, 'node': cell.data('node')}))
+                .done(function() {
+                    this.$('.channel-peek button').click();
+                }.bind(this))
+                .fail(this.handleAJAXError.bind(this));
+        }.bind(this));
     }
 });
 
+// decodeBody returns the text of a (base64 encoded) message body
+function decodeBody(body) {
+    if (!body) {
+        return '';
+    }
+    var raw = window.atob(body);
+    try {
+        return decodeURIComponent(escape(raw));
+    } catch (err) {
+        return raw;
+    }
+}
+
 module.exports = ChannelView;
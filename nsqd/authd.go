@@ -0,0 +1,89 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"nsq/internal/auth"
+	"nsq/internal/quantile"
+)
+
+// percentiles of the auth server query latency, over the E2E processing
+// latency window
+var authLatencyPercentiles = []float64{0.5, 0.95, 0.99}
+
+// authMetrics counts the auth server queries
+type authMetrics struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	QueryCount    uint64 // queries of the auth servers
+	ErrorCount    uint64 // queries not answered with an auth state
+	CacheHitCount uint64 // answered from the cache
+	StaleCount    uint64 // answered from the cache after expiry, no auth server reachable
+
+	latency *quantile.Quantile
+}
+
+type authStats struct {
+	Queries   uint64           `json:"queries"`
+	Errors    uint64           `json:"errors"`
+	CacheHits uint64           `json:"cache_hits"`
+	StaleHits uint64           `json:"stale_hits"`
+	Latency   *quantile.Result `json:"latency"`
+}
+
+func newAuthMetrics(opts *Options) *authMetrics {
+	return &authMetrics{
+		latency: quantile.New(opts.E2EProcessingLatencyWindowTime, authLatencyPercentiles),
+	}
+}
+
+// queryAuthd returns the auth state of a client from the cache or the auth
+// servers, falling back on the expired one if none can be reached
+func (n *NSQD) queryAuthd(remoteIP string, tlsEnabled bool, commonName string, secret string) (*auth.State, error) {
+	m := n.authMetrics
+	if authState, ok := n.authCache.Get(remoteIP, tlsEnabled, commonName, secret); ok {
+		atomic.AddUint64(&m.CacheHitCount, 1)
+		return authState, nil
+	}
+
+	opts := n.getOpts()
+	start := time.Now()
+	atomic.AddUint64(&m.QueryCount, 1)
+	authState, err := auth.QueryAnyAuthd(opts.AuthHTTPAddresses, opts.AuthHTTPHedgeDelay,
+		remoteIP, tlsEnabled, commonName, secret,
+		opts.HTTPClientConnectTimeout,
+		opts.HTTPClientRequestTimeout)
+	m.latency.Insert(start.UnixNano())
+	if err != nil {
+		atomic.AddUint64(&m.ErrorCount, 1)
+		if err != auth.ErrUnavailable {
+			// denied, not to be used even if the auth servers go down
+			n.authCache.Remove(remoteIP, tlsEnabled, commonName, secret)
+			return nil, err
+		}
+		authState, ok := n.authCache.GetStale(remoteIP, tlsEnabled, commonName, secret)
+		if !ok {
+			return nil, err
+		}
+		n.logf(LOG_WARN, "AUTH: using expired auth state of client(%s) - %s", remoteIP, err)
+		atomic.AddUint64(&m.StaleCount, 1)
+		return authState, nil
+	}
+	n.authCache.Set(remoteIP, tlsEnabled, commonName, secret, authState)
+	return authState, nil
+}
+
+// getAuthStats returns the auth server query stats, nil if there is none
+func (n *NSQD) getAuthStats() *authStats {
+	if len(n.getOpts().AuthHTTPAddresses) == 0 {
+		return nil
+	}
+	m := n.authMetrics
+	return &authStats{
+		Queries:   atomic.LoadUint64(&m.QueryCount),
+		Errors:    atomic.LoadUint64(&m.ErrorCount),
+		CacheHits: atomic.LoadUint64(&m.CacheHitCount),
+		StaleHits: atomic.LoadUint64(&m.StaleCount),
+		Latency:   m.latency.Result(),
+	}
+}
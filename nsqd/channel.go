@@ -37,15 +37,22 @@ type Consumer interface {
 //channel最重要的几个结构应该是跟延迟投递消息，以及可靠性保证的消息的相关数据结构。两者基本类似，都是用最小堆优先级队列实现的。
 type Channel struct { //nsqd的channel是最接近消费者端的，有他特有的东西，包括投递，确认等；
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	requeueCount uint64 // 需要重新排队的消息数
-	messageCount uint64 // 接收到的消息的总数
-	timeoutCount uint64 // 正在发送的消息的数量
+	requeueCount    uint64 // 需要重新排队的消息数
+	messageCount    uint64 // 接收到的消息的总数
+	timeoutCount    uint64 // 正在发送的消息的数量
+	deadLetterCount uint64 // 超过最大投递次数而被转移到死信 topic 的消息数
+	filteredCount   uint64 // 未通过过滤表达式而被自动 FIN 的消息数
+	quotaDrops      uint64 // 因超出配额而被丢弃的消息数
+	depthBytes      int64  // 队列中（内存+磁盘）消息体的总大小，重启后从元数据恢复
+	heldCount       int64  // 等待同一 ordering key 的前一条消息完成的消息数（计入 Depth）
+	idleSince       int64  // 最后一个客户端离开的时间（UnixNano），有客户端时为 0
 
 	sync.RWMutex
 
-	topicName string   // 其所属的 topic 名称
-	name      string   // channel 名称
-	ctx       *context // 存放nsqd 实例
+	topicName string       // 其所属的 topic 名称
+	name      string       // channel 名称
+	ctx       *context     // 存放nsqd 实例
+	config    *queueConfig // 此 channel 覆盖的配置项，未覆盖的从 topic 及 nsqd 的配置继承
 
 	backend BackendQueue //磁盘持久化存储队列
 	//注意此处的Message结构，和Topic中的一样。代表生产者或者消费者的一条消息。是nsq消息队列系统中最基本的元素。
@@ -61,6 +68,18 @@ type Channel struct { //nsqd的channel是最接近消费者端的，有他特有
 	deleteCallback func(*Channel)     //实际上就是DeleteExistingChannel，删除回调函数（同 topic 的 deleteCallback 作用类似）
 	deleter        sync.Once
 
+	// dead-letter policy, guarded by the channel lock
+	maxAttempts     uint16 // 0 disables dead-lettering
+	deadLetterTopic string
+
+	filter *msgFilter // nil delivers everything, guarded by the channel lock
+
+	ages *ageTracker // 等待中（内存+磁盘）消息的发布时间，用于统计最老消息的年龄
+
+	// push subscriptions by URL, their consumers are also in clients
+	pushConsumers map[string]*pushConsumer
+	pushMutex     sync.Mutex
+
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
 
@@ -69,11 +88,19 @@ type Channel struct { //nsqd的channel是最接近消费者端的，有他特有
 	deferredMessages map[MessageID]*pqueue.Item
 	deferredPQ       pqueue.PriorityQueue //被延迟发送的消息集合，它是一个最小堆优先级队列,其中优先级比较字段为消息发送时间(Item.Priority)
 	deferredMutex    sync.Mutex
+	deferredStore    *deferredStore //延迟消息及其到期时间的持久化存储，使其在重启或崩溃后不丢失（ephemeral channel 为 nil）
 	//正在发送中的消息记录，直到收到客户端的FIN才会删除，否则timeout到来会重传消息的.
 	//这里应用层有个坑，如果程序处理延迟了，那么可能重复投递，那怎么办,应用层得注意这个，设置了timeout就得接受有重传的存在，（因此client需要对消息做去重处理 de-duplicate）
 	inFlightMessages map[MessageID]*Message //已经发送给client但是没有得到client确认的消息,叫inFlightMessages。
 	inFlightPQ       inFlightPqueue         //代表正在发送的消息集合，同样是最小堆优先级队列，优先级比较字段也为消息发送时间(Message.pri)。
 	inFlightMutex    sync.Mutex
+
+	// ordered delivery: at most one message per ordering key is in flight,
+	// later messages for that key are held until it is FIN'd or dead-lettered
+	ordered      bool
+	keyOwners    map[string]MessageID  // 每个 key 当前正在投递（或已被预留）的消息
+	heldMessages map[string][]*Message // 每个 key 等待前一条消息完成的消息，同时记录在 deferredStore 中
+	orderMutex   sync.Mutex
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
@@ -82,16 +109,21 @@ type Channel struct { //nsqd的channel是最接近消费者端的，有他特有
 //其一，nsqd.Start->nsqd.LoadMetadata->topic.GetChannel->topic.getOrCreateChannel->NewChannel；//刚启动的时候
 // 其二，httpServer.doCreateChannel->topic.GetChannel；//消费者订阅channel的时候
 // 其三，protocolV2.SUB->topic.GetChannel。//客户端在订阅channel的时候
-func NewChannel(topicName string, channelName string, ctx *context,
+func NewChannel(topicName string, channelName string, config *queueConfig, ctx *context,
 	deleteCallback func(*Channel)) *Channel {
 
 	c := &Channel{
 		topicName:      topicName,
 		name:           channelName,
-		memoryMsgChan:  make(chan *Message, ctx.nsqd.getOpts().MemQueueSize),
+		memoryMsgChan:  make(chan *Message, config.memQueueSize()),
 		clients:        make(map[int64]Consumer),
 		deleteCallback: deleteCallback,
 		ctx:            ctx,
+		keyOwners:      make(map[string]MessageID),
+		heldMessages:   make(map[string][]*Message),
+		config:         config,
+		ages:           newAgeTracker(),
+		pushConsumers:  make(map[string]*pushConsumer),
 	}
 	if len(ctx.nsqd.getOpts().E2EProcessingLatencyPercentiles) > 0 {
 		c.e2eProcessingLatencyStream = quantile.New(
@@ -121,11 +153,18 @@ func NewChannel(topicName string, channelName string, ctx *context,
 			ctx.nsqd.getOpts().DataPath,
 			ctx.nsqd.getOpts().MaxBytesPerFile,
 			int32(minValidMsgLength),
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			ctx.nsqd.getOpts().SyncEvery,
+			backendMaxMsgSize(ctx.nsqd.getOpts()),
+			config.syncEvery(),
 			ctx.nsqd.getOpts().SyncTimeout,
 			dqLogf,
 		)
+
+		var err error
+		c.deferredStore, err = newDeferredStore(
+			deferredStoreFileName(ctx.nsqd.getOpts().DataPath, backendName), config.syncEvery(), ctx.nsqd.logf)
+		if err != nil {
+			ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to open deferred store - %s", c.name, err)
+		}
 	}
 
 	c.ctx.nsqd.Notify(c) // 5. 通知 lookupd 添加注册信息
@@ -134,7 +173,7 @@ func NewChannel(topicName string, channelName string, ctx *context,
 }
 
 func (c *Channel) initPQ() {
-	pqSize := int(math.Max(1, float64(c.ctx.nsqd.getOpts().MemQueueSize)/10))
+	pqSize := int(math.Max(1, float64(c.config.memQueueSize())/10))
 	//inFlightPQ和deferredPQ是两个数组
 	c.inFlightMutex.Lock()
 	c.inFlightMessages = make(map[MessageID]*Message)
@@ -167,13 +206,28 @@ func (c *Channel) Close() error { // 只是将三个消息队列中的消息刷
 }
 
 func (c *Channel) exit(deleted bool) error {
+	c.closePushConsumers()
+
 	c.exitMutex.Lock()
 	defer c.exitMutex.Unlock()
 
 	if !atomic.CompareAndSwapInt32(&c.exitFlag, 0, 1) { // 1. 保证还未被设置 exitFlag，即还在运行中，同时设置 exitFlag
 		return errors.New("exiting")
 	}
+	return c.shutdown(deleted)
+}
 
+// deleteExiting is Delete for a channel whose exitFlag is already set
+func (c *Channel) deleteExiting() error {
+	c.closePushConsumers()
+
+	c.exitMutex.Lock()
+	defer c.exitMutex.Unlock()
+	return c.shutdown(true)
+}
+
+// shutdown is the rest of exit once the exitFlag is set, under the exitMutex
+func (c *Channel) shutdown(deleted bool) error {
 	if deleted { // 2. 若需要删除数据，则通知 nsqlookupd，有 channel 被删除
 		c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): deleting", c.name)
 
@@ -195,11 +249,16 @@ func (c *Channel) exit(deleted bool) error {
 	if deleted { // 4. 清空此 channel 所维护的内存消息队列和持久化存储消息队列中的消息
 		// empty the queue (deletes the backend files, too)
 		c.Empty()
+		c.deferredStore.Delete()
 		return c.backend.Delete() // 5. 删除持久化存储消息队列中的消息
 	}
 
 	// write anything leftover to disk
-	c.flush()                // 6. 强制将内存消息队列、以及两个发送消息优先级队列中的消息写到持久化存储中
+	c.flush() // 6. 强制将内存消息队列、以及两个发送消息优先级队列中的消息写到持久化存储中
+	err := c.deferredStore.Close()
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to close deferred store - %s", c.name, err)
+	}
 	return c.backend.Close() // 7. 关闭持久化存储消息队列
 }
 
@@ -209,6 +268,11 @@ func (c *Channel) Empty() error {
 	defer c.Unlock()
 
 	c.initPQ() // 1. 重新初始化（清空） in-flight queue 及 deferred queue
+	c.orderMutex.Lock()
+	c.keyOwners = make(map[string]MessageID)
+	c.heldMessages = make(map[string][]*Message)
+	atomic.StoreInt64(&c.heldCount, 0)
+	c.orderMutex.Unlock()
 	// 2. 清空由 channel 为客户端维护的一些信息，比如 当前正在发送的消息的数量 InFlightCount
 	// 同时更新了 ReadyStateChan
 	for _, client := range c.clients {
@@ -222,13 +286,22 @@ func (c *Channel) Empty() error {
 			goto finish
 		}
 	}
-	// 4. 最后将后端持久化存储中的消息清空
 finish:
+	// 4. 最后将后端持久化存储中的消息清空
+	atomic.StoreInt64(&c.depthBytes, 0)
+	c.ages.reset()
+	err := c.deferredStore.Empty()
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to empty deferred store - %s", c.name, err)
+	}
 	return c.backend.Empty()
 }
 
 // flush persists all the messages in internal memory buffers to the backend
 // it does not drain inflight/deferred because it is only called in Close()
+//
+// deferred messages are only written to the backend for channels without a
+// deferredStore, otherwise they keep their schedule in the store
 // 将未消费的消息都写到持久化存储中，
 // 主要包括三个消息集合：memoryMsgChan、inFlightMessages和deferredMessages
 func (c *Channel) flush() error {
@@ -260,7 +333,23 @@ finish:
 		}
 	}
 	c.inFlightMutex.Unlock()
+	// held messages are kept in the deferredStore, if any
+	if c.deferredStore == nil {
+		c.orderMutex.Lock()
+		for _, held := range c.heldMessages {
+			for _, msg := range held {
+				err := writeMessageToBackend(&msgBuf, msg, c.backend)
+				if err != nil {
+					c.ctx.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+				}
+			}
+		}
+		c.orderMutex.Unlock()
+	}
 	// 3. 将被推迟发送的消息集合中的 deferredMessages 消息也到持久化存储
+	if c.deferredStore != nil {
+		return nil
+	}
 	c.deferredMutex.Lock()
 	for _, item := range c.deferredMessages {
 		msg := item.Value.(*Message)
@@ -275,7 +364,70 @@ finish:
 }
 
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
+	return int64(len(c.memoryMsgChan)) + c.backend.Depth() + atomic.LoadInt64(&c.heldCount)
+}
+
+// DepthBytes returns the size of the message bodies queued
+func (c *Channel) DepthBytes() int64 {
+	return atomic.LoadInt64(&c.depthBytes)
+}
+
+// dequeued accounts for msg having been read off the memory queue or backend
+func (c *Channel) dequeued(msg *Message) {
+	subDepthBytes(&c.depthBytes, int64(len(msg.Body)))
+	c.ages.remove(msg.Timestamp)
+}
+
+// OldestMessageTimestamp returns the publish time (to the second) of the
+// oldest message waiting in the memory queue or backend, 0 if there are none
+func (c *Channel) OldestMessageTimestamp() int64 {
+	return c.ages.Oldest()
+}
+
+// oldestPendingTimestamp is OldestMessageTimestamp including the in-flight
+// messages, which are written to the backend on exit
+func (c *Channel) oldestPendingTimestamp() int64 {
+	oldest := c.ages.Oldest()
+	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		if oldest == 0 || msg.Timestamp < oldest {
+			oldest = msg.Timestamp
+		}
+	}
+	c.inFlightMutex.Unlock()
+	return oldest
+}
+
+// pendingDepthBytes is DepthBytes including the in-flight messages, which are
+// written to the backend on exit
+func (c *Channel) pendingDepthBytes() int64 {
+	n := atomic.LoadInt64(&c.depthBytes)
+	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		n += int64(len(msg.Body))
+	}
+	c.inFlightMutex.Unlock()
+	return n
+}
+
+// restoreOldest accounts for the messages left in the backend by a previous
+// run, the oldest of which was published at ts
+func (c *Channel) restoreOldest(ts int64) {
+	if depth := c.backend.Depth(); depth > 0 {
+		c.ages.restore(depth, ts)
+	}
+}
+
+// restoreDepthBytes accounts for the size of the messages left in the backend
+// by a previous run
+func (c *Channel) restoreDepthBytes(n int64) {
+	if c.backend.Depth() > 0 {
+		atomic.StoreInt64(&c.depthBytes, n)
+	}
+}
+
+func (c *Channel) overQuota(n int64, size int64) bool {
+	return c.config.overQuota(c.Depth(), c.DepthBytes(), n, size)
 }
 
 func (c *Channel) Pause() error {
@@ -317,6 +469,25 @@ func (c *Channel) PutMessage(m *Message) error {
 	if c.Exiting() {
 		return errors.New("exiting")
 	}
+	if c.overQuota(1, int64(len(m.Body))) {
+		// reject 策略已在发布时检查过，这里只处理丢弃策略
+		switch c.config.overflowPolicy() {
+		case overflowDropNewest:
+			atomic.AddUint64(&c.quotaDrops, 1)
+			return nil
+		case overflowDropOldest:
+			for c.overQuota(1, int64(len(m.Body))) {
+				dropped, ok := dropOldestMessage(c.memoryMsgChan, c.backend)
+				if !ok {
+					break
+				}
+				if dropped != nil {
+					c.dequeued(dropped)
+				}
+				atomic.AddUint64(&c.quotaDrops, 1)
+			}
+		}
+	}
 	err := c.put(m) //将消息放入channel.memoryMsgChan里面，或者放到后台持久化里面，如果客户端来不及接受的话, 那就存入文件。
 	if err != nil {
 		return err
@@ -335,13 +506,20 @@ func (c *Channel) PutMessage(m *Message) error {
 //而管道的另一端，则是所有订阅到这上面的client的消息处理协程
 
 func (c *Channel) put(m *Message) error {
+	atomic.AddInt64(&c.depthBytes, int64(len(m.Body)))
+	// requeued, deferred and held messages come back through here too, so
+	// each dequeued() matches one add
+	c.ages.add(m.Timestamp)
 	select {
-	case c.memoryMsgChan <- m: //此memoryMsgChan中的消息只有flush函数才能拿去。
+	case memoryQueue(c.config.overflowPolicy(), c.memoryMsgChan, c.backend) <- m: //此memoryMsgChan中的消息只有flush函数才能拿去。
 	default:
 		b := bufferPoolGet()
 		err := writeMessageToBackend(b, m, c.backend)
 		bufferPoolPut(b)
 		c.ctx.nsqd.SetHealth(err)
+		if err != nil || c.ephemeral {
+			c.dequeued(m)
+		}
 		if err != nil {
 			c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
 				c.name, err)
@@ -393,6 +571,7 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
+	c.releaseOrderingKey(msg)
 	return nil
 }
 
@@ -413,6 +592,10 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	}
 	c.removeFromInFlightPQ(msg) // 2. 同时将消息从 in-flight queue 中移除，并更新 chanel 维护的消息重入队数量 requeueCount
 	atomic.AddUint64(&c.requeueCount, 1)
+
+	if c.shouldDeadLetter(msg) {
+		return c.deadLetter(msg)
+	}
 	// 3. 若 timeout 为0,则将消息重新入队。即调用 channel.put 方法，将消息添加到 memoryMsgChan 或 backend
 	if timeout == 0 {
 		c.exitMutex.RLock()
@@ -429,6 +612,75 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	return c.StartDeferredTimeout(msg, timeout) // 否则，创建一个延迟消息，并设置延迟时间
 }
 
+var errMessageNotPending = errors.New("ID not in flight or deferred")
+
+// DeleteMessage discards an in-flight or deferred message, whichever client
+// it is in flight to
+func (c *Channel) DeleteMessage(id MessageID) error {
+	msg, err := c.popPendingMessage(id)
+	if err != nil {
+		return err
+	}
+	c.releaseOrderingKey(msg)
+	return nil
+}
+
+// RescheduleMessage moves an in-flight or deferred message, whichever client
+// it is in flight to, back to the queue after timeout (immediately if 0)
+func (c *Channel) RescheduleMessage(id MessageID, timeout time.Duration) error {
+	msg, err := c.popPendingMessage(id)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.requeueCount, 1)
+
+	if timeout == 0 {
+		c.exitMutex.RLock()
+		if c.Exiting() {
+			c.exitMutex.RUnlock()
+			return errors.New("exiting")
+		}
+		err := c.put(msg)
+		c.exitMutex.RUnlock()
+		return err
+	}
+	return c.StartDeferredTimeout(msg, timeout)
+}
+
+// popPendingMessage removes a message from the in-flight or deferred set,
+// the client an in-flight message was sent to is told it timed out
+func (c *Channel) popPendingMessage(id MessageID) (*Message, error) {
+	c.inFlightMutex.Lock()
+	msg, ok := c.inFlightMessages[id]
+	if ok {
+		delete(c.inFlightMessages, id)
+		if msg.index != -1 {
+			c.inFlightPQ.Remove(msg.index)
+		}
+	}
+	c.inFlightMutex.Unlock()
+	if ok {
+		c.RLock()
+		client, ok := c.clients[msg.clientID]
+		c.RUnlock()
+		if ok {
+			client.TimedOutMessage()
+		}
+		return msg, nil
+	}
+
+	item, err := c.popDeferredMessage(id)
+	if err != nil {
+		return nil, errMessageNotPending
+	}
+	c.deferredMutex.Lock()
+	if item.Index != -1 {
+		heap.Remove(&c.deferredPQ, item.Index)
+	}
+	c.deferredMutex.Unlock()
+	return item.Value.(*Message), nil
+}
+
 // AddClient adds a client to the Channel's client list
 //SUB订阅消息仅限于TCP协议，客户端通过SUB命令订阅上来，最后调用cannnel.AddClient函数，
 // 函数很简单，就在channel上记录了一下当前clientid，以备后面进行清理等使用
@@ -442,7 +694,7 @@ func (c *Channel) AddClient(clientID int64, client Consumer) error {
 		return nil
 	}
 
-	maxChannelConsumers := c.ctx.nsqd.getOpts().MaxChannelConsumers
+	maxChannelConsumers := c.config.maxChannelConsumers()
 	if maxChannelConsumers != 0 && len(c.clients) >= maxChannelConsumers {
 		return errors.New("E_TOO_MANY_CHANNEL_CONSUMERS")
 	}
@@ -503,10 +755,31 @@ func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) erro
 	if err != nil {
 		return err
 	}
+	err = c.deferredStore.Add(msg, absTs)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to persist deferred msg(%s) - %s", c.name, msg.ID, err)
+	}
 	c.addToDeferredPQ(item) // 4. 将 item 放入到 deferred message 优先级队列
 	return nil
 }
 
+// loadDeferred restores the deferred messages recorded in the deferredStore
+// (ie. from before a restart or crash) with their original due time
+func (c *Channel) loadDeferred() {
+	entries := c.deferredStore.Entries()
+	if len(entries) == 0 {
+		return
+	}
+	c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): loading %d deferred messages", c.name, len(entries))
+	for _, e := range entries {
+		item := &pqueue.Item{Value: e.msg, Priority: e.due}
+		if c.pushDeferredMessage(item) != nil {
+			continue
+		}
+		c.addToDeferredPQ(item)
+	}
+}
+
 // pushInFlightMessage atomically adds a message to the in-flight dictionary
 func (c *Channel) pushInFlightMessage(msg *Message) error {
 	c.inFlightMutex.Lock()
@@ -578,6 +851,10 @@ func (c *Channel) popDeferredMessage(id MessageID) (*pqueue.Item, error) {
 	}
 	delete(c.deferredMessages, id)
 	c.deferredMutex.Unlock()
+	err := c.deferredStore.Remove(id)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to remove deferred msg(%s) from store - %s", c.name, id, err)
+	}
 	return item, nil
 }
 
@@ -628,6 +905,15 @@ exit:
 
 ///把 InFlightQueue里,优先级小于参数t的,全部重新发送
 func (c *Channel) processInFlightQueue(t int64) bool {
+	// messages that exhausted their attempts are published to the dead-letter
+	// topic only after exitMutex is released, since that acquires the NSQD lock
+	var deadLetters []*Message
+	defer func() {
+		for _, msg := range deadLetters {
+			c.deadLetter(msg)
+		}
+	}()
+
 	c.exitMutex.RLock() // 先检查是否已经退出
 	defer c.exitMutex.RUnlock()
 
@@ -659,9 +945,227 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 		if ok {
 			client.TimedOutMessage()
 		}
+		if c.shouldDeadLetter(msg) {
+			deadLetters = append(deadLetters, msg)
+			continue
+		}
 		c.put(msg) //nolint 消息在channel中发起重新投递，重新塞入原始发送队列: channel.memoryMsgChan <- m
 	}
 
 exit:
 	return dirty
 }
+
+// SetDeadLetter configures the channel to move messages that have been
+// delivered maxAttempts times to topicName instead of redelivering them.
+// A maxAttempts of 0 disables dead-lettering.
+func (c *Channel) SetDeadLetter(maxAttempts uint16, topicName string) {
+	c.Lock()
+	c.maxAttempts = maxAttempts
+	c.deadLetterTopic = topicName
+	c.Unlock()
+}
+
+// DeadLetter returns the channel's max attempts and dead-letter topic
+func (c *Channel) DeadLetter() (uint16, string) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.maxAttempts, c.deadLetterTopic
+}
+
+func (c *Channel) shouldDeadLetter(msg *Message) bool {
+	maxAttempts, topicName := c.DeadLetter()
+	return maxAttempts > 0 && topicName != "" && msg.Attempts >= maxAttempts
+}
+
+// how long a message that failed to be dead-lettered is deferred for
+const deadLetterRetryDelay = 5 * time.Second
+
+// deadLetter publishes a copy of msg to the channel's dead-letter topic.
+// The caller must not hold the channel's exitMutex.
+func (c *Channel) deadLetter(msg *Message) error {
+	_, topicName := c.DeadLetter()
+	// the dead-letter topic is created implicitly, like by a publish
+	topic, err := c.ctx.nsqd.getImplicitTopic(topicName)
+	if err == nil {
+		dlMsg := NewMessage(topic.GenerateID(), msg.Body)
+		dlMsg.Timestamp = msg.Timestamp
+		dlMsg.Headers = msg.Headers
+		err = topic.putDeadLetter(dlMsg)
+	}
+	if err != nil {
+		// keep the message rather than losing it, it is dead-lettered again
+		// once it comes back and fails its next attempt
+		c.ctx.nsqd.logf(LOG_ERROR,
+			"CHANNEL(%s): failed to dead-letter msg(%s) after %d attempts to topic(%s), deferring it for %s - %s",
+			c.name, msg.ID, msg.Attempts, topicName, deadLetterRetryDelay, err)
+		return c.StartDeferredTimeout(msg, deadLetterRetryDelay)
+	}
+	c.releaseOrderingKey(msg)
+	atomic.AddUint64(&c.deadLetterCount, 1)
+	c.ctx.nsqd.logf(LOG_WARN,
+		"CHANNEL(%s): dead-lettered msg(%s) after %d attempts to topic(%s)",
+		c.name, msg.ID, msg.Attempts, topicName)
+	return nil
+}
+
+// SetFilter sets the filter messages must match to be delivered, nil
+// delivers every message
+func (c *Channel) SetFilter(filter *msgFilter) {
+	c.Lock()
+	c.filter = filter
+	c.Unlock()
+}
+
+// Config returns the channel's configuration overrides
+func (c *Channel) Config() QueueConfig {
+	return c.config.Get()
+}
+
+// SetConfig replaces the channel's configuration overrides
+func (c *Channel) SetConfig(config QueueConfig) {
+	c.config.Set(config)
+}
+
+// MsgTimeout returns the in-flight timeout for clients that did not IDENTIFY
+// with their own msg_timeout
+func (c *Channel) MsgTimeout() time.Duration {
+	return c.config.msgTimeout()
+}
+
+// MaxChannelConsumers returns the channel's consumer limit (0 is unlimited)
+func (c *Channel) MaxChannelConsumers() int {
+	return c.config.maxChannelConsumers()
+}
+
+// Filter returns the channel's filter expression ("" when unfiltered)
+func (c *Channel) Filter() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.filter.String()
+}
+
+// FilterMessage returns whether msg should be delivered, messages that do not
+// match the channel's filter are auto-finished (ie. dropped) and counted
+func (c *Channel) FilterMessage(msg *Message) bool {
+	c.RLock()
+	filter := c.filter
+	c.RUnlock()
+
+	if filter.Match(msg) {
+		return true
+	}
+	atomic.AddUint64(&c.filteredCount, 1)
+	return false
+}
+
+// SetOrdered switches ordered delivery by ordering key on or off, switching
+// it off requeues every held message
+func (c *Channel) SetOrdered(ordered bool) {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	c.orderMutex.Lock()
+	defer c.orderMutex.Unlock()
+
+	c.ordered = ordered
+	if ordered || c.Exiting() {
+		return
+	}
+	for _, held := range c.heldMessages {
+		for _, msg := range held {
+			c.unholdMessage(msg)
+			c.put(msg) //nolint
+		}
+	}
+	c.keyOwners = make(map[string]MessageID)
+	c.heldMessages = make(map[string][]*Message)
+	atomic.StoreInt64(&c.heldCount, 0)
+}
+
+// Ordered returns whether the channel delivers messages in order by key
+func (c *Channel) Ordered() bool {
+	c.orderMutex.Lock()
+	defer c.orderMutex.Unlock()
+	return c.ordered
+}
+
+// HeldCount returns the number of messages waiting on an earlier message
+// with the same ordering key
+func (c *Channel) HeldCount() int {
+	return int(atomic.LoadInt64(&c.heldCount))
+}
+
+// acquireOrderingKey returns whether msg can be delivered now, in ordered
+// mode a keyed message is held while another message for its key is in
+// flight (or requeued) and re-queued by releaseOrderingKey
+func (c *Channel) acquireOrderingKey(msg *Message) bool {
+	key := msg.Headers[orderingKeyHeader]
+	if key == "" {
+		return true
+	}
+
+	c.orderMutex.Lock()
+	defer c.orderMutex.Unlock()
+
+	if !c.ordered {
+		return true
+	}
+	owner, ok := c.keyOwners[key]
+	if !ok {
+		c.keyOwners[key] = msg.ID
+		return true
+	}
+	if owner == msg.ID {
+		return true
+	}
+	c.heldMessages[key] = append(c.heldMessages[key], msg)
+	atomic.AddInt64(&c.heldCount, 1)
+	// it has already left the backend, record it so that it survives a crash
+	// (it is then reloaded as a deferred message that is already due)
+	err := c.deferredStore.Add(msg, msg.Timestamp)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to persist held msg(%s) - %s", c.name, msg.ID, err)
+	}
+	return false
+}
+
+// unholdMessage accounts for a held message being re-queued
+func (c *Channel) unholdMessage(msg *Message) {
+	atomic.AddInt64(&c.heldCount, -1)
+	err := c.deferredStore.Remove(msg.ID)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to remove held msg(%s) - %s", c.name, msg.ID, err)
+	}
+}
+
+// releaseOrderingKey is called once msg has left the channel (FIN'd or
+// dead-lettered) to hand its ordering key to the next held message
+func (c *Channel) releaseOrderingKey(msg *Message) {
+	key := msg.Headers[orderingKeyHeader]
+	if key == "" {
+		return
+	}
+
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	c.orderMutex.Lock()
+	defer c.orderMutex.Unlock()
+
+	if owner, ok := c.keyOwners[key]; !ok || owner != msg.ID || c.Exiting() {
+		return
+	}
+	held := c.heldMessages[key]
+	if len(held) == 0 {
+		delete(c.keyOwners, key)
+		return
+	}
+	next := held[0]
+	if len(held) == 1 {
+		delete(c.heldMessages, key)
+	} else {
+		c.heldMessages[key] = held[1:]
+	}
+	c.unholdMessage(next)
+	c.keyOwners[key] = next.ID
+	c.put(next) //nolint
+}
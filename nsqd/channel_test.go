@@ -1,6 +1,9 @@
 package nsqd
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"nsq/internal/lg"
 	"nsq/internal/test"
 )
 
@@ -248,3 +252,398 @@ func TestChannelHealth(t *testing.T) {
 	resp.Body.Close()
 	test.Equal(t, "OK", string(body))
 }
+
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MsgTimeout = 100 * time.Millisecond
+	opts.QueueScanRefreshInterval = 100 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	channel.SetDeadLetter(2, topicName+"_dlq")
+	dlqChannel := nsqd.GetTopic(topicName + "_dlq").GetChannel("channel")
+
+	// below the limit the message is requeued as usual
+	msg := NewMessage(topic.GenerateID(), []byte("first"))
+	msg.Attempts = 1
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	err := channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	outputMsg := <-channel.memoryMsgChan
+	test.Equal(t, msg.ID, outputMsg.ID)
+
+	// at the limit a REQ moves it to the dead-letter topic
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	err = channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	outputMsg = <-dlqChannel.memoryMsgChan
+	test.Equal(t, msg.Body, outputMsg.Body)
+	test.Equal(t, uint16(0), outputMsg.Attempts)
+
+	// and so does an in-flight timeout
+	msg = NewMessage(topic.GenerateID(), []byte("second"))
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	outputMsg = <-dlqChannel.memoryMsgChan
+	test.Equal(t, msg.Body, outputMsg.Body)
+	test.Equal(t, 0, len(channel.memoryMsgChan))
+
+	// a message the dead-letter topic rejects is deferred, not lost
+	maxBytes := int64(1)
+	policy := overflowReject
+	nsqd.GetTopic(topicName + "_dlq").SetConfig(QueueConfig{MaxBytes: &maxBytes, OverflowPolicy: &policy})
+	msg = NewMessage(topic.GenerateID(), []byte("third"))
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	err = channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	channel.deferredMutex.Lock()
+	_, deferred := channel.deferredMessages[msg.ID]
+	channel.deferredMutex.Unlock()
+	test.Equal(t, true, deferred)
+
+	stats := nsqd.GetStats(topicName, "channel", false)
+	test.Equal(t, uint64(2), stats[0].Channels[0].DeadLetterCount)
+	test.Equal(t, uint16(2), stats[0].Channels[0].MaxAttempts)
+	test.Equal(t, topicName+"_dlq", stats[0].Channels[0].DeadLetterTopic)
+
+	// nor is one for a dead-letter topic the auto-create policy refuses
+	opts.AutoCreateTopics = false
+	nsqd.swapOpts(opts)
+	channel.SetDeadLetter(2, topicName+"_missing")
+	msg = NewMessage(topic.GenerateID(), []byte("fourth"))
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	err = channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	channel.deferredMutex.Lock()
+	_, deferred = channel.deferredMessages[msg.ID]
+	channel.deferredMutex.Unlock()
+	test.Equal(t, true, deferred)
+	_, err = nsqd.GetExistingTopic(topicName + "_missing")
+	test.NotNil(t, err)
+}
+
+func TestDeferredStoreSync(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	fileName := deferredStoreFileName(dataPath, "test_deferred_sync")
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(f, args...)
+	}
+
+	s, err := newDeferredStore(fileName, 2, logf)
+	test.Nil(t, err)
+	due := time.Now().Add(time.Hour).UnixNano()
+	for i := 0; i < 3; i++ {
+		test.Nil(t, s.Add(NewMessage(MessageID{byte(i)}, []byte("test")), due))
+	}
+	// synced every other record, then on demand
+	test.Equal(t, int64(1), s.unsynced)
+	test.Nil(t, s.Sync())
+	test.Equal(t, int64(0), s.unsynced)
+
+	// reopened without a Close, as after a crash
+	s, err = newDeferredStore(fileName, 2, logf)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(s.Entries()))
+	test.Nil(t, s.Close())
+}
+
+func TestChannelOrdered(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_ordered" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	channel.SetOrdered(true)
+
+	newKeyedMessage := func(key string) *Message {
+		msg := NewMessage(topic.GenerateID(), []byte(key))
+		if key != "" {
+			msg.Headers = map[string]string{orderingKeyHeader: key}
+		}
+		return msg
+	}
+	a1 := newKeyedMessage("a")
+	a2 := newKeyedMessage("a")
+	b1 := newKeyedMessage("b")
+	unkeyed := newKeyedMessage("")
+
+	test.Equal(t, true, channel.acquireOrderingKey(a1))
+	channel.StartInFlightTimeout(a1, 0, opts.MsgTimeout) //nolint
+	test.Equal(t, false, channel.acquireOrderingKey(a2))
+	test.Equal(t, true, channel.acquireOrderingKey(b1))
+	test.Equal(t, true, channel.acquireOrderingKey(unkeyed))
+	test.Equal(t, 1, channel.HeldCount())
+	// a held message counts in the depth and is persisted
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, 1, len(channel.deferredStore.Entries()))
+
+	// a REQ keeps the key, so a2 stays held
+	err := channel.RequeueMessage(0, a1.ID, 0)
+	test.Nil(t, err)
+	test.Equal(t, a1.ID, (<-channel.memoryMsgChan).ID)
+	test.Equal(t, true, channel.acquireOrderingKey(a1))
+	test.Equal(t, 1, channel.HeldCount())
+
+	// a FIN hands the key to a2
+	channel.StartInFlightTimeout(a1, 0, opts.MsgTimeout) //nolint
+	err = channel.FinishMessage(0, a1.ID)
+	test.Nil(t, err)
+	test.Equal(t, 0, channel.HeldCount())
+	test.Equal(t, 0, len(channel.deferredStore.Entries()))
+	outputMsg := <-channel.memoryMsgChan
+	test.Equal(t, a2.ID, outputMsg.ID)
+	test.Equal(t, true, channel.acquireOrderingKey(outputMsg))
+
+	// out of ordered mode keyed messages are not held
+	channel.SetOrdered(false)
+	test.Equal(t, true, channel.acquireOrderingKey(newKeyedMessage("b")))
+}
+
+func TestChannelOldestMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_oldest_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	test.Equal(t, int64(0), channel.OldestMessageTimestamp())
+
+	// the first message goes to the memory queue, the others to the backend
+	now := time.Now()
+	for i := 3; i > 0; i-- {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Timestamp = now.Add(-time.Duration(i) * time.Minute).UnixNano()
+		channel.put(msg)
+	}
+	test.Equal(t, int64(3), channel.Depth())
+	oldest := now.Add(-3 * time.Minute).Truncate(time.Second).UnixNano()
+	test.Equal(t, oldest, channel.OldestMessageTimestamp())
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, true, stats.OldestMessageAge >= 3*time.Minute)
+
+	msg := <-channel.memoryMsgChan
+	channel.dequeued(msg)
+	oldest = now.Add(-2 * time.Minute).Truncate(time.Second).UnixNano()
+	test.Equal(t, oldest, channel.OldestMessageTimestamp())
+
+	// messages left in the backend by a previous run start from the oldest
+	// timestamp persisted and advance as they are dequeued
+	channel.ages.reset()
+	channel.restoreOldest(oldest)
+	test.Equal(t, oldest, channel.OldestMessageTimestamp())
+	msg, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	channel.dequeued(msg)
+	test.Equal(t, msg.Timestamp, channel.OldestMessageTimestamp())
+
+	channel.Empty()
+	test.Equal(t, int64(0), channel.OldestMessageTimestamp())
+
+	// requeued and deferred messages are tracked again once they are back in
+	// the queue, and only then
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Timestamp = oldest
+	channel.put(msg)
+	channel.dequeued(<-channel.memoryMsgChan)
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	test.Equal(t, int64(0), channel.OldestMessageTimestamp())
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, 0))
+	test.Equal(t, oldest, channel.OldestMessageTimestamp())
+
+	channel.dequeued(<-channel.memoryMsgChan)
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout) //nolint
+	test.Nil(t, channel.RequeueMessage(0, msg.ID, time.Minute))
+	test.Equal(t, int64(0), channel.OldestMessageTimestamp())
+	channel.processDeferredQueue(time.Now().Add(time.Hour).UnixNano())
+	test.Equal(t, oldest, channel.OldestMessageTimestamp())
+	channel.dequeued(<-channel.memoryMsgChan)
+	test.Equal(t, int64(0), channel.OldestMessageTimestamp())
+}
+
+func TestChannelPeek(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_peek" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("test%d", i)))
+		channel.put(msg)
+		msgs = append(msgs, msg)
+	}
+
+	// one in flight, one deferred
+	msg := <-channel.memoryMsgChan
+	channel.dequeued(msg)
+	channel.StartInFlightTimeout(msg, 1, time.Minute)
+	msg = <-channel.memoryMsgChan
+	channel.dequeued(msg)
+	channel.StartDeferredTimeout(msg, time.Minute)
+
+	result, err := channel.Peek(2)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(result.Memory))
+	test.Equal(t, string(msgs[2].ID[:]), result.Memory[0].ID)
+	test.Equal(t, []byte("test3"), result.Memory[1].Body)
+	test.Equal(t, 1, len(result.InFlight))
+	test.Equal(t, string(msgs[0].ID[:]), result.InFlight[0].ID)
+	test.Equal(t, int64(1), result.InFlight[0].ClientID)
+	test.Equal(t, 1, len(result.Deferred))
+	test.Equal(t, string(msgs[1].ID[:]), result.Deferred[0].ID)
+	test.Equal(t, int64(3), channel.Depth())
+
+	url := fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=ch&n=10", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	var peeked PeekResult
+	err = json.NewDecoder(resp.Body).Decode(&peeked)
+	resp.Body.Close()
+	test.Nil(t, err)
+	test.Equal(t, 3, len(peeked.Memory))
+	test.Equal(t, []byte("test4"), peeked.Memory[2].Body)
+	test.Equal(t, int64(3), channel.Depth())
+
+	url = fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=ch&n=0", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+
+	// peeking leaves the messages queued, in order
+	for i := 2; i < 5; i++ {
+		msg := <-channel.memoryMsgChan
+		test.Equal(t, msgs[i].ID, msg.ID)
+	}
+	result, err = channel.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(result.Memory))
+}
+
+func TestPeekDiskQueue(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsq-test-peek-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	msgs, err := peekDiskQueue(dataPath, "test", 10)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(msgs))
+
+	// two files, the first message of the first one was already read
+	var buf bytes.Buffer
+	var offsets []int64
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			err = ioutil.WriteFile(fmt.Sprintf("%s/test.diskqueue.%06d.dat", dataPath, 0), buf.Bytes(), 0600)
+			test.Nil(t, err)
+			buf.Reset()
+		}
+		offsets = append(offsets, int64(buf.Len()))
+		var msgBuf bytes.Buffer
+		var id MessageID
+		copy(id[:], fmt.Sprintf("%016d", i))
+		NewMessage(id, []byte(fmt.Sprintf("test%d", i))).WriteTo(&msgBuf)
+		binary.Write(&buf, binary.BigEndian, int32(msgBuf.Len()))
+		buf.Write(msgBuf.Bytes())
+	}
+	err = ioutil.WriteFile(fmt.Sprintf("%s/test.diskqueue.%06d.dat", dataPath, 1), buf.Bytes(), 0600)
+	test.Nil(t, err)
+	err = ioutil.WriteFile(fmt.Sprintf("%s/test.diskqueue.meta.dat", dataPath),
+		[]byte(fmt.Sprintf("3\n0,%d\n1,%d\n", offsets[1], buf.Len())), 0600)
+	test.Nil(t, err)
+
+	msgs, err = peekDiskQueue(dataPath, "test", 10)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(msgs))
+	test.Equal(t, []byte("test1"), msgs[0].Body)
+	test.Equal(t, []byte("test3"), msgs[2].Body)
+
+	msgs, err = peekDiskQueue(dataPath, "test", 2)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(msgs))
+	test.Equal(t, []byte("test2"), msgs[1].Body)
+}
+
+func TestChannelMessageActions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_message_actions" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msgs = append(msgs, msg)
+	}
+	channel.StartInFlightTimeout(msgs[0], 1, time.Minute)
+	channel.StartInFlightTimeout(msgs[1], 1, time.Minute)
+	channel.StartDeferredTimeout(msgs[2], time.Hour)
+
+	err := channel.DeleteMessage(msgs[0].ID)
+	test.Nil(t, err)
+	test.Equal(t, errMessageNotPending, channel.DeleteMessage(msgs[0].ID))
+	test.Equal(t, 1, len(channel.inFlightMessages))
+	test.Equal(t, 1, len(channel.inFlightPQ))
+	test.Equal(t, int64(0), channel.Depth())
+
+	// requeue an in-flight message now
+	url := fmt.Sprintf("http://%s/message/requeue?topic=%s&channel=ch&id=%s", httpAddr, topicName, msgs[1].ID)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, 0, len(channel.inFlightMessages))
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, msgs[1], <-channel.memoryMsgChan)
+
+	// bring a deferred message forward
+	url = fmt.Sprintf("http://%s/message/reschedule?topic=%s&channel=ch&id=%s&timeout=0", httpAddr, topicName, msgs[2].ID)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, 0, len(channel.deferredMessages))
+	test.Equal(t, 0, len(channel.deferredPQ))
+	test.Equal(t, msgs[2], <-channel.memoryMsgChan)
+
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 404, resp.StatusCode)
+	resp.Body.Close()
+
+	url = fmt.Sprintf("http://%s/message/delete?topic=%s&channel=ch&id=abc", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	resp.Body.Close()
+}
@@ -39,6 +39,7 @@ type identifyDataV2 struct {
 	SampleRate          int32  `json:"sample_rate"`           //投递此次连接的消息接收率。
 	UserAgent           string `json:"user_agent"`            //这个客户端的代理字符串
 	MsgTimeout          int    `json:"msg_timeout"`           //配置服务端发送消息给客户端的超时时间
+	MsgHeaders          bool   `json:"msg_headers"`           //客户端支持带消息头的 v2 消息帧
 }
 
 type identifyEvent struct {
@@ -82,7 +83,8 @@ type clientV2 struct {
 
 	HeartbeatInterval time.Duration
 
-	MsgTimeout time.Duration
+	MsgTimeout    time.Duration
+	msgTimeoutSet bool // IDENTIFY 时客户端是否指定了 msg_timeout
 
 	State          int32
 	ConnectTime    time.Time
@@ -98,9 +100,10 @@ type clientV2 struct {
 	IdentifyEventChan chan identifyEvent
 	SubEventChan      chan *Channel
 
-	TLS     int32
-	Snappy  int32
-	Deflate int32
+	TLS        int32
+	Snappy     int32
+	Deflate    int32
+	MsgHeaders int32 // 是否以 v2 格式（带消息头）发送消息
 
 	// re-usable buffer for reading the 4-byte lengths off the wire
 	lenBuf   [4]byte
@@ -158,6 +161,14 @@ func (c *clientV2) String() string {
 	return c.RemoteAddr().String()
 }
 
+// msgFormat returns the message format negotiated in IDENTIFY
+func (c *clientV2) msgFormat() int {
+	if atomic.LoadInt32(&c.MsgHeaders) == 1 {
+		return msgFormatV2
+	}
+	return msgFormatV1
+}
+
 func (c *clientV2) Identify(data identifyDataV2) error {
 	c.ctx.nsqd.logf(LOG_INFO, "[%s] IDENTIFY: %+v", c, data)
 
@@ -466,6 +477,18 @@ func (c *clientV2) SetSampleRate(sampleRate int32) error {
 	return nil
 }
 
+// channelMsgTimeout returns the client's msg_timeout, or the channel's when
+// the client did not IDENTIFY with one
+func (c *clientV2) channelMsgTimeout(channel *Channel) time.Duration {
+	c.writeLock.RLock()
+	msgTimeout, msgTimeoutSet := c.MsgTimeout, c.msgTimeoutSet
+	c.writeLock.RUnlock()
+	if msgTimeoutSet {
+		return msgTimeout
+	}
+	return channel.MsgTimeout()
+}
+
 func (c *clientV2) SetMsgTimeout(msgTimeout int) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
@@ -476,6 +499,7 @@ func (c *clientV2) SetMsgTimeout(msgTimeout int) error {
 	case msgTimeout >= 1000 &&
 		msgTimeout <= int(c.ctx.nsqd.getOpts().MaxMsgTimeout/time.Millisecond):
 		c.MsgTimeout = time.Duration(msgTimeout) * time.Millisecond
+		c.msgTimeoutSet = true
 	default:
 		return fmt.Errorf("msg timeout (%d) is invalid", msgTimeout)
 	}
@@ -575,10 +599,7 @@ func (c *clientV2) QueryAuthd() error {
 		}
 	}
 
-	authState, err := auth.QueryAnyAuthd(c.ctx.nsqd.getOpts().AuthHTTPAddresses,
-		remoteIP, tlsEnabled, commonName, c.AuthSecret,
-		c.ctx.nsqd.getOpts().HTTPClientConnectTimeout,
-		c.ctx.nsqd.getOpts().HTTPClientRequestTimeout)
+	authState, err := c.ctx.nsqd.queryAuth(remoteIP, tlsEnabled, commonName, c.AuthSecret)
 	if err != nil {
 		return err
 	}
@@ -586,6 +607,12 @@ func (c *clientV2) QueryAuthd() error {
 	return nil
 }
 
+// isJWTAuth returns whether the client's AUTH secret is a JWT validated by
+// nsqd
+func (c *clientV2) isJWTAuth() bool {
+	return c.ctx.nsqd.jwt != nil && auth.IsJWT(c.AuthSecret)
+}
+
 func (c *clientV2) Auth(secret string) error {
 	c.AuthSecret = secret
 	return c.QueryAuthd()
@@ -0,0 +1,118 @@
+package nsqd
+
+import (
+	"sync"
+	"time"
+)
+
+const maxDedupeKeyLen = 255
+
+func isValidDedupeKey(key string) bool {
+	return len(key) > 0 && len(key) <= maxDedupeKeyLen
+}
+
+type dedupeEntry struct {
+	key string
+	ts  int64
+}
+
+// dedupeWindow remembers the dedupe keys a topic was published with in the
+// last window (and at most maxKeys of them) so that retried publishes
+// are not enqueued twice.
+//
+// The window is in memory only, it does not survive restarts.
+type dedupeWindow struct {
+	sync.Mutex
+
+	window  time.Duration
+	maxKeys int
+
+	keys    map[string]int64         // key => publish time
+	order   []dedupeEntry            // oldest first
+	pending map[string]chan struct{} // keys being published, closed once done
+}
+
+func newDedupeWindow(window time.Duration, maxKeys int) *dedupeWindow {
+	return &dedupeWindow{
+		window:  window,
+		maxKeys: maxKeys,
+		keys:    make(map[string]int64),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+func (d *dedupeWindow) enabled() bool {
+	return d.window > 0 && d.maxKeys > 0
+}
+
+// Acquire returns whether key was recorded within the window, otherwise the
+// caller publishes it and must then call Release. A concurrent publish with
+// the same key waits for that outcome.
+func (d *dedupeWindow) Acquire(key string) bool {
+	if !d.enabled() {
+		return false
+	}
+	for {
+		d.Lock()
+		d.expire(time.Now().UnixNano())
+		if _, ok := d.keys[key]; ok {
+			d.Unlock()
+			return true
+		}
+		done, ok := d.pending[key]
+		if !ok {
+			d.pending[key] = make(chan struct{})
+			d.Unlock()
+			return false
+		}
+		d.Unlock()
+		<-done
+	}
+}
+
+// Release records key once its publish succeeded, a failed publish can be
+// retried with the same key
+func (d *dedupeWindow) Release(key string, published bool) {
+	if !d.enabled() {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+
+	if published {
+		now := time.Now().UnixNano()
+		d.keys[key] = now
+		d.order = append(d.order, dedupeEntry{key, now})
+		for len(d.keys) > d.maxKeys {
+			d.evict()
+		}
+	}
+	close(d.pending[key])
+	delete(d.pending, key)
+}
+
+// Len returns the number of keys in the window
+func (d *dedupeWindow) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	d.expire(time.Now().UnixNano())
+	return len(d.keys)
+}
+
+func (d *dedupeWindow) expire(now int64) {
+	cutoff := now - int64(d.window)
+	for len(d.order) > 0 && d.order[0].ts <= cutoff {
+		d.evict()
+	}
+}
+
+// evict drops the oldest entry, entries of forgotten (or re-recorded) keys
+// are only skipped
+func (d *dedupeWindow) evict() {
+	e := d.order[0]
+	d.order[0] = dedupeEntry{}
+	d.order = d.order[1:]
+	if ts, ok := d.keys[e.key]; ok && ts == e.ts {
+		delete(d.keys, e.key)
+	}
+}
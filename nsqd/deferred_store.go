@@ -0,0 +1,367 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"nsq/internal/lg"
+)
+
+const (
+	deferredOpAdd    byte = 'A'
+	deferredOpRemove byte = 'R'
+)
+
+type deferredEntry struct {
+	msg *Message
+	due int64
+}
+
+// deferredStore durably records a channel's deferred messages together with
+// their absolute due time so that they survive restarts.
+//
+// It is an append-only log of add/remove records:
+//
+//   add:    'A' + due (int64) + len (int32) + message (see Message.WriteTo)
+//   remove: 'R' + message ID (16-byte)
+//
+// Like the channel's backend, the log is synced every syncEvery records and
+// every SyncTimeout (see deferredSyncLoop), a crash loses the records written
+// since the last sync.
+//
+// The log is compacted down to the live entries when it is opened, when it
+// is closed and whenever it holds over 1000 more records than twice the live
+// entries.
+//
+// All methods are safe to call on a nil *deferredStore (ephemeral channels).
+type deferredStore struct {
+	sync.Mutex
+
+	fileName  string
+	file      *os.File
+	entries   map[MessageID]deferredEntry
+	records   int
+	syncEvery int64
+	unsynced  int64
+	buf       bytes.Buffer
+	logf      lg.AppLogFunc
+}
+
+func deferredStoreFileName(dataPath string, backendName string) string {
+	return path.Join(dataPath, backendName+".deferred.dat")
+}
+
+func newDeferredStore(fileName string, syncEvery int64, logf lg.AppLogFunc) (*deferredStore, error) {
+	s := &deferredStore{
+		fileName:  fileName,
+		entries:   make(map[MessageID]deferredEntry),
+		syncEvery: syncEvery,
+		logf:      logf,
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads every record in the log, stopping at the first truncated or
+// corrupt record (ie. a partial write at crash time)
+func (s *deferredStore) load() error {
+	f, err := os.Open(s.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var header [12]byte
+	r := bufio.NewReader(f)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			return nil
+		}
+		switch op {
+		case deferredOpAdd:
+			_, err = io.ReadFull(r, header[:])
+			if err != nil {
+				goto corrupt
+			}
+			due := int64(binary.BigEndian.Uint64(header[:8]))
+			size := int32(binary.BigEndian.Uint32(header[8:12]))
+			if size < minValidMsgLength {
+				goto corrupt
+			}
+			data := make([]byte, size)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				goto corrupt
+			}
+			msg, err := decodeMessage(data)
+			if err != nil {
+				goto corrupt
+			}
+			s.entries[msg.ID] = deferredEntry{msg: msg, due: due}
+		case deferredOpRemove:
+			var id MessageID
+			_, err = io.ReadFull(r, id[:])
+			if err != nil {
+				goto corrupt
+			}
+			delete(s.entries, id)
+		default:
+			goto corrupt
+		}
+	}
+
+corrupt:
+	s.logf(LOG_WARN, "DEFERRED(%s): ignoring corrupt or truncated tail", s.fileName)
+	return nil
+}
+
+// compact rewrites the log so that it only contains the live entries
+func (s *deferredStore) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	// the live entries are synced below (or none are left)
+	s.unsynced = 0
+
+	if len(s.entries) == 0 {
+		s.records = 0
+		err := os.Remove(s.fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmpFileName := fmt.Sprintf("%s.tmp", s.fileName)
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range s.entries {
+		s.encodeAdd(e.msg, e.due)
+		w.Write(s.buf.Bytes())
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	s.records = len(s.entries)
+	return os.Rename(tmpFileName, s.fileName)
+}
+
+func (s *deferredStore) encodeAdd(msg *Message, due int64) {
+	var header [12]byte
+	s.buf.Reset()
+	s.buf.WriteByte(deferredOpAdd)
+	s.buf.Write(header[:])
+	msg.WriteTo(&s.buf)
+	b := s.buf.Bytes()
+	binary.BigEndian.PutUint64(b[1:9], uint64(due))
+	binary.BigEndian.PutUint32(b[9:13], uint32(len(b)-13))
+}
+
+func (s *deferredStore) append() error {
+	if s.entries == nil {
+		return errors.New("closed")
+	}
+	if s.file == nil {
+		f, err := os.OpenFile(s.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		s.file = f
+	}
+	_, err := s.file.Write(s.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	s.records++
+	s.unsynced++
+	if s.unsynced >= s.syncEvery {
+		return s.sync()
+	}
+	return nil
+}
+
+func (s *deferredStore) sync() error {
+	if s.file == nil || s.unsynced == 0 {
+		return nil
+	}
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	s.unsynced = 0
+	return nil
+}
+
+// Sync syncs the records written since the last sync
+func (s *deferredStore) Sync() error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	return s.sync()
+}
+
+// Add records msg as deferred until due (nanoseconds since epoch)
+func (s *deferredStore) Add(msg *Message, due int64) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	s.encodeAdd(msg, due)
+	err := s.append()
+	if err != nil {
+		return err
+	}
+	s.entries[msg.ID] = deferredEntry{msg: msg, due: due}
+	return nil
+}
+
+// Remove records that the deferred message id is no longer deferred
+func (s *deferredStore) Remove(id MessageID) error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.entries[id]; !ok {
+		return nil
+	}
+	s.buf.Reset()
+	s.buf.WriteByte(deferredOpRemove)
+	s.buf.Write(id[:])
+	err := s.append()
+	if err != nil {
+		return err
+	}
+	delete(s.entries, id)
+
+	if s.records > 2*len(s.entries)+1000 {
+		return s.compact()
+	}
+	return nil
+}
+
+// Entries returns the deferred messages along with their absolute due time
+func (s *deferredStore) Entries() []deferredEntry {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	entries := make([]deferredEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Empty discards every deferred message
+func (s *deferredStore) Empty() error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if s.entries == nil {
+		return errors.New("closed")
+	}
+	s.entries = make(map[MessageID]deferredEntry)
+	return s.compact()
+}
+
+// Close compacts and syncs the log
+func (s *deferredStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if s.entries == nil {
+		return errors.New("closed")
+	}
+	err := s.compact()
+	s.entries = nil
+	return err
+}
+
+// Delete removes the log from disk
+func (s *deferredStore) Delete() error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.entries = nil
+	err := os.Remove(s.fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deferredSyncLoop periodically syncs the channels' deferred stores, even
+// those written less than syncEvery times since their last sync
+func (n *NSQD) deferredSyncLoop() {
+	ticker := time.NewTicker(n.getOpts().SyncTimeout)
+	for {
+		select {
+		case <-ticker.C:
+			for _, c := range n.channels() {
+				err := c.deferredStore.Sync()
+				if err != nil {
+					n.logf(LOG_ERROR, "CHANNEL(%s): failed to sync deferred store - %s", c.name, err)
+				}
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "DEFERRED: closing")
+	ticker.Stop()
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package nsqd
+
+import (
+	"syscall"
+)
+
+// diskFree returns the bytes available to nsqd on the volume of path
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,107 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// disk space status of the DataPath volume
+const (
+	diskOK   = iota
+	diskLow  // below DiskSoftLimit, warn
+	diskFull // below DiskHardLimit, reject publishes
+)
+
+var errDiskFull = errors.New("disk full")
+
+type diskStats struct {
+	Status    string `json:"status"`
+	FreeBytes int64  `json:"free_bytes"`
+	SoftLimit int64  `json:"soft_limit"`
+	HardLimit int64  `json:"hard_limit"`
+}
+
+// diskSpaceLoop periodically checks the free space on the DataPath volume
+// against DiskSoftLimit/DiskHardLimit
+func (n *NSQD) diskSpaceLoop() {
+	n.checkDiskSpace()
+
+	ticker := time.NewTicker(n.getOpts().DiskCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+			n.checkDiskSpace()
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "DISK: closing")
+	ticker.Stop()
+}
+
+func (n *NSQD) checkDiskSpace() {
+	opts := n.getOpts()
+	if opts.DiskSoftLimit <= 0 && opts.DiskHardLimit <= 0 {
+		atomic.StoreInt32(&n.diskStatus, diskOK)
+		return
+	}
+
+	free, err := diskFree(opts.DataPath)
+	if err != nil {
+		n.logf(LOG_ERROR, "DISK: failed to get free space of %s - %s", opts.DataPath, err)
+		return
+	}
+	atomic.StoreInt64(&n.diskFree, free)
+
+	status := int32(diskOK)
+	switch {
+	case opts.DiskHardLimit > 0 && free < opts.DiskHardLimit:
+		status = diskFull
+	case opts.DiskSoftLimit > 0 && free < opts.DiskSoftLimit:
+		status = diskLow
+	}
+
+	old := atomic.SwapInt32(&n.diskStatus, status)
+	if old == status {
+		return
+	}
+	switch status {
+	case diskFull:
+		n.logf(LOG_ERROR, "DISK: %d bytes free on %s, below hard limit %d - rejecting publishes",
+			free, opts.DataPath, opts.DiskHardLimit)
+	case diskLow:
+		n.logf(LOG_WARN, "DISK: %d bytes free on %s, below soft limit %d",
+			free, opts.DataPath, opts.DiskSoftLimit)
+	default:
+		n.logf(LOG_INFO, "DISK: %d bytes free on %s, recovered", free, opts.DataPath)
+	}
+}
+
+// diskSpaceErr returns errDiskFull while the DataPath volume is below the
+// hard limit
+func (n *NSQD) diskSpaceErr() error {
+	if atomic.LoadInt32(&n.diskStatus) == diskFull {
+		return errDiskFull
+	}
+	return nil
+}
+
+func (n *NSQD) getDiskStats() diskStats {
+	opts := n.getOpts()
+	status := "ok"
+	switch atomic.LoadInt32(&n.diskStatus) {
+	case diskLow:
+		status = "low"
+	case diskFull:
+		status = "full"
+	}
+	return diskStats{
+		Status:    status,
+		FreeBytes: atomic.LoadInt64(&n.diskFree),
+		SoftLimit: opts.DiskSoftLimit,
+		HardLimit: opts.DiskHardLimit,
+	}
+}
@@ -0,0 +1,170 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// msgFilter is a channel's filter expression over message headers and JSON
+// body fields, messages that do not match are never delivered.
+//
+// An expression is one or more conditions joined by && and ||, && binding
+// tighter than ||, where a condition is one of:
+//
+//   header.<key>==<value>    body.<field>[.<field>...]==<value>
+//   header.<key>!=<value>    body.<field>[.<field>...]!=<value>
+//   header.<key>             body.<field>[.<field>...]            (is set)
+//
+// eg. header.type==order&&body.customer.region!=eu||header.priority
+//
+// JSON body values compare against their JSON text (strings unquoted).
+type msgFilter struct {
+	expr string
+	or   [][]filterCond
+}
+
+type filterCond struct {
+	source string // "header" or "body"
+	path   []string
+	op     string // "==", "!=" or "" (is set)
+	value  string
+}
+
+func parseMsgFilter(expr string) (*msgFilter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, errors.New("empty filter")
+	}
+
+	f := &msgFilter{expr: expr}
+	for _, term := range strings.Split(expr, "||") {
+		var and []filterCond
+		for _, c := range strings.Split(term, "&&") {
+			cond, err := parseFilterCond(strings.TrimSpace(c))
+			if err != nil {
+				return nil, err
+			}
+			and = append(and, cond)
+		}
+		f.or = append(f.or, and)
+	}
+	return f, nil
+}
+
+func parseFilterCond(s string) (filterCond, error) {
+	var cond filterCond
+
+	field := s
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(s, op); i >= 0 {
+			field = strings.TrimSpace(s[:i])
+			cond.op = op
+			cond.value = strings.TrimSpace(s[i+len(op):])
+			break
+		}
+	}
+
+	parts := strings.Split(field, ".")
+	if len(parts) < 2 {
+		return cond, fmt.Errorf("invalid filter condition %q", s)
+	}
+	cond.source = parts[0]
+	cond.path = parts[1:]
+	switch cond.source {
+	case "header":
+		if len(cond.path) != 1 {
+			cond.path = []string{strings.Join(cond.path, ".")}
+		}
+	case "body":
+	default:
+		return cond, fmt.Errorf("invalid filter condition %q", s)
+	}
+	for _, p := range cond.path {
+		if p == "" {
+			return cond, fmt.Errorf("invalid filter condition %q", s)
+		}
+	}
+	return cond, nil
+}
+
+func (f *msgFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Match returns whether msg passes the filter, a nil filter matches everything
+func (f *msgFilter) Match(msg *Message) bool {
+	if f == nil {
+		return true
+	}
+
+	var body interface{}
+	var bodyParsed bool
+	for _, and := range f.or {
+		matched := true
+		for _, cond := range and {
+			var value string
+			var ok bool
+			switch cond.source {
+			case "header":
+				value, ok = msg.Headers[cond.path[0]]
+			case "body":
+				if !bodyParsed {
+					bodyParsed = true
+					if json.Unmarshal(msg.Body, &body) != nil {
+						body = nil
+					}
+				}
+				value, ok = jsonField(body, cond.path)
+			}
+			switch cond.op {
+			case "==":
+				matched = ok && value == cond.value
+			case "!=":
+				matched = !ok || value != cond.value
+			default:
+				matched = ok
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonField returns the value at path in the decoded JSON v as text
+func jsonField(v interface{}, path []string) (string, bool) {
+	for _, p := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		v, ok = obj[p]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	case nil:
+		return "null", true
+	default:
+		b, _ := json.Marshal(t)
+		return string(b), true
+	}
+}
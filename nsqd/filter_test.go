@@ -0,0 +1,74 @@
+package nsqd
+
+import (
+	"testing"
+
+	"nsq/internal/test"
+)
+
+func TestParseMsgFilter(t *testing.T) {
+	for _, expr := range []string{
+		"header.type",
+		"header.type==order",
+		"header.content.type==text/plain",
+		"body.customer.region!=eu",
+		" header.type == order && body.region != eu || body.priority ",
+		"header.trace-id==a b",
+	} {
+		f, err := parseMsgFilter(expr)
+		test.Nil(t, err)
+		test.NotNil(t, f)
+	}
+
+	for _, expr := range []string{
+		"",
+		"   ",
+		"type==order",
+		"header==order",
+		"header.",
+		"body.customer..region",
+		"query.type==order",
+		"header.type==order&&",
+		"||body.region",
+	} {
+		_, err := parseMsgFilter(expr)
+		test.NotNil(t, err)
+	}
+
+	// dotted header keys are a single key, body paths are nested fields
+	f, _ := parseMsgFilter("header.content.type==text/plain&&body.customer.region==eu")
+	test.Equal(t, []string{"content.type"}, f.or[0][0].path)
+	test.Equal(t, []string{"customer", "region"}, f.or[0][1].path)
+
+	// the expression is kept as given, minus the surrounding spaces
+	f, _ = parseMsgFilter(" header.type == order ")
+	test.Equal(t, "header.type == order", f.String())
+	test.Equal(t, "order", f.or[0][0].value)
+	test.Equal(t, "", (*msgFilter)(nil).String())
+}
+
+func TestMsgFilterMatch(t *testing.T) {
+	newMsg := func(headers map[string]string, body string) *Message {
+		msg := NewMessage(MessageID{}, []byte(body))
+		msg.Headers = headers
+		return msg
+	}
+
+	f, err := parseMsgFilter("header.type==order&&body.region!=eu||body.priority")
+	test.Nil(t, err)
+	test.Equal(t, true, f.Match(newMsg(map[string]string{"type": "order"}, `{"region":"us"}`)))
+	test.Equal(t, true, f.Match(newMsg(map[string]string{"type": "order"}, `not json`)))
+	test.Equal(t, false, f.Match(newMsg(map[string]string{"type": "order"}, `{"region":"eu"}`)))
+	test.Equal(t, false, f.Match(newMsg(map[string]string{"type": "refund"}, `{"region":"us"}`)))
+	test.Equal(t, true, f.Match(newMsg(nil, `{"priority":false}`)))
+	test.Equal(t, false, f.Match(newMsg(nil, `not json`)))
+
+	// JSON values compare against their JSON text
+	f, _ = parseMsgFilter("body.a.b==1.5&&body.c==true&&body.d==null&&body.e==[1,2]&&body.f==x")
+	test.Equal(t, true, f.Match(newMsg(nil, `{"a":{"b":1.5},"c":true,"d":null,"e":[1,2],"f":"x"}`)))
+	test.Equal(t, false, f.Match(newMsg(nil, `{"a":{"b":2},"c":true,"d":null,"e":[1,2],"f":"x"}`)))
+	test.Equal(t, false, f.Match(newMsg(nil, `{"a":1.5,"c":true,"d":null,"e":[1,2],"f":"x"}`)))
+
+	// a nil filter matches everything
+	test.Equal(t, true, (*msgFilter)(nil).Match(newMsg(nil, "")))
+}
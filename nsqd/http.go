@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
@@ -19,8 +21,10 @@ import (
 
 	"nsq/internal/http_api"
 	"nsq/internal/lg"
+	"nsq/internal/prometheus"
 	"nsq/internal/protocol"
 	"nsq/internal/version"
+	"nsq/internal/websocket"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -60,35 +64,52 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1)) //版本
 
 	// v1 negotiate
-	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.V1))
-	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.V1))       //发布多个消息到话题
-	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1)) //检查综合运行
+	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, s.authorize("publish"), http_api.V1))
+	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, s.authorize("publish"), http_api.V1))     //发布多个消息到话题
+	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, s.authorize("admin"), log, http_api.V1)) //检查综合运行
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, s.authorize("admin"), log, http_api.PlainText))
 
 	// only v1
-	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, log, http_api.V1))
-	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, log, http_api.V1))   //清空话题（topic)
-	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))   //暂停话题（topic)的消息流
-	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, log, http_api.V1)) //恢复话题（topic)的消息流
-	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
-	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
+	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/topic/delete", http_api.Decorate(s.doDeleteTopic, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, s.authorize("admin"), log, http_api.V1))   //清空话题（topic)
+	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, s.authorize("admin"), log, http_api.V1))   //暂停话题（topic)的消息流
+	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, s.authorize("admin"), log, http_api.V1)) //恢复话题（topic)的消息流
+	router.Handle("POST", "/topic/config", http_api.Decorate(s.doTopicConfig, s.authorize("admin"), log, http_api.V1))
+	router.Handle("GET", "/topic/peek", http_api.Decorate(s.doPeekTopic, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/rewind", http_api.Decorate(s.doRewindChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/config", http_api.Decorate(s.doChannelConfig, s.authorize("admin"), log, http_api.V1))
+	router.Handle("GET", "/channel/peek", http_api.Decorate(s.doPeekChannel, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/push/create", http_api.Decorate(s.doCreatePush, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/channel/push/delete", http_api.Decorate(s.doDeletePush, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/message/delete", http_api.Decorate(s.doDeleteMessage, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/message/requeue", http_api.Decorate(s.doRequeueMessage, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/message/reschedule", http_api.Decorate(s.doRescheduleMessage, s.authorize("admin"), log, http_api.V1))
+	router.Handle("POST", "/sub", http_api.Decorate(s.doSUB, log, http_api.V1))
+	router.Handle("POST", "/fin", http_api.Decorate(s.doFIN, log, http_api.V1))
+	router.Handle("POST", "/req", http_api.Decorate(s.doREQ, log, http_api.V1))
+	router.Handle("POST", "/touch", http_api.Decorate(s.doTOUCH, log, http_api.V1))
+	router.Handle("POST", "/cls", http_api.Decorate(s.doCLS, log, http_api.V1))
+	router.Handle("GET", "/ws", s.doWebSocket)
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
-	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, s.authorize("admin"), log, http_api.V1))
 
 	// debug
-	router.HandlerFunc("GET", "/debug/pprof/", pprof.Index) //pprof 调试入口
-	router.HandlerFunc("GET", "/debug/pprof/cmdline", pprof.Cmdline)
-	router.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("POST", "/debug/pprof/symbol", pprof.Symbol)
-	router.HandlerFunc("GET", "/debug/pprof/profile", pprof.Profile)            // 生成 pprof CPU 配置文件
-	router.Handler("GET", "/debug/pprof/heap", pprof.Handler("heap"))           //生成 pprof 堆配置文件
-	router.Handler("GET", "/debug/pprof/goroutine", pprof.Handler("goroutine")) //生成 pprof 计算配置文件
-	router.Handler("GET", "/debug/pprof/block", pprof.Handler("block"))         //生成 pprof 块配置文件
-	router.Handle("PUT", "/debug/setblockrate", http_api.Decorate(setBlockRateHandler, log, http_api.PlainText))
-	router.Handler("GET", "/debug/pprof/threadcreate", pprof.Handler("threadcreate")) //生成 pprof OS 线程配置文件
+	router.Handler("GET", "/debug/pprof/", s.authorizeHandler("admin", http.HandlerFunc(pprof.Index))) //pprof 调试入口
+	router.Handler("GET", "/debug/pprof/cmdline", s.authorizeHandler("admin", http.HandlerFunc(pprof.Cmdline)))
+	router.Handler("GET", "/debug/pprof/symbol", s.authorizeHandler("admin", http.HandlerFunc(pprof.Symbol)))
+	router.Handler("POST", "/debug/pprof/symbol", s.authorizeHandler("admin", http.HandlerFunc(pprof.Symbol)))
+	router.Handler("GET", "/debug/pprof/profile", s.authorizeHandler("admin", http.HandlerFunc(pprof.Profile))) // 生成 pprof CPU 配置文件
+	router.Handler("GET", "/debug/pprof/heap", s.authorizeHandler("admin", pprof.Handler("heap")))              //生成 pprof 堆配置文件
+	router.Handler("GET", "/debug/pprof/goroutine", s.authorizeHandler("admin", pprof.Handler("goroutine")))    //生成 pprof 计算配置文件
+	router.Handler("GET", "/debug/pprof/block", s.authorizeHandler("admin", pprof.Handler("block")))            //生成 pprof 块配置文件
+	router.Handle("PUT", "/debug/setblockrate", http_api.Decorate(setBlockRateHandler, s.authorize("admin"), log, http_api.PlainText))
+	router.Handler("GET", "/debug/pprof/threadcreate", s.authorizeHandler("admin", pprof.Handler("threadcreate"))) //生成 pprof OS 线程配置文件
 
 	return s
 }
@@ -116,6 +137,117 @@ func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.router.ServeHTTP(w, req) //这个就是路由对应真实处理函数了。
 }
 
+// authorize is a decorator requiring, when auth is enabled, the credentials
+// of the request to grant permission ("publish" or "admin") on the "topic"
+// (and "channel") of its query
+func (s *httpServer) authorize(permission string) http_api.Decorator {
+	return func(f http_api.APIHandler) http_api.APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			query := req.URL.Query()
+			err := s.checkAuth(req, permission, query.Get("topic"), query.Get("channel"))
+			if err != nil {
+				return nil, err
+			}
+			return f(w, req, ps)
+		}
+	}
+}
+
+// authorizeHandler is authorize for the plain http.Handler of the debug
+// endpoints
+func (s *httpServer) authorizeHandler(permission string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := s.checkAuth(req, permission, "", "")
+		if err != nil {
+			http_api.RespondV1(w, err.(http_api.Err).Code, err)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// checkAuth checks, when auth is enabled, that the bearer secret of the
+// Authorization header and/or the TLS client certificate of the request grant
+// permission on topic and channel, the same way as the AUTH of a TCP client
+func (s *httpServer) checkAuth(req *http.Request, permission string, topicName string, channelName string) error {
+	if !s.ctx.nsqd.IsAuthEnabled() {
+		return nil
+	}
+
+	var secret string
+	if header := req.Header.Get("Authorization"); header != "" {
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			return http_api.Err{Code: 401, Text: "AUTH_FAILED"}
+		}
+		secret = strings.TrimSpace(header[7:])
+	}
+	tlsEnabled := req.TLS != nil
+	commonName := ""
+	if tlsEnabled && len(req.TLS.PeerCertificates) > 0 {
+		commonName = req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if secret == "" && commonName == "" {
+		return http_api.Err{Code: 401, Text: "AUTH_REQUIRED"}
+	}
+
+	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteIP = req.RemoteAddr
+	}
+	authState, err := s.ctx.nsqd.queryAuth(remoteIP, tlsEnabled, commonName, secret)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_WARN, "HTTP: auth failed for client(%s) - %s", req.RemoteAddr, err)
+		return http_api.Err{Code: 401, Text: "AUTH_FAILED"}
+	}
+
+	var ok bool
+	switch permission {
+	case "admin":
+		ok = authState.IsAdminAllowed(topicName, channelName)
+	case "subscribe":
+		ok = channelName != "" && authState.IsAllowed(topicName, channelName)
+	default:
+		ok = authState.IsAllowed(topicName, "")
+	}
+	if !ok {
+		return http_api.Err{Code: 403, Text: "UNAUTHORIZED"}
+	}
+	return nil
+}
+
+// doWebSocket upgrades the request to a WebSocket carrying the same stream
+// as a TCP connection (protocol magic, commands and frames)
+func (s *httpServer) doWebSocket(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !s.isWebSocketOriginAllowed(req) {
+		s.ctx.nsqd.logf(LOG_WARN, "WS: rejecting client(%s) from origin %s", req.RemoteAddr, req.Header.Get("Origin"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Upgrade(w, req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "WS: failed to upgrade client(%s) - %s", req.RemoteAddr, err)
+		return
+	}
+	s.ctx.nsqd.logf(LOG_INFO, "WS: new client(%s)", conn.RemoteAddr())
+	tcpServer := &tcpServer{ctx: s.ctx}
+	tcpServer.handleProtocol(conn)
+}
+
+// isWebSocketOriginAllowed returns whether a WebSocket may be opened from the
+// origin of req, so that any web page cannot use the browser's access to nsqd
+func (s *httpServer) isWebSocketOriginAllowed(req *http.Request) bool {
+	if websocket.IsSameOrigin(req) {
+		return true
+	}
+	origin := req.Header.Get("Origin")
+	for _, allowed := range s.ctx.nsqd.getOpts().WebSocketAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	health := s.ctx.nsqd.GetHealth()
 	if !s.ctx.nsqd.IsHealthy() {
@@ -146,273 +278,1311 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 	}, nil
 }
 
-func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.ReqParams, *Topic, string, error) {
-	reqParams, err := http_api.NewReqParams(req)
+func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.ReqParams, *Topic, string, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, nil, "", http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	if err != nil {
+		return nil, nil, "", http_api.Err{Code: 400, Text: err.Error()}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, nil, "", http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	return reqParams, topic, channelName, err
+}
+
+func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
+	reqParams, topicName, err := s.getTopicNameFromQuery(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topic, err := s.ctx.nsqd.getImplicitTopic(topicName)
+	if err != nil {
+		return nil, nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+	return reqParams, topic, nil
+}
+
+func (s *httpServer) getTopicNameFromQuery(req *http.Request) (url.Values, string, error) {
+	//ParseQuery把参数解析成map的形式。
+	reqParams, err := url.ParseQuery(req.URL.RawQuery) //RawQuery指的就是url问号后面的所有参数，不包括#之后的内容。URL结构体中Fragment中存放的就是#号后面的东西。
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, "", http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicNames, ok := reqParams["topic"]
+	if !ok {
+		return nil, "", http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+	topicName := topicNames[0] //因为ParseQuery解析出来的map中的value都是数组形式，就算只有一个值也是数组的形式，所以此处指明索引为0
+
+	if !protocol.IsValidTopicName(topicName) { //验证topic格式
+		return nil, "", http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
+	}
+
+	return reqParams, topicName, nil
+}
+
+func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	// TODO: one day I'd really like to just error on chunked requests
+	// to be able to fail "too big" requests before we even read
+
+	maxMsgSize := s.ctx.nsqd.topicMaxMsgSize(req.URL.Query().Get("topic"))
+	if req.ContentLength > maxMsgSize { //发送消息的长度和配置设定的大小对比
+		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	}
+
+	// add 1 so that it's greater than our max when we test for it
+	// (LimitReader returns a "fake" EOF)
+	readMax := maxMsgSize + 1
+	//io.LimitReader从reader中读取readMax字节
+	//ioutil.ReadAll一次性全部读取，成功后err返回nil,而非EOF.
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	if err != nil {
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+	if int64(len(body)) == readMax {
+		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	}
+	if len(body) == 0 {
+		return nil, http_api.Err{Code: 400, Text: "MSG_EMPTY"}
+	}
+	//1.看有没有topic，有则返回
+	//无则创建topic，并通知lookup，创建完后通知此topic的messagePump跑起来
+	reqParams, topic, err := s.getTopicFromQuery(req) //首先要从http query中拿到topic
+	if err != nil {
+		return nil, err
+	}
+
+	var deferred time.Duration
+	if ds, ok := reqParams["defer"]; ok {
+		var di int64
+		di, err = strconv.ParseInt(ds[0], 10, 64)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_DEFER"}
+		}
+		deferred = time.Duration(di) * time.Millisecond
+		if deferred < 0 || deferred > s.ctx.nsqd.getOpts().MaxReqTimeout {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_DEFER"}
+		}
+	}
+
+	headers, err := getMsgHeadersFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body))+msgHeadersSize(headers) > maxMsgSize {
+		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	}
+
+	dedupeKey, err := getDedupeKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := NewMessage(topic.GenerateID(), body)
+	msg.deferred = deferred
+	msg.Headers = headers
+	_, err = s.ctx.nsqd.putMessages(topic, []*Message{msg}, dedupeKey) //publish消息，把消息放到内存或者磁盘队列中。
+	if err == errQuotaExceeded {
+		return nil, http_api.Err{Code: 429, Text: "QUOTA_EXCEEDED"}
+	}
+	if err == errDiskFull {
+		return nil, http_api.Err{Code: 507, Text: "DISK_FULL"}
+	}
+	if err == errTopicNotFound {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+	if err != nil {
+		return nil, http_api.Err{Code: 503, Text: "EXITING"}
+	}
+
+	return "OK", nil
+}
+
+// number of messages per batch of a streaming /mpub, by default and at most
+const (
+	defaultMPUBBatchSize = 1000
+	maxMPUBBatchSize     = 100000
+)
+
+// mpubBatch is the summary of a batch of a streaming /mpub
+type mpubBatch struct {
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+	Error    string `json:"error,omitempty"`
+}
+
+// doMPUBStream publishes the newline-delimited messages of an unbounded
+// (typically chunked) request body, in batches of up to "batch_size" messages
+// and --max-body-size bytes as they are read.
+//
+// Batches are published independently and the summary lists them in order.
+// The first error ends the request: a batch that failed to publish (the topic
+// over quota...) has its error set, an invalid message (too big...) is
+// reported as a last, empty batch with the error.
+func (s *httpServer) doMPUBStream(req *http.Request, reqParams url.Values, topic *Topic,
+	headers map[string]string, maxMsgSize int64) (interface{}, error) {
+	batchSize := defaultMPUBBatchSize
+	if vals, ok := reqParams["batch_size"]; ok {
+		var err error
+		batchSize, err = strconv.Atoi(vals[0])
+		if err != nil || batchSize <= 0 || batchSize > maxMPUBBatchSize {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_BATCH_SIZE"}
+		}
+	}
+	if _, ok := reqParams["dedupe_key"]; ok {
+		// a key would dedupe the first batch only
+		return nil, http_api.Err{Code: 400, Text: "INVALID_DEDUPE_KEY"}
+	}
+
+	maxBatchBytes := s.ctx.nsqd.getOpts().MaxBodySize
+
+	var result struct {
+		Messages int         `json:"messages"`
+		Batches  []mpubBatch `json:"batches"`
+	}
+	result.Batches = []mpubBatch{}
+
+	var msgs []*Message
+	var batch mpubBatch
+	// flush publishes the pending batch, returning false if it failed
+	flush := func() bool {
+		if len(msgs) == 0 {
+			return true
+		}
+		var err error
+		topic, err = s.ctx.nsqd.putMessages(topic, msgs, "")
+		switch {
+		case err == errQuotaExceeded:
+			batch.Error = "QUOTA_EXCEEDED"
+		case err == errDiskFull:
+			batch.Error = "DISK_FULL"
+		case err == errTopicNotFound:
+			batch.Error = "TOPIC_NOT_FOUND"
+		case err != nil:
+			batch.Error = "EXITING"
+		default:
+			result.Messages += len(msgs)
+		}
+		result.Batches = append(result.Batches, batch)
+		msgs = nil
+		batch = mpubBatch{}
+		return err == nil
+	}
+	// fail ends the request on an invalid message, after the pending batch
+	fail := func(text string) {
+		if flush() {
+			result.Batches = append(result.Batches, mpubBatch{Error: text})
+		}
+	}
+
+	// a line longer than the buffer fails with bufio.ErrBufferFull, so no
+	// more than one message is ever held beyond the batch
+	rdr := bufio.NewReaderSize(req.Body, int(maxMsgSize)+1)
+	for {
+		line, err := rdr.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			fail("MSG_TOO_BIG")
+			break
+		}
+		if err != nil && err != io.EOF {
+			s.ctx.nsqd.logf(LOG_ERROR, "failed to read /mpub stream - %s", err)
+			fail("INTERNAL_ERROR")
+			break
+		}
+		eof := err == io.EOF
+
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		// silently discard 0 length messages, like the text mode
+		if len(line) > 0 {
+			if int64(len(line)) > maxMsgSize {
+				fail("MSG_TOO_BIG")
+				break
+			}
+			if batch.Bytes+int64(len(line)) > maxBatchBytes && !flush() {
+				break
+			}
+			// ReadSlice's buffer is reused by the next read
+			body := make([]byte, len(line))
+			copy(body, line)
+			msg := NewMessage(topic.GenerateID(), body)
+			if len(headers) > 0 {
+				msg.Headers = headers
+			}
+			msgs = append(msgs, msg)
+			batch.Messages++
+			batch.Bytes += int64(len(body))
+			if len(msgs) == batchSize && !flush() {
+				break
+			}
+		}
+
+		if eof {
+			flush()
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var msgs []*Message
+	var exit bool
+
+	// TODO: one day I'd really like to just error on chunked requests
+	// to be able to fail "too big" requests before we even read
+
+	streamMode := boolParams[req.URL.Query().Get("stream")]
+	if !streamMode && req.ContentLength > s.ctx.nsqd.getOpts().MaxBodySize {
+		return nil, http_api.Err{Code: 413, Text: "BODY_TOO_BIG"}
+	}
+
+	reqParams, topic, err := s.getTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the headers are set on every message, and count against its size
+	headers, err := getMsgHeadersFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	maxMsgSize := topic.config.maxMsgSize() - msgHeadersSize(headers)
+	if maxMsgSize <= 0 {
+		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	}
+
+	if streamMode {
+		return s.doMPUBStream(req, reqParams, topic, headers, maxMsgSize)
+	}
+
+	dedupeKey, err := getDedupeKeyFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// text mode is default, but unrecognized binary opt considered true
+	binaryMode := false
+	if vals, ok := reqParams["binary"]; ok {
+		if binaryMode, ok = boolParams[vals[0]]; !ok {
+			binaryMode = true
+			s.ctx.nsqd.logf(LOG_WARN, "deprecated value '%s' used for /mpub binary param", vals[0])
+		}
+	}
+	if binaryMode {
+		tmp := make([]byte, 4)
+		msgs, err = readMPUB(req.Body, tmp, topic,
+			maxMsgSize, s.ctx.nsqd.getOpts().MaxBodySize)
+		if err != nil {
+			return nil, http_api.Err{Code: 413, Text: err.(*protocol.FatalClientErr).Code[2:]}
+		}
+	} else {
+		// add 1 so that it's greater than our max when we test for it
+		// (LimitReader returns a "fake" EOF)
+		readMax := s.ctx.nsqd.getOpts().MaxBodySize + 1
+		rdr := bufio.NewReader(io.LimitReader(req.Body, readMax))
+		total := 0
+		for !exit {
+			var block []byte
+			block, err = rdr.ReadBytes('\n')
+			if err != nil {
+				if err != io.EOF {
+					return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+				}
+				exit = true
+			}
+			total += len(block)
+			if int64(total) == readMax {
+				return nil, http_api.Err{Code: 413, Text: "BODY_TOO_BIG"}
+			}
+
+			if len(block) > 0 && block[len(block)-1] == '\n' {
+				block = block[:len(block)-1]
+			}
+
+			// silently discard 0 length messages
+			// this maintains the behavior pre 0.2.22
+			if len(block) == 0 {
+				continue
+			}
+
+			if int64(len(block)) > maxMsgSize {
+				return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+			}
+
+			msg := NewMessage(topic.GenerateID(), block)
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(headers) > 0 {
+		for _, msg := range msgs {
+			msg.Headers = headers
+		}
+	}
+
+	_, err = s.ctx.nsqd.putMessages(topic, msgs, dedupeKey)
+	if err == errQuotaExceeded {
+		return nil, http_api.Err{Code: 429, Text: "QUOTA_EXCEEDED"}
+	}
+	if err == errDiskFull {
+		return nil, http_api.Err{Code: 507, Text: "DISK_FULL"}
+	}
+	if err == errTopicNotFound {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+	if err != nil {
+		return nil, http_api.Err{Code: 503, Text: "EXITING"}
+	}
+
+	return "OK", nil
+}
+
+func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	var retentionTime time.Duration
+	var retentionBytes int64
+	_, hasRetentionTime := reqParams["retention"]
+	_, hasRetentionBytes := reqParams["retention_bytes"]
+	if hasRetentionTime {
+		retentionTime, err = time.ParseDuration(reqParams.Get("retention"))
+		if err != nil || retentionTime < 0 {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_RETENTION"}
+		}
+	}
+	if hasRetentionBytes {
+		retentionBytes, err = strconv.ParseInt(reqParams.Get("retention_bytes"), 10, 64)
+		if err != nil || retentionBytes < 0 {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_RETENTION_BYTES"}
+		}
+	}
+
+	// explicit creation, regardless of --auto-create-topics
+	_, topicName, err := s.getTopicNameFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	if (hasRetentionTime || hasRetentionBytes) && strings.HasSuffix(topicName, "#ephemeral") {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_RETENTION"}
+	}
+	topic := s.ctx.nsqd.GetTopic(topicName)
+	if hasRetentionTime || hasRetentionBytes {
+		topic.SetRetention(retentionTime, retentionBytes)
+
+		// pro-actively persist metadata so in case of process failure
+		// nsqd won't lose the topic's retention window
+		s.ctx.nsqd.Lock()
+		s.ctx.nsqd.PersistMetadata()
+		s.ctx.nsqd.Unlock()
+	}
+	return nil, nil
+}
+
+// getQueueConfigFromQuery applies the QueueConfig params in the query to
+// config, an empty value clearing the override. max_msg_size only applies
+// to topics.
+func (s *httpServer) getQueueConfigFromQuery(reqParams *http_api.ReqParams, config QueueConfig, isTopic bool) (QueueConfig, error) {
+	opts := s.ctx.nsqd.getOpts()
+
+	parseInt := func(name string, min int64, max int64, v **int64) error {
+		vals, ok := reqParams.Values[name]
+		if !ok {
+			return nil
+		}
+		if vals[0] == "" {
+			*v = nil
+			return nil
+		}
+		i, err := strconv.ParseInt(vals[0], 10, 64)
+		if err != nil || i < min || i > max {
+			return http_api.Err{Code: 400, Text: "INVALID_" + strings.ToUpper(name)}
+		}
+		*v = &i
+		return nil
+	}
+
+	err := parseInt("mem_queue_size", 0, math.MaxInt32, &config.MemQueueSize)
+	if err != nil {
+		return config, err
+	}
+	err = parseInt("sync_every", 1, math.MaxInt64, &config.SyncEvery)
+	if err != nil {
+		return config, err
+	}
+	if _, ok := reqParams.Values["max_msg_size"]; ok && !isTopic {
+		return config, http_api.Err{Code: 400, Text: "INVALID_MAX_MSG_SIZE"}
+	}
+	err = parseInt("max_msg_size", 1, opts.MaxBodySize, &config.MaxMsgSize)
+	if err != nil {
+		return config, err
+	}
+
+	err = parseInt("max_channel_consumers", 0, math.MaxInt32, &config.MaxChannelConsumers)
+	if err != nil {
+		return config, err
+	}
+	err = parseInt("max_depth", 0, math.MaxInt64, &config.MaxDepth)
+	if err != nil {
+		return config, err
+	}
+	err = parseInt("max_bytes", 0, math.MaxInt64, &config.MaxBytes)
+	if err != nil {
+		return config, err
+	}
+	if vals, ok := reqParams.Values["overflow_policy"]; ok {
+		config.OverflowPolicy = nil
+		if vals[0] != "" {
+			if !isValidOverflowPolicy(vals[0]) {
+				return config, http_api.Err{Code: 400, Text: "INVALID_OVERFLOW_POLICY"}
+			}
+			policy := vals[0]
+			config.OverflowPolicy = &policy
+		}
+	}
+
+	if vals, ok := reqParams.Values["msg_timeout"]; ok {
+		config.MsgTimeout = nil
+		if vals[0] != "" {
+			d, err := time.ParseDuration(vals[0])
+			if err != nil || d < time.Second || d > opts.MaxMsgTimeout {
+				return config, http_api.Err{Code: 400, Text: "INVALID_MSG_TIMEOUT"}
+			}
+			config.MsgTimeout = &d
+		}
+	}
+
+	return config, nil
+}
+
+// getMsgHeadersFromQuery returns the headers of a publish, from its "header"
+// (key:value) params and its ordering "key" param
+func getMsgHeadersFromQuery(reqParams url.Values) (map[string]string, error) {
+	var headers map[string]string
+	if vals, ok := reqParams["header"]; ok {
+		headers = make(map[string]string, len(vals))
+		for _, v := range vals {
+			kv := strings.SplitN(v, ":", 2)
+			if len(kv) != 2 {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_HEADER"}
+			}
+			headers[kv[0]] = kv[1]
+		}
+		if validateMsgHeaders(headers) != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_HEADER"}
+		}
+	}
+
+	if key, ok := reqParams["key"]; ok && key[0] != "" {
+		if headers == nil {
+			headers = make(map[string]string, 1)
+		}
+		headers[orderingKeyHeader] = key[0]
+		if validateMsgHeaders(headers) != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_KEY"}
+		}
+	}
+	return headers, nil
+}
+
+// getDedupeKeyFromQuery returns the optional "dedupe_key" param of a publish
+func getDedupeKeyFromQuery(reqParams url.Values) (string, error) {
+	vals, ok := reqParams["dedupe_key"]
+	if !ok {
+		return "", nil
+	}
+	if !isValidDedupeKey(vals[0]) {
+		return "", http_api.Err{Code: 400, Text: "INVALID_DEDUPE_KEY"}
+	}
+	return vals[0], nil
+}
+
+// getSinceFromQuery parses the "since" param of a rewind, either "oldest" or a
+// unix timestamp (in seconds), into nanoseconds since epoch
+func getSinceFromQuery(reqParams *http_api.ReqParams) (int64, error) {
+	since, err := reqParams.Get("since")
+	if err != nil {
+		return 0, http_api.Err{Code: 400, Text: "MISSING_ARG_SINCE"}
+	}
+	if since == "oldest" {
+		return 0, nil
+	}
+	ts, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, http_api.Err{Code: 400, Text: "INVALID_SINCE"}
+	}
+	return time.Unix(ts, 0).UnixNano(), nil
+}
+
+// getPeekCountFromQuery returns the number of messages to peek at, "n" in the
+// query
+func getPeekCountFromQuery(reqParams *http_api.ReqParams) (int, error) {
+	n, err := reqParams.Get("n")
+	if err != nil {
+		return defaultPeekCount, nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count <= 0 || count > maxPeekCount {
+		return 0, http_api.Err{Code: 400, Text: "INVALID_N"}
+	}
+	return count, nil
+}
+
+// doPeekTopic returns the next messages queued in a topic without consuming
+// them
+func (s *httpServer) doPeekTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
+	}
+
+	n, err := getPeekCountFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	result, err := topic.Peek(n)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to peek topic %s - %s", topicName, err)
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+	return result, nil
+}
+
+func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	err = topic.Empty()
+	if err != nil {
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+
+	return nil, nil
+}
+
+func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+
+	err = s.ctx.nsqd.DeleteExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	return nil, nil
+}
+
+func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	if strings.Contains(req.URL.Path, "unpause") {
+		err = topic.UnPause()
+	} else {
+		err = topic.Pause()
+	}
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't suddenly (un)pause a topic
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return nil, nil
+}
+
+// doTopicConfig sets (or with an empty value, clears) the topic's
+// configuration overrides given in the query, returning them
+func (s *httpServer) doTopicConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	config, err := s.getQueueConfigFromQuery(reqParams, topic.Config(), true)
+	if err != nil {
+		return nil, err
+	}
+	topic.SetConfig(config)
+
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return config, nil
+}
+
+func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var since int64
+	_, rewind := reqParams.Values["since"]
+	if rewind {
+		since, err = getSinceFromQuery(reqParams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var filter *msgFilter
+	_, hasFilter := reqParams.Values["filter"]
+	if hasFilter {
+		// an empty filter removes the channel's filter
+		if expr, _ := reqParams.Get("filter"); expr != "" {
+			filter, err = parseMsgFilter(expr)
+			if err != nil {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_FILTER"}
+			}
+		}
+	}
+
+	var ordered bool
+	_, hasOrdered := reqParams.Values["ordered"]
+	if hasOrdered {
+		v, _ := reqParams.Get("ordered")
+		var ok bool
+		if ordered, ok = boolParams[v]; !ok {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_ORDERED"}
+		}
+	}
+
+	var maxAttempts uint64
+	var deadLetterTopic string
+	if ma, err := reqParams.Get("max_attempts"); err == nil {
+		maxAttempts, err = strconv.ParseUint(ma, 10, 16)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_MAX_ATTEMPTS"}
+		}
+		if maxAttempts > 0 {
+			deadLetterTopic, _ = reqParams.Get("dead_letter_topic")
+			if !protocol.IsValidTopicName(deadLetterTopic) || deadLetterTopic == topic.name {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_DEAD_LETTER_TOPIC"}
+			}
+		}
+	}
+
+	// an existing channel is only rewound explicitly, by /channel/rewind
+	_, err = topic.GetExistingChannel(channelName)
+	isNew := err != nil
+	if rewind && !isNew {
+		return nil, http_api.Err{Code: 400, Text: "CHANNEL_EXISTS"}
+	}
+	channel := topic.GetChannel(channelName)
+	_, hasMaxAttempts := reqParams.Values["max_attempts"]
+	if hasMaxAttempts {
+		channel.SetDeadLetter(uint16(maxAttempts), deadLetterTopic)
+	}
+	if hasFilter {
+		channel.SetFilter(filter)
+	}
+	if hasOrdered {
+		channel.SetOrdered(ordered)
+	}
+	if hasMaxAttempts || hasFilter || hasOrdered {
+		// pro-actively persist metadata so in case of process failure
+		// nsqd won't lose the channel's dead-letter policy, filter or mode
+		s.ctx.nsqd.Lock()
+		s.ctx.nsqd.PersistMetadata()
+		s.ctx.nsqd.Unlock()
+	}
+
+	// a new channel can start from retained messages rather than only
+	// receiving those published from now on
+	if rewind {
+		_, err = topic.RewindChannel(channelName, since)
+		if err != nil {
+			s.ctx.nsqd.logf(LOG_ERROR, "failed to rewind channel %s - %s", channelName, err)
+			return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+		}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doRewindChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	since, err := getSinceFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	count, err := topic.RewindChannel(channelName, since)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to rewind channel %s - %s", channelName, err)
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+
+	return struct {
+		Count int64 `json:"count"`
+	}{count}, nil
+}
+
+// doChannelConfig sets (or with an empty value, clears) the channel's
+// configuration overrides given in the query, returning them
+func (s *httpServer) doChannelConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	config, err := s.getQueueConfigFromQuery(reqParams, channel.Config(), false)
+	if err != nil {
+		return nil, err
+	}
+	channel.SetConfig(config)
+
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return config, nil
+}
+
+// doPeekChannel returns the next messages queued in a channel, and its
+// in-flight and deferred messages, without altering their delivery
+func (s *httpServer) doPeekChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := getPeekCountFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	result, err := channel.Peek(n)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to peek channel %s - %s", channelName, err)
+		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+	}
+	return result, nil
+}
+
+// getPushConfigFromQuery returns the push subscription given in the query,
+// durations are in ms
+func (s *httpServer) getPushConfigFromQuery(reqParams *http_api.ReqParams) (PushConfig, error) {
+	cfg := PushConfig{
+		Concurrency: defaultPushConcurrency,
+		Timeout:     defaultPushTimeout,
+		Backoff:     defaultPushBackoff,
+		MaxBackoff:  defaultPushMaxBackoff,
+	}
+
+	var err error
+	cfg.URL, err = reqParams.Get("url")
+	if err != nil {
+		return cfg, http_api.Err{Code: 400, Text: "MISSING_ARG_URL"}
+	}
+
+	if v, err := reqParams.Get("concurrency"); err == nil {
+		cfg.Concurrency, err = strconv.Atoi(v)
+		if err != nil {
+			return cfg, http_api.Err{Code: 400, Text: "INVALID_CONCURRENCY"}
+		}
+	}
+	for _, d := range []struct {
+		name string
+		v    *time.Duration
+	}{
+		{"timeout", &cfg.Timeout},
+		{"backoff", &cfg.Backoff},
+		{"max_backoff", &cfg.MaxBackoff},
+	} {
+		v, err := reqParams.Get(d.name)
+		if err != nil {
+			continue
+		}
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cfg, http_api.Err{Code: 400, Text: "INVALID_" + strings.ToUpper(d.name)}
+		}
+		*d.v = time.Duration(ms) * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = cfg.Backoff
+	}
+
+	err = cfg.validate(s.ctx.nsqd.getOpts())
+	if err != nil {
+		return cfg, http_api.Err{Code: 400, Text: err.Error()}
+	}
+	return cfg, nil
+}
+
+// doCreatePush subscribes an HTTP endpoint to a channel (creating it), nsqd
+// POSTs the channel's messages to it
+func (s *httpServer) doCreatePush(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, nil, "", http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+		return nil, err
 	}
 
-	topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+	cfg, err := s.getPushConfigFromQuery(reqParams)
 	if err != nil {
-		return nil, nil, "", http_api.Err{Code: 400, Text: err.Error()}
+		return nil, err
 	}
 
-	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	channel := topic.GetChannel(channelName)
+	err = channel.AddPushSubscription(cfg)
 	if err != nil {
-		return nil, nil, "", http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+		return nil, http_api.Err{Code: 400, Text: err.Error()}
 	}
 
-	return reqParams, topic, channelName, err
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return cfg, nil
 }
 
-func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
-	//ParseQuery把参数解析成map的形式。
-	reqParams, err := url.ParseQuery(req.URL.RawQuery) //RawQuery指的就是url问号后面的所有参数，不包括#之后的内容。URL结构体中Fragment中存放的就是#号后面的东西。
+func (s *httpServer) doDeletePush(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+		return nil, err
 	}
 
-	topicNames, ok := reqParams["topic"]
-	if !ok {
-		return nil, nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	rawURL, err := reqParams.Get("url")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_URL"}
 	}
-	topicName := topicNames[0] //因为ParseQuery解析出来的map中的value都是数组形式，就算只有一个值也是数组的形式，所以此处指明索引为0
 
-	if !protocol.IsValidTopicName(topicName) { //验证topic格式
-		return nil, nil, http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	err = channel.RemovePushSubscription(rawURL)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "PUSH_NOT_FOUND"}
 	}
 
-	return reqParams, s.ctx.nsqd.GetTopic(topicName), nil
+	s.ctx.nsqd.Lock()
+	s.ctx.nsqd.PersistMetadata()
+	s.ctx.nsqd.Unlock()
+	return nil, nil
 }
 
-func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	// TODO: one day I'd really like to just error on chunked requests
-	// to be able to fail "too big" requests before we even read
+// getChannelMessageFromQuery returns the channel and the message "id" given in
+// the query
+func (s *httpServer) getChannelMessageFromQuery(req *http.Request) (*http_api.ReqParams, *Channel, MessageID, error) {
+	var id MessageID
 
-	if req.ContentLength > s.ctx.nsqd.getOpts().MaxMsgSize { //发送消息的长度和配置设定的大小对比
-		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, nil, id, err
 	}
 
-	// add 1 so that it's greater than our max when we test for it
-	// (LimitReader returns a "fake" EOF)
-	readMax := s.ctx.nsqd.getOpts().MaxMsgSize + 1
-	//io.LimitReader从reader中读取readMax字节
-	//ioutil.ReadAll一次性全部读取，成功后err返回nil,而非EOF.
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	idStr, err := reqParams.Get("id")
 	if err != nil {
-		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
-	}
-	if int64(len(body)) == readMax {
-		return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
+		return nil, nil, id, http_api.Err{Code: 400, Text: "MISSING_ARG_ID"}
 	}
-	if len(body) == 0 {
-		return nil, http_api.Err{Code: 400, Text: "MSG_EMPTY"}
+	if len(idStr) != MsgIDLength {
+		return nil, nil, id, http_api.Err{Code: 400, Text: "INVALID_ID"}
 	}
-	//1.看有没有topic，有则返回
-	//无则创建topic，并通知lookup，创建完后通知此topic的messagePump跑起来
-	reqParams, topic, err := s.getTopicFromQuery(req) //首先要从http query中拿到topic
+	copy(id[:], idStr)
+
+	channel, err := topic.GetExistingChannel(channelName)
 	if err != nil {
-		return nil, err
+		return nil, nil, id, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
 	}
 
-	var deferred time.Duration
-	if ds, ok := reqParams["defer"]; ok {
-		var di int64
-		di, err = strconv.ParseInt(ds[0], 10, 64)
-		if err != nil {
-			return nil, http_api.Err{Code: 400, Text: "INVALID_DEFER"}
-		}
-		deferred = time.Duration(di) * time.Millisecond
-		if deferred < 0 || deferred > s.ctx.nsqd.getOpts().MaxReqTimeout {
-			return nil, http_api.Err{Code: 400, Text: "INVALID_DEFER"}
-		}
+	return reqParams, channel, id, nil
+}
+
+// doDeleteMessage discards an in-flight or deferred message of a channel
+func (s *httpServer) doDeleteMessage(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, channel, id, err := s.getChannelMessageFromQuery(req)
+	if err != nil {
+		return nil, err
 	}
 
-	msg := NewMessage(topic.GenerateID(), body)
-	msg.deferred = deferred
-	err = topic.PutMessage(msg) //publish消息，把消息放到内存或者磁盘队列中。
+	err = channel.DeleteMessage(id)
 	if err != nil {
-		return nil, http_api.Err{Code: 503, Text: "EXITING"}
+		return nil, http_api.Err{Code: 404, Text: "MESSAGE_NOT_FOUND"}
 	}
 
-	return "OK", nil
+	return nil, nil
 }
 
-func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	var msgs []*Message
-	var exit bool
-
-	// TODO: one day I'd really like to just error on chunked requests
-	// to be able to fail "too big" requests before we even read
-
-	if req.ContentLength > s.ctx.nsqd.getOpts().MaxBodySize {
-		return nil, http_api.Err{Code: 413, Text: "BODY_TOO_BIG"}
+// doRequeueMessage moves an in-flight or deferred message of a channel back
+// to its queue
+func (s *httpServer) doRequeueMessage(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, channel, id, err := s.getChannelMessageFromQuery(req)
+	if err != nil {
+		return nil, err
 	}
+	return nil, s.rescheduleMessage(channel, id, 0)
+}
 
-	reqParams, topic, err := s.getTopicFromQuery(req)
+// doRescheduleMessage moves an in-flight or deferred message of a channel
+// back to its queue after "timeout" (in ms)
+func (s *httpServer) doRescheduleMessage(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, channel, id, err := s.getChannelMessageFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
 
-	// text mode is default, but unrecognized binary opt considered true
-	binaryMode := false
-	if vals, ok := reqParams["binary"]; ok {
-		if binaryMode, ok = boolParams[vals[0]]; !ok {
-			binaryMode = true
-			s.ctx.nsqd.logf(LOG_WARN, "deprecated value '%s' used for /mpub binary param", vals[0])
-		}
+	ts, err := reqParams.Get("timeout")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TIMEOUT"}
+	}
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_TIMEOUT"}
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout < 0 || timeout > s.ctx.nsqd.getOpts().MaxReqTimeout {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_TIMEOUT"}
 	}
-	if binaryMode {
-		tmp := make([]byte, 4)
-		msgs, err = readMPUB(req.Body, tmp, topic,
-			s.ctx.nsqd.getOpts().MaxMsgSize, s.ctx.nsqd.getOpts().MaxBodySize)
-		if err != nil {
-			return nil, http_api.Err{Code: 413, Text: err.(*protocol.FatalClientErr).Code[2:]}
-		}
-	} else {
-		// add 1 so that it's greater than our max when we test for it
-		// (LimitReader returns a "fake" EOF)
-		readMax := s.ctx.nsqd.getOpts().MaxBodySize + 1
-		rdr := bufio.NewReader(io.LimitReader(req.Body, readMax))
-		total := 0
-		for !exit {
-			var block []byte
-			block, err = rdr.ReadBytes('\n')
-			if err != nil {
-				if err != io.EOF {
-					return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
-				}
-				exit = true
-			}
-			total += len(block)
-			if int64(total) == readMax {
-				return nil, http_api.Err{Code: 413, Text: "BODY_TOO_BIG"}
-			}
-
-			if len(block) > 0 && block[len(block)-1] == '\n' {
-				block = block[:len(block)-1]
-			}
-
-			// silently discard 0 length messages
-			// this maintains the behavior pre 0.2.22
-			if len(block) == 0 {
-				continue
-			}
 
-			if int64(len(block)) > s.ctx.nsqd.getOpts().MaxMsgSize {
-				return nil, http_api.Err{Code: 413, Text: "MSG_TOO_BIG"}
-			}
+	return nil, s.rescheduleMessage(channel, id, timeout)
+}
 
-			msg := NewMessage(topic.GenerateID(), block)
-			msgs = append(msgs, msg)
-		}
+func (s *httpServer) rescheduleMessage(channel *Channel, id MessageID, timeout time.Duration) error {
+	err := channel.RescheduleMessage(id, timeout)
+	if err == errMessageNotPending {
+		return http_api.Err{Code: 404, Text: "MESSAGE_NOT_FOUND"}
 	}
-
-	err = topic.PutMessages(msgs)
 	if err != nil {
-		return nil, http_api.Err{Code: 503, Text: "EXITING"}
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to requeue message %s - %s", id, err)
+		return http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
 	}
-
-	return "OK", nil
+	return nil
 }
 
-func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, _, err := s.getTopicFromQuery(req)
-	return nil, err
+// getHTTPConsumerFromQuery returns the HTTP consumer "session" given in the
+// query, acquired for the request (the caller must release it). The request
+// must be authorized to subscribe to its channel, like the one that started it
+func (s *httpServer) getHTTPConsumerFromQuery(req *http.Request, reqParams *http_api.ReqParams) (*httpConsumer, error) {
+	session, err := reqParams.Get("session")
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_SESSION"}
+	}
+	h, err := s.ctx.nsqd.getHTTPConsumer(session)
+	if err != nil {
+		return nil, http_api.Err{Code: 404, Text: "SESSION_NOT_FOUND"}
+	}
+	err = s.checkAuth(req, "subscribe", h.Channel.topicName, h.Channel.name)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	return h, nil
 }
 
-func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+// getHTTPConsumerMessageFromQuery returns the HTTP consumer "session" and the
+// message "id" given in the query
+func (s *httpServer) getHTTPConsumerMessageFromQuery(req *http.Request) (*http_api.ReqParams, *httpConsumer, MessageID, error) {
+	var id MessageID
+
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
 		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+		return nil, nil, id, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
 	}
 
-	topicName, err := reqParams.Get("topic")
+	idStr, err := reqParams.Get("id")
 	if err != nil {
-		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
-	}
-
-	if !protocol.IsValidTopicName(topicName) {
-		return nil, http_api.Err{Code: 400, Text: "INVALID_TOPIC"}
+		return nil, nil, id, http_api.Err{Code: 400, Text: "MISSING_ARG_ID"}
 	}
-
-	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
-	if err != nil {
-		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	if len(idStr) != MsgIDLength {
+		return nil, nil, id, http_api.Err{Code: 400, Text: "INVALID_ID"}
 	}
+	copy(id[:], idStr)
 
-	err = topic.Empty()
+	h, err := s.getHTTPConsumerFromQuery(req, reqParams)
 	if err != nil {
-		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+		return nil, nil, id, err
 	}
-
-	return nil, nil
+	return reqParams, h, id, nil
 }
 
-func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+// doSUB long-polls a channel for an HTTP consumer session, started by the
+// first request (with "topic" and "channel") and continued by passing the
+// "session" it returns. It waits up to "wait" (in ms) for a message and
+// returns up to "n" messages, in flight until FINed, REQed or timed out
+func (s *httpServer) doSUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
 		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
 		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
 	}
+	opts := s.ctx.nsqd.getOpts()
 
-	topicName, err := reqParams.Get("topic")
+	n := 1
+	if nStr, err := reqParams.Get("n"); err == nil {
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n <= 0 || int64(n) > opts.MaxRdyCount {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_N"}
+		}
+	}
+
+	wait := defaultHTTPConsumerWait
+	if waitStr, err := reqParams.Get("wait"); err == nil {
+		ms, err := strconv.ParseInt(waitStr, 10, 64)
+		if err != nil || ms < 0 {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_WAIT"}
+		}
+		wait = time.Duration(ms) * time.Millisecond
+	}
+	if wait > opts.HTTPConsumerSessionTimeout {
+		wait = opts.HTTPConsumerSessionTimeout
+	}
+
+	var h *httpConsumer
+	if _, err := reqParams.Get("session"); err == nil {
+		h, err = s.getHTTPConsumerFromQuery(req, reqParams)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		topicName, channelName, err := http_api.GetTopicChannelArgs(reqParams)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: err.Error()}
+		}
+		err = s.checkAuth(req, "subscribe", topicName, channelName)
+		if err != nil {
+			return nil, err
+		}
+
+		var msgTimeout time.Duration
+		if msStr, err := reqParams.Get("msg_timeout"); err == nil {
+			ms, err := strconv.ParseInt(msStr, 10, 64)
+			msgTimeout = time.Duration(ms) * time.Millisecond
+			if err != nil || msgTimeout < 1000*time.Millisecond || msgTimeout > opts.MaxMsgTimeout {
+				return nil, http_api.Err{Code: 400, Text: "INVALID_MSG_TIMEOUT"}
+			}
+		}
+
+		// same retry-loop as SUB, a channel / topic may start exiting
+		// (deleted for being ephemeral or idle) between GetChannel() and
+		// AddClient()
+		for {
+			topic, err := s.ctx.nsqd.getImplicitTopic(topicName)
+			if err != nil {
+				return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+			}
+			channel := topic.GetChannel(channelName)
+			h, err = s.ctx.nsqd.addHTTPConsumer(channel, req.RemoteAddr, req.UserAgent(), msgTimeout)
+			if err != nil {
+				return nil, http_api.Err{Code: 400, Text: "TOO_MANY_CHANNEL_CONSUMERS"}
+			}
+			if channel.Exiting() || topic.Exiting() {
+				s.ctx.nsqd.removeHTTPConsumer(h)
+				if !s.ctx.nsqd.retryExiting() {
+					return nil, http_api.Err{Code: 503, Text: "EXITING"}
+				}
+				continue
+			}
+			break
+		}
+		h.acquire()
+		s.ctx.nsqd.logf(LOG_INFO, "%s: subscribed to %s:%s", h, topicName, channelName)
+	}
+	defer h.release()
+
+	msgs := h.poll(n, wait)
+
+	return struct {
+		Session  string                `json:"session"`
+		Messages []httpConsumerMessage `json:"messages"`
+	}{h.Session, newHTTPConsumerMessages(msgs)}, nil
+}
+
+// doFIN finishes a message sent to an HTTP consumer session
+func (s *httpServer) doFIN(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, h, id, err := s.getHTTPConsumerMessageFromQuery(req)
 	if err != nil {
-		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+		return nil, err
 	}
+	defer h.release()
 
-	err = s.ctx.nsqd.DeleteExistingTopic(topicName)
+	err = h.Channel.FinishMessage(h.ID, id)
 	if err != nil {
-		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+		return nil, http_api.Err{Code: 400, Text: "FIN_FAILED"}
 	}
+	h.FinishedMessage()
 
 	return nil, nil
 }
 
-func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	reqParams, err := http_api.NewReqParams(req)
+// doREQ requeues a message sent to an HTTP consumer session, after "timeout"
+// (in ms, clamped to --max-req-timeout)
+func (s *httpServer) doREQ(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, h, id, err := s.getHTTPConsumerMessageFromQuery(req)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+		return nil, err
 	}
+	defer h.release()
 
-	topicName, err := reqParams.Get("topic")
+	var timeout time.Duration
+	if ts, err := reqParams.Get("timeout"); err == nil {
+		ms, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_TIMEOUT"}
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	maxReqTimeout := s.ctx.nsqd.getOpts().MaxReqTimeout
+	clampedTimeout := timeout
+	if timeout < 0 {
+		clampedTimeout = 0
+	} else if timeout > maxReqTimeout {
+		clampedTimeout = maxReqTimeout
+	}
+	if clampedTimeout != timeout {
+		s.ctx.nsqd.logf(LOG_INFO, "%s: REQ timeout %d out of range 0-%d. Setting to %d",
+			h, timeout, maxReqTimeout, clampedTimeout)
+		timeout = clampedTimeout
+	}
+
+	err = h.Channel.RequeueMessage(h.ID, id, timeout)
 	if err != nil {
-		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+		return nil, http_api.Err{Code: 400, Text: "REQ_FAILED"}
 	}
+	h.RequeuedMessage()
 
-	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
+	return nil, nil
+}
+
+// doTOUCH resets the timeout of a message sent to an HTTP consumer session
+func (s *httpServer) doTOUCH(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, h, id, err := s.getHTTPConsumerMessageFromQuery(req)
 	if err != nil {
-		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+		return nil, err
 	}
+	defer h.release()
 
-	if strings.Contains(req.URL.Path, "unpause") {
-		err = topic.UnPause()
-	} else {
-		err = topic.Pause()
+	msgTimeout := h.MsgTimeout
+	if msgTimeout == 0 {
+		msgTimeout = h.Channel.MsgTimeout()
 	}
+	err = h.Channel.TouchMessage(h.ID, id, msgTimeout)
 	if err != nil {
-		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
-		return nil, http_api.Err{Code: 500, Text: "INTERNAL_ERROR"}
+		return nil, http_api.Err{Code: 400, Text: "TOUCH_FAILED"}
 	}
 
-	// pro-actively persist metadata so in case of process failure
-	// nsqd won't suddenly (un)pause a topic
-	s.ctx.nsqd.Lock()
-	s.ctx.nsqd.PersistMetadata()
-	s.ctx.nsqd.Unlock()
 	return nil, nil
 }
 
-func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+// doCLS ends an HTTP consumer session, its in-flight messages are requeued
+func (s *httpServer) doCLS(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{Code: 400, Text: "INVALID_REQUEST"}
+	}
+
+	h, err := s.getHTTPConsumerFromQuery(req, reqParams)
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+	h.release()
+	s.ctx.nsqd.removeHTTPConsumer(h)
+
 	return nil, nil
 }
 
@@ -547,8 +1717,10 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 	}
 
 	ms := getMemStats()
+	disk := s.ctx.nsqd.getDiskStats()
+	auth := s.ctx.nsqd.getAuthStats()
 	if !jsonFormat {
-		return s.printStats(stats, producerStats, ms, health, startTime, uptime), nil
+		return s.printStats(stats, producerStats, ms, disk, auth, health, startTime, uptime), nil
 	}
 
 	return struct {
@@ -557,11 +1729,13 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		StartTime int64         `json:"start_time"`
 		Topics    []TopicStats  `json:"topics"`
 		Memory    memStats      `json:"memory"`
+		Disk      diskStats     `json:"disk"`
+		Auth      *authStats    `json:"auth,omitempty"`
 		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats, ms, producerStats}, nil
+	}{version.Binary, health, startTime.Unix(), stats, ms, disk, auth, producerStats}, nil
 }
 
-func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, ms memStats, health string, startTime time.Time, uptime time.Duration) []byte {
+func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, ms memStats, disk diskStats, auth *authStats, health string, startTime time.Time, uptime time.Duration) []byte {
 	var buf bytes.Buffer
 	w := &buf
 
@@ -584,6 +1758,20 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 	fmt.Fprintf(w, "   %-25s\t%d\n", "next_gc_bytes", ms.NextGCBytes)
 	fmt.Fprintf(w, "   %-25s\t%d\n", "gc_total_runs", ms.GCTotalRuns)
 
+	fmt.Fprintf(w, "\nDisk: %s\n", disk.Status)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "free_bytes", disk.FreeBytes)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "soft_limit", disk.SoftLimit)
+	fmt.Fprintf(w, "   %-25s\t%d\n", "hard_limit", disk.HardLimit)
+
+	if auth != nil {
+		fmt.Fprintf(w, "\nAuth:\n")
+		fmt.Fprintf(w, "   %-25s\t%d\n", "queries", auth.Queries)
+		fmt.Fprintf(w, "   %-25s\t%d\n", "errors", auth.Errors)
+		fmt.Fprintf(w, "   %-25s\t%d\n", "cache_hits", auth.CacheHits)
+		fmt.Fprintf(w, "   %-25s\t%d\n", "stale_hits", auth.StaleHits)
+		fmt.Fprintf(w, "   %-25s\t%s\n", "latency", auth.Latency)
+	}
+
 	if len(stats) == 0 {
 		fmt.Fprintf(w, "\nTopics: None\n")
 	} else {
@@ -605,13 +1793,16 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 			t.MessageCount,
 			t.E2eProcessingLatency,
 		)
+		if t.IdleExpiresAt > 0 {
+			fmt.Fprintf(w, "    idle, expires: %s\n", time.Unix(t.IdleExpiresAt, 0).Format(time.RFC3339))
+		}
 		for _, c := range t.Channels {
 			if c.Paused {
 				pausedPrefix = "   *P "
 			} else {
 				pausedPrefix = "      "
 			}
-			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d dead: %-5d msgs: %-8d oldest: %-8s e2e%%: %s\n",
 				pausedPrefix,
 				c.ChannelName,
 				c.Depth,
@@ -620,9 +1811,14 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 				c.DeferredCount,
 				c.RequeueCount,
 				c.TimeoutCount,
+				c.DeadLetterCount,
 				c.MessageCount,
+				c.OldestMessageAge.Truncate(time.Second),
 				c.E2eProcessingLatency,
 			)
+			if c.IdleExpiresAt > 0 {
+				fmt.Fprintf(w, "          idle, expires: %s\n", time.Unix(c.IdleExpiresAt, 0).Format(time.RFC3339))
+			}
 			for _, client := range c.Clients {
 				connectTime := time.Unix(client.ConnectTime, 0)
 				// truncate to the second
@@ -672,6 +1868,14 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 	return buf.Bytes()
 }
 
+// doMetrics serves the stats in the Prometheus text format
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	e := prometheus.NewEncoder("nsq_")
+	s.ctx.nsqd.writeMetrics(e)
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	return e.Bytes(), nil
+}
+
 func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	opt := ps.ByName("opt")
 
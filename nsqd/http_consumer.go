@@ -0,0 +1,327 @@
+package nsqd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpConsumer is an HTTP consumer session: a Consumer of a channel whose
+// messages are long-polled with /sub and acknowledged with /fin, /req and
+// /touch.
+//
+// The messages it is sent are in flight like those of a TCP client and time
+// out the same way, when the session itself times out (ie. it is not used
+// for SessionTimeout) its in-flight messages time out right away.
+type httpConsumer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID             int64
+	Session        string // random, unlike ID it can't be guessed to use the session
+	Channel        *Channel
+	RemoteAddress  string
+	UserAgent      string
+	MsgTimeout     time.Duration // 0 for the channel's
+	SessionTimeout time.Duration
+	ConnectTime    time.Time
+
+	ctx *context
+
+	pollMutex sync.Mutex // a session is polled by one request at a time
+
+	sync.RWMutex
+	stateChan chan struct{} // closed (and replaced) when the channel is paused or unpaused
+	timer     *time.Timer   // expires the session
+	busy      int           // requests in progress, the session does not expire meanwhile
+
+	exitChan chan int
+	exitOnce sync.Once
+}
+
+// default duration a /sub request waits for a message
+const defaultHTTPConsumerWait = 30 * time.Second
+
+// httpConsumerMessage is a message as returned by /sub
+type httpConsumerMessage struct {
+	ID        string            `json:"id"`
+	Body      []byte            `json:"body"`
+	Timestamp int64             `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+func newHTTPConsumer(ctx *context, channel *Channel, remoteAddr string, userAgent string, msgTimeout time.Duration) *httpConsumer {
+	opts := ctx.nsqd.getOpts()
+	var session [16]byte
+	rand.Read(session[:])
+	return &httpConsumer{
+		ID:             atomic.AddInt64(&ctx.nsqd.clientIDSequence, 1),
+		Session:        hex.EncodeToString(session[:]),
+		Channel:        channel,
+		RemoteAddress:  remoteAddr,
+		UserAgent:      userAgent,
+		MsgTimeout:     msgTimeout,
+		SessionTimeout: opts.HTTPConsumerSessionTimeout,
+		ConnectTime:    time.Now(),
+		ctx:            ctx,
+		stateChan:      make(chan struct{}),
+		exitChan:       make(chan int),
+	}
+}
+
+func (h *httpConsumer) String() string {
+	return fmt.Sprintf("HTTP(%d %s)", h.ID, h.RemoteAddress)
+}
+
+// acquire marks the start of a request of the session, returning false if it
+// has expired
+func (h *httpConsumer) acquire() bool {
+	h.Lock()
+	defer h.Unlock()
+	select {
+	case <-h.exitChan:
+		return false
+	default:
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.busy++
+	return true
+}
+
+// release marks the end of a request of the session, it expires after
+// SessionTimeout without any
+func (h *httpConsumer) release() {
+	h.Lock()
+	defer h.Unlock()
+	h.busy--
+	if h.busy > 0 {
+		return
+	}
+	if h.timer == nil {
+		h.timer = time.AfterFunc(h.SessionTimeout, h.expire)
+		return
+	}
+	h.timer.Reset(h.SessionTimeout)
+}
+
+func (h *httpConsumer) expire() {
+	h.RLock()
+	busy := h.busy
+	h.RUnlock()
+	if busy > 0 {
+		return
+	}
+	h.ctx.nsqd.logf(LOG_INFO, "%s: session timed out", h)
+	h.ctx.nsqd.removeHTTPConsumer(h)
+}
+
+// poll waits up to wait for a message, then returns up to n messages
+func (h *httpConsumer) poll(n int, wait time.Duration) []*Message {
+	h.pollMutex.Lock()
+	defer h.pollMutex.Unlock()
+
+	c := h.Channel
+	msgTimeout := h.MsgTimeout
+	if msgTimeout == 0 {
+		msgTimeout = c.MsgTimeout()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var msgs []*Message
+	for len(msgs) < n {
+		var memoryMsgChan chan *Message
+		var backendMsgChan <-chan []byte
+		h.RLock()
+		stateChan := h.stateChan
+		h.RUnlock()
+		if !c.IsPaused() {
+			memoryMsgChan = c.memoryMsgChan
+			backendMsgChan = c.backend.ReadChan()
+		}
+
+		var msg *Message
+		var b []byte
+		if len(msgs) == 0 {
+			// wait for the first message only
+			select {
+			case msg = <-memoryMsgChan:
+			case b = <-backendMsgChan:
+			case <-stateChan:
+				continue
+			case <-h.exitChan:
+				return msgs
+			case <-timer.C:
+				return msgs
+			}
+		} else {
+			select {
+			case msg = <-memoryMsgChan:
+			case b = <-backendMsgChan:
+			default:
+				return msgs
+			}
+		}
+		if msg == nil {
+			var err error
+			msg, err = decodeMessage(b)
+			if err != nil {
+				h.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				continue
+			}
+		}
+		c.dequeued(msg)
+
+		if !c.FilterMessage(msg) || !c.acquireOrderingKey(msg) {
+			continue
+		}
+		msg.Attempts++
+		err := c.StartInFlightTimeout(msg, h.ID, msgTimeout)
+		if err != nil {
+			continue
+		}
+		atomic.AddInt64(&h.InFlightCount, 1)
+		atomic.AddUint64(&h.MessageCount, 1)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (h *httpConsumer) stateChanged() {
+	h.Lock()
+	close(h.stateChan)
+	h.stateChan = make(chan struct{})
+	h.Unlock()
+}
+
+func (h *httpConsumer) Pause() {
+	h.stateChanged()
+}
+
+func (h *httpConsumer) UnPause() {
+	h.stateChanged()
+}
+
+// Close ends the polls in progress, the session still expires (and is
+// forgotten) once idle for SessionTimeout
+func (h *httpConsumer) Close() error {
+	h.exitOnce.Do(func() {
+		close(h.exitChan)
+	})
+	return nil
+}
+
+func (h *httpConsumer) TimedOutMessage() {
+	atomic.AddInt64(&h.InFlightCount, -1)
+}
+
+func (h *httpConsumer) FinishedMessage() {
+	atomic.AddUint64(&h.FinishCount, 1)
+	atomic.AddInt64(&h.InFlightCount, -1)
+}
+
+func (h *httpConsumer) RequeuedMessage() {
+	atomic.AddUint64(&h.RequeueCount, 1)
+	atomic.AddInt64(&h.InFlightCount, -1)
+}
+
+func (h *httpConsumer) Empty() {
+	atomic.StoreInt64(&h.InFlightCount, 0)
+}
+
+func (h *httpConsumer) Stats() ClientStats {
+	host, _, _ := net.SplitHostPort(h.RemoteAddress)
+	return ClientStats{
+		Version:       "HTTP",
+		RemoteAddress: h.RemoteAddress,
+		ClientID:      fmt.Sprintf("http-%d", h.ID),
+		Hostname:      host,
+		UserAgent:     h.UserAgent,
+		State:         stateSubscribed,
+		InFlightCount: atomic.LoadInt64(&h.InFlightCount),
+		MessageCount:  atomic.LoadUint64(&h.MessageCount),
+		FinishCount:   atomic.LoadUint64(&h.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&h.RequeueCount),
+		ConnectTime:   h.ConnectTime.Unix(),
+	}
+}
+
+func newHTTPConsumerMessages(msgs []*Message) []httpConsumerMessage {
+	hmsgs := make([]httpConsumerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		hmsgs = append(hmsgs, httpConsumerMessage{
+			ID:        string(msg.ID[:]),
+			Body:      msg.Body,
+			Timestamp: msg.Timestamp,
+			Attempts:  msg.Attempts,
+			Headers:   msg.Headers,
+		})
+	}
+	return hmsgs
+}
+
+// addHTTPConsumer starts an HTTP consumer session on channel
+func (n *NSQD) addHTTPConsumer(channel *Channel, remoteAddr string, userAgent string, msgTimeout time.Duration) (*httpConsumer, error) {
+	h := newHTTPConsumer(&context{n}, channel, remoteAddr, userAgent, msgTimeout)
+	err := channel.AddClient(h.ID, h)
+	if err != nil {
+		return nil, err
+	}
+	n.httpConsumerLock.Lock()
+	n.httpConsumers[h.Session] = h
+	n.httpConsumerLock.Unlock()
+	return h, nil
+}
+
+// getHTTPConsumer returns the HTTP consumer session, acquired for a request
+func (n *NSQD) getHTTPConsumer(session string) (*httpConsumer, error) {
+	n.httpConsumerLock.RLock()
+	h, ok := n.httpConsumers[session]
+	n.httpConsumerLock.RUnlock()
+	if !ok || !h.acquire() {
+		return nil, errors.New("session does not exist")
+	}
+	return h, nil
+}
+
+// removeHTTPConsumer ends an HTTP consumer session, its in-flight messages
+// time out right away
+func (n *NSQD) removeHTTPConsumer(h *httpConsumer) {
+	n.httpConsumerLock.Lock()
+	_, ok := n.httpConsumers[h.Session]
+	delete(n.httpConsumers, h.Session)
+	n.httpConsumerLock.Unlock()
+	if !ok {
+		return
+	}
+	h.Close()
+	h.Channel.RemoveClient(h.ID)
+	h.Channel.timeoutClientMessages(h.ID)
+}
+
+// timeoutClientMessages makes the messages in flight to clientID due, so
+// that they time out on the next scan of the in-flight queue
+func (c *Channel) timeoutClientMessages(clientID int64) {
+	now := time.Now().UnixNano()
+	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		if msg.clientID != clientID || msg.index == -1 {
+			continue
+		}
+		c.inFlightPQ.Remove(msg.index)
+		msg.pri = now
+		c.inFlightPQ.Push(msg)
+	}
+	c.inFlightMutex.Unlock()
+}
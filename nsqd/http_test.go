@@ -5,9 +5,11 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"runtime"
 	"strconv"
@@ -61,6 +63,56 @@ func TestHTTPpub(t *testing.T) {
 	test.Equal(t, int64(1), topic.Depth())
 }
 
+func TestHTTPpubHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_headers" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	buf := bytes.NewBuffer([]byte("test message"))
+	url := fmt.Sprintf("http://%s/pub?topic=%s&header=content-type:text/plain&header=trace-id:abc",
+		httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, "OK", string(body))
+
+	msg := <-topic.memoryMsgChan
+	test.Equal(t, map[string]string{"content-type": "text/plain", "trace-id": "abc"}, msg.Headers)
+
+	buf = bytes.NewBuffer([]byte("test message"))
+	url = fmt.Sprintf("http://%s/pub?topic=%s&header=invalid", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+
+	// the headers count against the max message size
+	buf = bytes.NewBuffer(make([]byte, opts.MaxMsgSize-10))
+	url = fmt.Sprintf("http://%s/pub?topic=%s&header=trace-id:abc", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 413, resp.StatusCode)
+
+	// and are set on every message of a /mpub
+	buf = bytes.NewBuffer([]byte("one\ntwo\n"))
+	url = fmt.Sprintf("http://%s/mpub?topic=%s&header=trace-id:abc", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	for i := 0; i < 2; i++ {
+		msg = <-topic.memoryMsgChan
+		test.Equal(t, map[string]string{"trace-id": "abc"}, msg.Headers)
+	}
+}
+
 func TestHTTPpubEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -114,6 +166,129 @@ func TestHTTPmpub(t *testing.T) {
 	test.Equal(t, int64(4), topic.Depth())
 }
 
+func TestHTTPpubTopicAutoCreate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AutoCreateTopics = false
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_auto_create" + strconv.Itoa(int(time.Now().Unix()))
+	post := func(endpoint string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr, endpoint), "application/octet-stream",
+			bytes.NewBufferString("test message"))
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	test.Equal(t, 404, post("/pub?topic="+topicName))
+	test.Equal(t, 404, post("/mpub?topic="+topicName))
+	test.Equal(t, 404, post("/sub?channel=ch&wait=0&topic="+topicName))
+	_, err := nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+
+	test.Equal(t, 200, post("/topic/create?topic="+topicName))
+	test.Equal(t, 200, post("/pub?topic="+topicName))
+	test.Equal(t, int64(1), nsqd.GetTopic(topicName).Depth())
+
+	// the channels of an existing topic are still created implicitly
+	test.Equal(t, 200, post("/sub?channel=ch&wait=0&topic="+topicName))
+	_, err = nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	test.Nil(t, err)
+}
+
+func TestHTTPCreateRetention(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_create_retention" + strconv.Itoa(int(time.Now().Unix()))
+	post := func(endpoint string) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr, endpoint), "application/octet-stream", nil)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// an ephemeral topic with retention is rejected, without being created
+	test.Equal(t, 400, post("/topic/create?retention=1h&topic="+topicName+"%23ephemeral"))
+	_, err := nsqd.GetExistingTopic(topicName + "#ephemeral")
+	test.NotNil(t, err)
+
+	// since only applies to a new channel
+	test.Equal(t, 200, post("/topic/create?retention=1h&topic="+topicName))
+	test.Equal(t, 200, post("/channel/create?since=oldest&channel=ch&topic="+topicName))
+	test.Equal(t, 400, post("/channel/create?since=oldest&channel=ch&topic="+topicName))
+}
+
+func TestHTTPmpubStream(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxMsgSize = 100
+	opts.MaxBodySize = 4000
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_mpub_stream" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	type streamResponse struct {
+		Messages int `json:"messages"`
+		Batches  []struct {
+			Messages int    `json:"messages"`
+			Bytes    int64  `json:"bytes"`
+			Error    string `json:"error"`
+		} `json:"batches"`
+	}
+	// the body is chunked, and over --max-body-size
+	post := func(query string, lines []string) streamResponse {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, line := range lines {
+				io.WriteString(pw, line+"\n")
+			}
+			pw.Close()
+		}()
+		url := fmt.Sprintf("http://%s/mpub?topic=%s&stream=true%s", httpAddr, topicName, query)
+		resp, err := http.Post(url, "application/octet-stream", pr)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		var sr streamResponse
+		test.Nil(t, json.NewDecoder(resp.Body).Decode(&sr))
+		return sr
+	}
+
+	var lines []string
+	for i := 0; i < 2500; i++ {
+		lines = append(lines, fmt.Sprintf("%06d", i))
+	}
+	// batches of 666 messages (3996 bytes) bounded by --max-body-size
+	sr := post("&batch_size=1000", lines)
+	test.Equal(t, 2500, sr.Messages)
+	test.Equal(t, 4, len(sr.Batches))
+	test.Equal(t, 666, sr.Batches[0].Messages)
+	test.Equal(t, int64(3996), sr.Batches[0].Bytes)
+	test.Equal(t, 502, sr.Batches[3].Messages)
+
+	sr = post("&batch_size=2", []string{"a", "", "b", "c", strings.Repeat("x", 101), "d"})
+	test.Equal(t, 3, sr.Messages)
+	test.Equal(t, 3, len(sr.Batches))
+	test.Equal(t, 2, sr.Batches[0].Messages)
+	test.Equal(t, 1, sr.Batches[1].Messages)
+	test.Equal(t, "MSG_TOO_BIG", sr.Batches[2].Error)
+
+	for i := 0; i < 100 && topic.Depth() < 2503; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	test.Equal(t, int64(2503), topic.Depth())
+}
+
 func TestHTTPmpubEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -502,6 +677,349 @@ func TestHTTPV1TopicChannel(t *testing.T) {
 	test.NotNil(t, err)
 }
 
+func TestHTTPChannelCreateDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	nsqd.GetTopic(topicName)
+
+	em := ErrMessage{}
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_attempts=5&dead_letter_topic=%s",
+		httpAddr, topicName, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 400, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	err = json.Unmarshal(body, &em)
+	test.Nil(t, err)
+	test.Equal(t, "INVALID_DEAD_LETTER_TOPIC", em.Message)
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_attempts=5&dead_letter_topic=%s_dlq",
+		httpAddr, topicName, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	topic, _ := nsqd.GetExistingTopic(topicName)
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	maxAttempts, deadLetterTopic := channel.DeadLetter()
+	test.Equal(t, uint16(5), maxAttempts)
+	test.Equal(t, topicName+"_dlq", deadLetterTopic)
+
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	for _, mt := range m.Topics {
+		if mt.Name != topicName {
+			continue
+		}
+		test.Equal(t, uint16(5), mt.Channels[0].MaxAttempts)
+		test.Equal(t, topicName+"_dlq", mt.Channels[0].DeadLetterTopic)
+	}
+}
+
+func TestHTTPChannelPush(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PushAllowedHosts = []string{"127.0.0.1"}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// the first attempt of each message fails
+	var mu sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-NSQ-Attempts") == "1" {
+			w.WriteHeader(500)
+			return
+		}
+		received = append(received, string(body))
+	}))
+	defer ts.Close()
+
+	topicName := "test_http_push" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/channel/push/create?topic=%s&channel=ch&url=%s&backoff=10",
+		httpAddr, topicName, ts.URL)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test1")))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test2")))
+
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		channel.processDeferredQueue(time.Now().UnixNano())
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	test.Equal(t, []string{"test1", "test2"}, received)
+	mu.Unlock()
+
+	stats := nsqd.GetStats(topicName, "ch", true)
+	test.Equal(t, 1, len(stats[0].Channels[0].Clients))
+	client := stats[0].Channels[0].Clients[0]
+	test.Equal(t, ts.URL, client.ClientID)
+	test.Equal(t, uint64(2), client.FinishCount)
+	test.Equal(t, uint64(2), client.RequeueCount)
+
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	for _, mt := range m.Topics {
+		if mt.Name != topicName {
+			continue
+		}
+		test.Equal(t, 1, len(mt.Channels[0].PushSubscriptions))
+		test.Equal(t, ts.URL, mt.Channels[0].PushSubscriptions[0].URL)
+		test.Equal(t, 10*time.Millisecond, mt.Channels[0].PushSubscriptions[0].Backoff)
+	}
+
+	url = fmt.Sprintf("http://%s/channel/push/delete?topic=%s&channel=ch&url=%s",
+		httpAddr, topicName, ts.URL)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, 0, len(channel.PushSubscriptions()))
+
+	for _, query := range []string{
+		"url=ftp://127.0.0.1",
+		"url=http://169.254.169.254/latest/meta-data",
+		"url=" + ts.URL + "&concurrency=17",
+	} {
+		url = fmt.Sprintf("http://%s/channel/push/create?topic=%s&channel=ch&%s",
+			httpAddr, topicName, query)
+		resp, err = http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestPushConsumerClose(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PushAllowedHosts = []string{"127.0.0.1"}
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// the endpoint never answers
+	requested := make(chan struct{}, 1)
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	topicName := "test_push_close" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	test.Nil(t, channel.AddPushSubscription(PushConfig{
+		URL:         ts.URL,
+		Concurrency: 1,
+		Timeout:     time.Minute,
+		MaxBackoff:  time.Minute,
+	}))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	<-requested
+
+	// removing the subscription aborts the request and waits for its message
+	// to be back in the queue
+	test.Nil(t, channel.RemovePushSubscription(ts.URL))
+	channel.inFlightMutex.Lock()
+	test.Equal(t, 0, len(channel.inFlightMessages))
+	channel.inFlightMutex.Unlock()
+	test.Equal(t, int64(1), channel.Depth())
+}
+
+func TestHTTPConsumer(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HTTPConsumerSessionTimeout = 200 * time.Millisecond
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	type subResponse struct {
+		Session  string `json:"session"`
+		Messages []struct {
+			ID       string `json:"id"`
+			Body     []byte `json:"body"`
+			Attempts uint16 `json:"attempts"`
+		} `json:"messages"`
+	}
+	post := func(endpoint string, v interface{}) int {
+		resp, err := http.Post(fmt.Sprintf("http://%s%s", httpAddr, endpoint), "application/json", nil)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == 200 {
+			test.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	topicName := "test_http_consumer" + strconv.Itoa(int(time.Now().Unix()))
+
+	var sr subResponse
+	test.Equal(t, 200, post(fmt.Sprintf("/sub?topic=%s&channel=ch&wait=0", topicName), &sr))
+	test.Equal(t, 0, len(sr.Messages))
+	session := sr.Session
+
+	topic := nsqd.GetTopic(topicName)
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	for _, body := range []string{"test1", "test2", "test3"} {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body)))
+	}
+	for i := 0; i < 100 && channel.Depth() < 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	sr = subResponse{}
+	test.Equal(t, 200, post(fmt.Sprintf("/sub?session=%s&n=2", session), &sr))
+	test.Equal(t, 2, len(sr.Messages))
+	test.Equal(t, []byte("test1"), sr.Messages[0].Body)
+	test.Equal(t, []byte("test2"), sr.Messages[1].Body)
+
+	test.Equal(t, 200, post(fmt.Sprintf("/touch?session=%s&id=%s", session, sr.Messages[0].ID), nil))
+	test.Equal(t, 200, post(fmt.Sprintf("/fin?session=%s&id=%s", session, sr.Messages[0].ID), nil))
+	test.Equal(t, 400, post(fmt.Sprintf("/fin?session=%s&id=%s", session, sr.Messages[0].ID), nil))
+	test.Equal(t, 200, post(fmt.Sprintf("/req?session=%s&id=%s", session, sr.Messages[1].ID), nil))
+
+	sr = subResponse{}
+	test.Equal(t, 200, post(fmt.Sprintf("/sub?session=%s&n=5", session), &sr))
+	test.Equal(t, 2, len(sr.Messages))
+	test.Equal(t, uint16(2), sr.Messages[1].Attempts)
+
+	stats := nsqd.GetStats(topicName, "ch", true)
+	client := stats[0].Channels[0].Clients[0]
+	test.Equal(t, int64(2), client.InFlightCount)
+	test.Equal(t, uint64(1), client.FinishCount)
+	test.Equal(t, uint64(1), client.RequeueCount)
+
+	// the session expires, its in-flight messages time out
+	time.Sleep(400 * time.Millisecond)
+	test.Equal(t, 404, post(fmt.Sprintf("/fin?session=%s&id=%s", session, sr.Messages[0].ID), nil))
+	channel.processInFlightQueue(time.Now().UnixNano())
+	test.Equal(t, int64(2), channel.Depth())
+	test.Equal(t, 0, len(nsqd.GetStats(topicName, "ch", true)[0].Channels[0].Clients))
+
+	test.Equal(t, 400, post("/sub?topic=bad!topic&channel=ch", nil))
+}
+
+func TestHTTPAuth(t *testing.T) {
+	authFile, err := ioutil.TempFile("", "nsqd-auth")
+	test.Nil(t, err)
+	defer os.Remove(authFile.Name())
+	err = ioutil.WriteFile(authFile.Name(), []byte(`{"secrets": {
+		"publisher": {"ttl": 3600, "authorizations":
+			[{"topic": "test", "channels": [".*"], "permissions": ["publish"]}]},
+		"consumer": {"ttl": 3600, "authorizations":
+			[{"topic": "test", "channels": ["ch"], "permissions": ["subscribe"]}]},
+		"admin": {"ttl": 3600, "authorizations":
+			[{"topic": "test", "channels": ["ch"], "permissions": ["admin"]}]},
+		"root": {"ttl": 3600, "authorizations":
+			[{"topic": ".*", "channels": [".*"], "permissions": ["admin"]}]}
+	}}`), 0600)
+	test.Nil(t, err)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthFile = authFile.Name()
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	doBody := func(method string, endpoint string, secret string, body string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", httpAddr, endpoint),
+			strings.NewReader(body))
+		test.Nil(t, err)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	do := func(method string, endpoint string, secret string) int {
+		return doBody(method, endpoint, secret, "test")
+	}
+
+	test.Equal(t, 401, do("POST", "/pub?topic=test", ""))
+	test.Equal(t, 401, do("POST", "/pub?topic=test", "unknown"))
+	test.Equal(t, 403, do("POST", "/pub?topic=other", "publisher"))
+	test.Equal(t, 403, do("POST", "/pub?topic=test", "admin"))
+	test.Equal(t, 200, do("POST", "/pub?topic=test", "publisher"))
+	test.Equal(t, 200, do("POST", "/mpub?topic=test", "publisher"))
+
+	test.Equal(t, 403, do("POST", "/channel/create?topic=test&channel=ch", "publisher"))
+	test.Equal(t, 403, do("POST", "/channel/create?topic=test&channel=other", "admin"))
+	test.Equal(t, 200, do("POST", "/channel/create?topic=test&channel=ch", "admin"))
+	test.Equal(t, 200, do("POST", "/channel/empty?topic=test&channel=ch", "admin"))
+	test.Equal(t, 200, do("POST", "/topic/pause?topic=test", "admin"))
+	test.Equal(t, 403, do("POST", "/topic/delete?topic=other", "admin"))
+	test.Equal(t, 403, doBody("PUT", "/config/log_level", "admin", "info"))
+	test.Equal(t, 200, doBody("PUT", "/config/log_level", "root", "info"))
+
+	test.Equal(t, 403, do("POST", "/sub?topic=test&channel=other&wait=0", "consumer"))
+	test.Equal(t, 403, do("POST", "/sub?topic=test&channel=ch&wait=0", "publisher"))
+	test.Equal(t, 200, do("POST", "/sub?topic=test&channel=ch&wait=0", "consumer"))
+	nsqd.httpConsumerLock.RLock()
+	var session string
+	for id := range nsqd.httpConsumers {
+		session = id
+	}
+	nsqd.httpConsumerLock.RUnlock()
+	test.Equal(t, 401, do("POST", fmt.Sprintf("/cls?session=%s", session), ""))
+	test.Equal(t, 200, do("POST", fmt.Sprintf("/cls?session=%s", session), "consumer"))
+
+	// stats, metrics and profiles are admin endpoints of no topic in particular
+	for _, endpoint := range []string{"/stats", "/metrics", "/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/heap"} {
+		test.Equal(t, 401, do("GET", endpoint, ""))
+		test.Equal(t, 403, do("GET", endpoint, "admin"))
+		test.Equal(t, 200, do("GET", endpoint, "root"))
+	}
+	test.Equal(t, 200, do("GET", "/ping", ""))
+
+	// as sent by nsqadmin
+	client := http_api.NewClient(nil, time.Second, time.Second)
+	var stats struct{}
+	err = client.GETV1(fmt.Sprintf("http://%s/stats?format=json", httpAddr), &stats)
+	test.Equal(t, 401, err.(http_api.StatusErr).Code)
+	client.AuthSecret = "root"
+	err = client.GETV1(fmt.Sprintf("http://%s/stats?format=json", httpAddr), &stats)
+	test.Nil(t, err)
+}
+
 func TestHTTPClientStats(t *testing.T) {
 	topicName := "test_http_client_stats" + strconv.Itoa(int(time.Now().Unix()))
 
@@ -589,6 +1107,34 @@ func TestHTTPgetStatusText(t *testing.T) {
 	test.NotNil(t, body)
 }
 
+func TestHTTPmetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_metrics" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	topic.PutMessage(msg)
+
+	url := fmt.Sprintf("http://%s/metrics", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	metrics := string(body)
+	test.Equal(t, true, strings.Contains(metrics, "# TYPE nsq_topic_depth gauge\n"))
+	test.Equal(t, true, strings.Contains(metrics, fmt.Sprintf("nsq_topic_messages_total{topic=%q} 1\n", topicName)))
+	test.Equal(t, true, strings.Contains(metrics, fmt.Sprintf("nsq_channel_depth{topic=%q,channel=\"ch\"} 1\n", topicName)))
+	test.Equal(t, true, strings.Contains(metrics, "nsq_mem_heap_objects "))
+}
+
 func TestHTTPconfig(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -0,0 +1,215 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// what to do with topics and channels idle for longer than their idle timeout
+const (
+	idleActionDelete = "delete"
+	idleActionPause  = "pause"
+)
+
+// idleLoop periodically deletes (or pauses) the durable channels without
+// clients for ChannelIdleTimeout and the durable topics without channels nor
+// publishes for TopicIdleTimeout
+func (n *NSQD) idleLoop() {
+	ticker := time.NewTicker(n.getOpts().IdleCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+			n.checkIdle()
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "IDLE: closing")
+	ticker.Stop()
+}
+
+func (n *NSQD) checkIdle() {
+	opts := n.getOpts()
+	if opts.ChannelIdleTimeout <= 0 && opts.TopicIdleTimeout <= 0 {
+		return
+	}
+	pause := opts.IdleAction == idleActionPause
+	now := time.Now().UnixNano()
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	persist := false
+	for _, t := range topics {
+		if t.ephemeral || t.Exiting() {
+			continue
+		}
+
+		t.RLock()
+		channels := make([]*Channel, 0, len(t.channelMap))
+		for _, c := range t.channelMap {
+			channels = append(channels, c)
+		}
+		t.RUnlock()
+
+		if opts.ChannelIdleTimeout > 0 {
+			for _, c := range channels {
+				if c.ephemeral || c.Exiting() {
+					continue
+				}
+				c.RLock()
+				active := len(c.clients) > 0
+				c.RUnlock()
+				if pause && c.IsPaused() {
+					// nothing left to do until it is unpaused
+					active = true
+				}
+				name := "CHANNEL(" + t.name + ":" + c.name + ")"
+				if !n.idleExpired(name, &c.idleSince, active, now, opts.ChannelIdleTimeout) {
+					continue
+				}
+
+				atomic.StoreInt64(&c.idleSince, 0)
+				if pause {
+					n.logf(LOG_INFO, "%s: pausing, no clients for %s", name, opts.ChannelIdleTimeout)
+					c.Pause()
+					persist = true
+					continue
+				}
+				if t.deleteIdleChannel(c) {
+					n.logf(LOG_INFO, "%s: deleted, no clients for %s", name, opts.ChannelIdleTimeout)
+				}
+			}
+		}
+
+		if opts.TopicIdleTimeout > 0 {
+			messageCount := atomic.LoadUint64(&t.messageCount)
+			published := atomic.SwapUint64(&t.idleMessageCount, messageCount) != messageCount
+			t.RLock()
+			active := published || len(t.channelMap) > 0
+			t.RUnlock()
+			if pause && t.IsPaused() {
+				active = true
+			}
+			name := "TOPIC(" + t.name + ")"
+			if !n.idleExpired(name, &t.idleSince, active, now, opts.TopicIdleTimeout) {
+				continue
+			}
+
+			atomic.StoreInt64(&t.idleSince, 0)
+			if pause {
+				n.logf(LOG_INFO, "%s: pausing, no channels nor publishes for %s", name, opts.TopicIdleTimeout)
+				t.Pause()
+				persist = true
+				continue
+			}
+			if n.deleteIdleTopic(t, messageCount) {
+				n.logf(LOG_INFO, "%s: deleted, no channels nor publishes for %s", name, opts.TopicIdleTimeout)
+			}
+		}
+	}
+
+	if persist {
+		// pro-actively persist metadata so that the pauses survive a crash
+		n.Lock()
+		n.PersistMetadata()
+		n.Unlock()
+	}
+}
+
+// deleteIdleChannel is DeleteExistingChannel for a channel found without
+// clients, unless one was added since: its exitFlag is set under its lock, so
+// a SUB either added its client before or finds it exiting and retries
+func (t *Topic) deleteIdleChannel(c *Channel) bool {
+	t.Lock()
+	c.Lock()
+	idle := len(c.clients) == 0 && atomic.CompareAndSwapInt32(&c.exitFlag, 0, 1)
+	c.Unlock()
+	if idle {
+		delete(t.channelMap, c.name)
+	}
+	t.Unlock()
+	if !idle {
+		return false
+	}
+
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): deleting channel %s", t.name, c.name)
+	c.deleteExiting()
+
+	// update messagePump state
+	select {
+	case t.channelUpdateChan <- 1:
+	case <-t.exitChan:
+	}
+	return true
+}
+
+// deleteIdleTopic is DeleteExistingTopic for a topic found without channels
+// and with messageCount messages, unless a channel was added or a message
+// published since: its exitFlag is set under its lock, so a publish either
+// counted its message before or finds it exiting and retries
+func (n *NSQD) deleteIdleTopic(t *Topic, messageCount uint64) bool {
+	t.Lock()
+	idle := len(t.channelMap) == 0 && atomic.LoadUint64(&t.messageCount) == messageCount &&
+		atomic.CompareAndSwapInt32(&t.exitFlag, 0, 1)
+	t.Unlock()
+	if !idle {
+		return false
+	}
+
+	// removed from the map only once deleted, like DeleteExistingTopic
+	t.shutdown(true)
+
+	n.Lock()
+	if n.topicMap[t.name] == t {
+		delete(n.topicMap, t.name)
+	}
+	n.Unlock()
+	return true
+}
+
+// idleExpired tracks since when a topic or channel is idle in idleSince and
+// returns whether that was longer than timeout ago, warning once it enters
+// the IdleWarningPeriod
+func (n *NSQD) idleExpired(name string, idleSince *int64, active bool, now int64, timeout time.Duration) bool {
+	if active {
+		atomic.StoreInt64(idleSince, 0)
+		return false
+	}
+	since := atomic.LoadInt64(idleSince)
+	if since == 0 {
+		atomic.StoreInt64(idleSince, now)
+		return false
+	}
+
+	idle := time.Duration(now - since)
+	if idle >= timeout {
+		return true
+	}
+	opts := n.getOpts()
+	warnAfter := timeout - opts.IdleWarningPeriod
+	if idle >= warnAfter && idle-opts.IdleCheckInterval < warnAfter {
+		n.logf(LOG_WARN, "%s: idle for %s, will be %sd in %s",
+			name, idle.Truncate(time.Second), opts.IdleAction, (timeout - idle).Truncate(time.Second))
+	}
+	return false
+}
+
+// idleExpiresAt returns when a topic or channel idle since idleSince expires
+// (unix seconds), 0 unless it is within the IdleWarningPeriod of it
+func idleExpiresAt(opts *Options, idleSince int64, timeout time.Duration) int64 {
+	if idleSince == 0 || timeout <= 0 {
+		return 0
+	}
+	expires := time.Unix(0, idleSince).Add(timeout)
+	if time.Until(expires) > opts.IdleWarningPeriod {
+		return 0
+	}
+	return expires.Unix()
+}
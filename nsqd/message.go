@@ -3,8 +3,10 @@ package nsqd
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"time"
 )
 
@@ -13,6 +15,26 @@ const (
 	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
 )
 
+// message formats, on disk and on the wire
+const (
+	msgFormatV1 = 1 // Timestamp + Attempts + ID + Body
+	msgFormatV2 = 2 // magic + version + Timestamp + Attempts + ID + Headers + Body
+)
+
+// msgV2Magic starts every v2 message, a v1 message can never start with it
+// because that would be a negative Timestamp
+const msgV2Magic = 0xff
+
+// orderingKeyHeader is the message header holding the key that an ordered
+// channel delivers messages in order by
+const orderingKeyHeader = "ordering-key"
+
+const (
+	maxMsgHeaders      = 64
+	maxMsgHeaderKeyLen = 255
+	maxMsgHeaderValLen = 65535
+)
+
 type MessageID [MsgIDLength]byte
 //网络传输的消息包格式构成为：Timestamp(8byte) + Attempts(2byte) + MessageID(16byte) + MessageBody(N-byte)。
 type Message struct { //代表生产者或者消费者的一条消息，是nsq消息队列系统中最基本的元素
@@ -20,6 +42,7 @@ type Message struct { //代表生产者或者消费者的一条消息，是nsq
 	Body      []byte // 消息体
 	Timestamp int64 // 当前时间戳
 	Attempts  uint16 // 消息重复投递次数（一旦消息投递次数过多，客户端可针对性地做处理）
+	Headers   map[string]string // 消息头（content-type, trace id 等），非空时以 v2 格式编码
 
 	// for in-flight handling
 	deliveryTS time.Time // 投递消息的时间戳
@@ -37,10 +60,29 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// WriteTo writes the message in the v2 format if it has headers and in the
+// v1 format otherwise
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if len(m.Headers) > 0 {
+		return m.WriteToVersion(w, msgFormatV2)
+	}
+	return m.WriteToVersion(w, msgFormatV1)
+}
+
+// WriteToVersion writes the message in the given format, headers are dropped
+// from the v1 format
+func (m *Message) WriteToVersion(w io.Writer, version int) (int64, error) {
 	var buf [10]byte
 	var total int64
 
+	if version == msgFormatV2 {
+		n, err := w.Write([]byte{msgV2Magic, msgFormatV2})
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
 	binary.BigEndian.PutUint16(buf[8:10], uint16(m.Attempts))
 
@@ -56,6 +98,14 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if version == msgFormatV2 {
+		nn, err := writeMsgHeaders(w, m.Headers)
+		total += nn
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(m.Body)
 	total += int64(n)
 	if err != nil {
@@ -75,9 +125,21 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 //                        (uint16)
 //                         2-byte
 //                        attempts
+//
+// a v2 message starts with 0xff and the format version (2), and has its
+// headers (see readMsgHeaders) between the message ID and the body
 func decodeMessage(b []byte) (*Message, error) {
 	var msg Message
 
+	version := msgFormatV1
+	if len(b) >= 2 && b[0] == msgV2Magic {
+		if b[1] != msgFormatV2 {
+			return nil, fmt.Errorf("invalid message format version (%d)", b[1])
+		}
+		version = msgFormatV2
+		b = b[2:]
+	}
+
 	if len(b) < minValidMsgLength {
 		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
 	}
@@ -87,9 +149,108 @@ func decodeMessage(b []byte) (*Message, error) {
 	copy(msg.ID[:], b[10:10+MsgIDLength])
 	msg.Body = b[10+MsgIDLength:]
 
+	if version == msgFormatV2 {
+		headers, n, err := readMsgHeaders(msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		msg.Headers = headers
+		msg.Body = msg.Body[n:]
+	}
+
 	return &msg, nil
 }
 
+// writeMsgHeaders writes headers, sorted by key, as:
+//
+//   [2-byte count]([1-byte key len][key][2-byte value len][value])*
+func writeMsgHeaders(w io.Writer, headers map[string]string) (int64, error) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], uint16(len(keys)))
+	buf.Write(tmp[:])
+	for _, k := range keys {
+		v := headers[k]
+		buf.WriteByte(byte(len(k)))
+		buf.WriteString(k)
+		binary.BigEndian.PutUint16(tmp[:], uint16(len(v)))
+		buf.Write(tmp[:])
+		buf.WriteString(v)
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// readMsgHeaders parses headers written by writeMsgHeaders from the start of
+// b, returning them along with the number of bytes they took up
+func readMsgHeaders(b []byte) (map[string]string, int, error) {
+	if len(b) < 2 {
+		return nil, 0, errors.New("invalid message headers")
+	}
+	count := int(binary.BigEndian.Uint16(b[:2]))
+	if count > maxMsgHeaders {
+		return nil, 0, fmt.Errorf("too many message headers (%d)", count)
+	}
+	pos := 2
+	headers := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		if len(b) < pos+1 {
+			return nil, 0, errors.New("invalid message headers")
+		}
+		kl := int(b[pos])
+		pos++
+		if len(b) < pos+kl+2 {
+			return nil, 0, errors.New("invalid message headers")
+		}
+		k := string(b[pos : pos+kl])
+		pos += kl
+		vl := int(binary.BigEndian.Uint16(b[pos : pos+2]))
+		pos += 2
+		if len(b) < pos+vl {
+			return nil, 0, errors.New("invalid message headers")
+		}
+		headers[k] = string(b[pos : pos+vl])
+		pos += vl
+	}
+	return headers, pos, nil
+}
+
+// msgHeadersSize returns how many bytes headers add to an encoded message,
+// the v2 magic and version included, which count against the max message
+// size like the body
+func msgHeadersSize(headers map[string]string) int64 {
+	if len(headers) == 0 {
+		return 0
+	}
+	size := int64(2 + 2) // magic + version, header count
+	for k, v := range headers {
+		size += int64(1 + len(k) + 2 + len(v))
+	}
+	return size
+}
+
+// validateMsgHeaders checks that headers can be encoded
+func validateMsgHeaders(headers map[string]string) error {
+	if len(headers) > maxMsgHeaders {
+		return fmt.Errorf("too many headers %d > %d", len(headers), maxMsgHeaders)
+	}
+	for k, v := range headers {
+		if len(k) == 0 || len(k) > maxMsgHeaderKeyLen {
+			return fmt.Errorf("invalid header key %q", k)
+		}
+		if len(v) > maxMsgHeaderValLen {
+			return fmt.Errorf("header %q value too long %d > %d", k, len(v), maxMsgHeaderValLen)
+		}
+	}
+	return nil
+}
+
 func writeMessageToBackend(buf *bytes.Buffer, msg *Message, bq BackendQueue) error {
 	buf.Reset()
 	_, err := msg.WriteTo(buf)
@@ -0,0 +1,91 @@
+package nsqd
+
+import (
+	"sync"
+	"time"
+)
+
+// ageTracker counts the messages waiting in a channel's memory queue and
+// backend by the second they were published in, to report the oldest one.
+//
+// The messages left in the backend by a previous run are only counted, their
+// timestamps are learned as they are dequeued, starting from the oldest
+// timestamp persisted in the metadata.
+type ageTracker struct {
+	sync.Mutex
+
+	counts map[int64]int64 // publish time (unix seconds) => messages
+
+	untracked   int64 // messages queued before a restart
+	untrackedTs int64 // lower bound of their timestamps, 0 if unknown
+}
+
+func newAgeTracker() *ageTracker {
+	return &ageTracker{
+		counts: make(map[int64]int64),
+	}
+}
+
+func (a *ageTracker) add(ts int64) {
+	a.Lock()
+	a.counts[ts/int64(time.Second)]++
+	a.Unlock()
+}
+
+func (a *ageTracker) remove(ts int64) {
+	sec := ts / int64(time.Second)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if n, ok := a.counts[sec]; ok {
+		if n <= 1 {
+			delete(a.counts, sec)
+		} else {
+			a.counts[sec] = n - 1
+		}
+		return
+	}
+	if a.untracked > 0 {
+		a.untracked--
+		if ts > a.untrackedTs {
+			a.untrackedTs = ts
+		}
+	}
+}
+
+// restore counts the n messages found in the backend on startup, published
+// at or after ts
+func (a *ageTracker) restore(n int64, ts int64) {
+	a.Lock()
+	a.untracked = n
+	a.untrackedTs = ts
+	a.Unlock()
+}
+
+func (a *ageTracker) reset() {
+	a.Lock()
+	a.counts = make(map[int64]int64)
+	a.untracked = 0
+	a.untrackedTs = 0
+	a.Unlock()
+}
+
+// Oldest returns the timestamp (truncated to the second) of the oldest
+// message waiting, or 0 if there are none (or it is not known)
+func (a *ageTracker) Oldest() int64 {
+	a.Lock()
+	defer a.Unlock()
+
+	var oldest int64
+	for sec := range a.counts {
+		if oldest == 0 || sec < oldest {
+			oldest = sec
+		}
+	}
+	oldest *= int64(time.Second)
+	if a.untracked > 0 && a.untrackedTs > 0 && (oldest == 0 || a.untrackedTs < oldest) {
+		oldest = a.untrackedTs
+	}
+	return oldest
+}
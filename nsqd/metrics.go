@@ -0,0 +1,90 @@
+package nsqd
+
+import (
+	"nsq/internal/prometheus"
+)
+
+// writeMetrics adds the stats of nsqd (as in /stats) to e, with the topic and
+// channel names as labels
+func (n *NSQD) writeMetrics(e *prometheus.Encoder) {
+	stats := n.GetStats("", "", false)
+	producerStats := n.GetProducerStats()
+
+	e.Gauge("healthy", "Whether nsqd is healthy.", prometheus.Bool(n.IsHealthy()))
+	e.Gauge("start_time_seconds", "Start time of nsqd since unix epoch in seconds.", float64(n.GetStartTime().Unix()))
+	e.Gauge("producers", "Number of connected producers.", float64(len(producerStats)))
+	e.Gauge("topics", "Number of topics.", float64(len(stats)))
+
+	for _, t := range stats {
+		topic := prometheus.Label{Name: "topic", Value: t.TopicName}
+
+		e.Gauge("topic_depth", "Number of messages queued in the topic.", float64(t.Depth), topic)
+		e.Gauge("topic_backend_depth", "Number of messages queued on disk in the topic.", float64(t.BackendDepth), topic)
+		e.Gauge("topic_depth_bytes", "Bytes of the message bodies queued in the topic.", float64(t.DepthBytes), topic)
+		e.Gauge("topic_paused", "Whether the topic is paused.", prometheus.Bool(t.Paused), topic)
+		e.Gauge("topic_channels", "Number of channels of the topic.", float64(len(t.Channels)), topic)
+		e.Counter("topic_messages_total", "Messages published to the topic.", float64(t.MessageCount), topic)
+		e.Counter("topic_message_bytes_total", "Bytes of the messages published to the topic.", float64(t.MessageBytes), topic)
+		e.Counter("topic_dedupe_hits_total", "Publishes to the topic dropped as duplicates.", float64(t.DedupeHitCount), topic)
+		e.Counter("topic_quota_rejected_total", "Messages rejected as over the topic quota.", float64(t.QuotaRejectedCount), topic)
+		e.Counter("topic_quota_dropped_total", "Messages dropped as over the topic quota.", float64(t.QuotaDroppedCount), topic)
+		if t.E2eProcessingLatency != nil {
+			e.Summary("topic_e2e_processing_latency_seconds", "End to end processing latency of the topic's channels.",
+				prometheus.LatencyQuantiles(t.E2eProcessingLatency.Percentiles), uint64(t.E2eProcessingLatency.Count), topic)
+		}
+
+		for _, c := range t.Channels {
+			channel := prometheus.Label{Name: "channel", Value: c.ChannelName}
+
+			e.Gauge("channel_depth", "Number of messages queued in the channel.", float64(c.Depth), topic, channel)
+			e.Gauge("channel_backend_depth", "Number of messages queued on disk in the channel.", float64(c.BackendDepth), topic, channel)
+			e.Gauge("channel_depth_bytes", "Bytes of the message bodies queued in the channel.", float64(c.DepthBytes), topic, channel)
+			e.Gauge("channel_in_flight", "Number of messages in flight in the channel.", float64(c.InFlightCount), topic, channel)
+			e.Gauge("channel_deferred", "Number of deferred messages in the channel.", float64(c.DeferredCount), topic, channel)
+			e.Gauge("channel_clients", "Number of clients subscribed to the channel.", float64(c.ClientCount), topic, channel)
+			e.Gauge("channel_paused", "Whether the channel is paused.", prometheus.Bool(c.Paused), topic, channel)
+			e.Gauge("channel_oldest_message_age_seconds", "Age of the oldest message queued in the channel.",
+				c.OldestMessageAge.Seconds(), topic, channel)
+			e.Counter("channel_messages_total", "Messages queued to the channel.", float64(c.MessageCount), topic, channel)
+			e.Counter("channel_requeued_total", "Messages requeued in the channel.", float64(c.RequeueCount), topic, channel)
+			e.Counter("channel_timed_out_total", "Messages timed out in the channel.", float64(c.TimeoutCount), topic, channel)
+			e.Counter("channel_dead_lettered_total", "Messages moved to the channel's dead letter topic.", float64(c.DeadLetterCount), topic, channel)
+			e.Counter("channel_filtered_total", "Messages skipped by the channel filter.", float64(c.FilteredCount), topic, channel)
+			e.Counter("channel_quota_dropped_total", "Messages dropped as over the channel quota.", float64(c.QuotaDroppedCount), topic, channel)
+			if c.E2eProcessingLatency != nil {
+				e.Summary("channel_e2e_processing_latency_seconds", "End to end processing latency of the channel.",
+					prometheus.LatencyQuantiles(c.E2eProcessingLatency.Percentiles), uint64(c.E2eProcessingLatency.Count), topic, channel)
+			}
+		}
+	}
+
+	ms := getMemStats()
+	e.Gauge("mem_heap_objects", "Number of allocated heap objects.", float64(ms.HeapObjects))
+	e.Gauge("mem_heap_idle_bytes", "Heap bytes waiting to be used.", float64(ms.HeapIdleBytes))
+	e.Gauge("mem_heap_in_use_bytes", "Heap bytes in use.", float64(ms.HeapInUseBytes))
+	e.Gauge("mem_heap_released_bytes", "Heap bytes released to the OS.", float64(ms.HeapReleasedBytes))
+	e.Gauge("mem_next_gc_bytes", "Heap size of the next garbage collection.", float64(ms.NextGCBytes))
+	e.Counter("mem_gc_runs_total", "Number of completed garbage collections.", float64(ms.GCTotalRuns))
+	e.Summary("mem_gc_pause_seconds", "Recent garbage collection pauses.", []prometheus.Quantile{
+		{Quantile: 0.95, Value: float64(ms.GCPauseUsec95) / 1e6},
+		{Quantile: 0.99, Value: float64(ms.GCPauseUsec99) / 1e6},
+		{Quantile: 1, Value: float64(ms.GCPauseUsec100) / 1e6},
+	}, uint64(ms.GCTotalRuns))
+
+	disk := n.getDiskStats()
+	if disk.SoftLimit > 0 || disk.HardLimit > 0 {
+		e.Gauge("disk_free_bytes", "Free bytes on the data path volume.", float64(disk.FreeBytes))
+		e.Gauge("disk_full", "Whether publishes are rejected for lack of disk space.", prometheus.Bool(disk.Status == "full"))
+	}
+
+	if authStats := n.getAuthStats(); authStats != nil {
+		e.Counter("auth_queries_total", "Queries of the auth servers.", float64(authStats.Queries))
+		e.Counter("auth_errors_total", "Queries of the auth servers not answered with an auth state.", float64(authStats.Errors))
+		e.Counter("auth_cache_hits_total", "Auth states answered from the cache.", float64(authStats.CacheHits))
+		e.Counter("auth_stale_hits_total", "Expired auth states used while no auth server could be reached.", float64(authStats.StaleHits))
+		if authStats.Latency != nil {
+			e.Summary("auth_query_latency_seconds", "Latency of the queries of the auth servers.",
+				prometheus.LatencyQuantiles(authStats.Latency.Percentiles), uint64(authStats.Latency.Count))
+		}
+	}
+}
@@ -12,11 +12,13 @@ import (
 	"net"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"nsq/internal/auth"
 	"nsq/internal/clusterinfo"
 	"nsq/internal/dirlock"
 	"nsq/internal/http_api"
@@ -44,6 +46,8 @@ type Client interface {
 type NSQD struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	clientIDSequence int64 // nsqd 借助其为订阅的client生成 ID
+	diskFree         int64 // DataPath 所在磁盘最近一次检查到的剩余空间
+	diskStatus       int32 // diskOK, diskLow 或 diskFull
 
 	sync.RWMutex //此处组合了锁，在读写和创建topic的时候，用到其方法RLock和RUnlock
 
@@ -52,6 +56,7 @@ type NSQD struct {
 	dl        *dirlock.DirLock //这个文件锁貌似只在linux中用到。
 	isLoading int32            //nsqd 当前是否处于启动加载过程。这个也用于原子操作，但是他是基本类型，不需要再被atomic.Value包一下。
 	errValue  atomic.Value     // 表示健康状况的错误值
+	authFile  atomic.Value     // *auth.File loaded from --auth-file, reloaded on SIGHUP
 	startTime time.Time        //记录这个实例生成的时间
 	//一个nsqd实例可以有多个Topic,使用sync.RWMutex加锁
 	topicMap map[string]*Topic //一个NSQD中对应多个Topic集合，string表示的是Topic名称。
@@ -59,6 +64,9 @@ type NSQD struct {
 	clientLock sync.RWMutex
 	clients    map[int64]Client //标识符id对应的client，来一个client就存储一下。存的是订阅了此nsqd所维护的topic的客户端实体
 
+	httpConsumerLock sync.RWMutex
+	httpConsumers    map[string]*httpConsumer // HTTP consumer sessions (/sub) by Session
+
 	lookupPeers atomic.Value //需要并发保护的变量，// nsqjd与nsqlookupd之间网络连接抽象实体
 
 	tcpListener   net.Listener //同样，一个NSQD实例有3个这种服务
@@ -74,6 +82,13 @@ type NSQD struct {
 	waitGroup            util.WaitGroupWrapper // 等待goroutine退出
 
 	ci *clusterinfo.ClusterInfo
+
+	jwt *auth.JWTVerifier // validates JWT AUTH secrets, nil if not configured
+
+	authCache   *auth.Cache // auth server responses
+	authMetrics *authMetrics
+
+	autoCreateTopicPatterns []*regexp.Regexp // compiled --auto-create-topic-pattern
 }
 
 func New(opts *Options) (*NSQD, error) {
@@ -97,6 +112,7 @@ func New(opts *Options) (*NSQD, error) {
 		startTime:            time.Now(),
 		topicMap:             make(map[string]*Topic), //make和new的功能相似都是分配空间，但是make只能用在slice/map/chan上
 		clients:              make(map[int64]Client),  //标识符id对应的client，来一个client就存储一下。存的是订阅了此nsqd所维护的topic的客户端实体
+		httpConsumers:        make(map[string]*httpConsumer),
 		exitChan:             make(chan int),
 		notifyChan:           make(chan interface{}),
 		optsNotificationChan: make(chan struct{}, 1),
@@ -132,7 +148,12 @@ func New(opts *Options) (*NSQD, error) {
 		}
 		statsdHostKey := statsd.HostKey(net.JoinHostPort(opts.BroadcastAddress, port))
 		prefixWithHost := strings.Replace(opts.StatsdPrefix, "%s", statsdHostKey, -1)
-		if prefixWithHost[len(prefixWithHost)-1] != '.' {
+		if opts.StatsdTags {
+			// the host is sent as a tag rather than in the prefix
+			prefixWithHost = strings.Replace(opts.StatsdPrefix, "%s", "", -1)
+			prefixWithHost = strings.Trim(strings.Replace(prefixWithHost, "..", ".", -1), ".")
+		}
+		if prefixWithHost != "" && prefixWithHost[len(prefixWithHost)-1] != '.' {
 			prefixWithHost += "."
 		}
 		opts.StatsdPrefix = prefixWithHost
@@ -152,6 +173,43 @@ func New(opts *Options) (*NSQD, error) {
 	}
 	n.tlsConfig = tlsConfig
 
+	if opts.AuthFile != "" {
+		authFile, err := auth.LoadFile(opts.AuthFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load --auth-file - %s", err)
+		}
+		n.authFile.Store(authFile)
+	}
+	n.authCache = auth.NewCache(opts.AuthStaleTTL)
+	n.authMetrics = newAuthMetrics(opts)
+	if opts.AuthJWTHMACKeyFile != "" || len(opts.AuthJWTPublicKeyFiles) != 0 {
+		n.jwt, err = auth.NewJWTVerifier(opts.AuthJWTHMACKeyFile, opts.AuthJWTPublicKeyFiles,
+			opts.AuthJWTIssuer, opts.AuthJWTAudience)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT keys - %s", err)
+		}
+	}
+
+	for _, pattern := range opts.AutoCreateTopicPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --auto-create-topic-pattern %q - %s", pattern, err)
+		}
+		n.autoCreateTopicPatterns = append(n.autoCreateTopicPatterns, re)
+	}
+
+	if opts.DiskCheckInterval <= 0 {
+		return nil, fmt.Errorf("invalid --disk-check-interval %s (must be > 0)", opts.DiskCheckInterval)
+	}
+
+	if opts.IdleCheckInterval <= 0 {
+		return nil, fmt.Errorf("invalid --idle-check-interval %s (must be > 0)", opts.IdleCheckInterval)
+	}
+
+	if opts.IdleAction != idleActionDelete && opts.IdleAction != idleActionPause {
+		return nil, fmt.Errorf("invalid --idle-action %q (must be %s or %s)", opts.IdleAction, idleActionDelete, idleActionPause)
+	}
+
 	for _, v := range opts.E2EProcessingLatencyPercentiles {
 		if v <= 0 || v > 1 {
 			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
@@ -279,6 +337,12 @@ func (n *NSQD) Main() error {
 
 	n.waitGroup.Wrap(n.queueScanLoop) //用于进行msg重试，作用对象是inflight队列和deferred队列。保证消息“至少投递一次” 是由这个goroutine中的queueScanWorker不断的扫描 InFlightQueue 实现的。
 	//in-flight和deffered queue的。在具体的算法上的话参考了redis的随机过期算法。
+	n.waitGroup.Wrap(n.diskSpaceLoop)
+	n.waitGroup.Wrap(n.retentionLoop)
+	n.waitGroup.Wrap(n.deferredSyncLoop)
+	if n.getOpts().ChannelIdleTimeout > 0 || n.getOpts().TopicIdleTimeout > 0 {
+		n.waitGroup.Wrap(n.idleLoop)
+	}
 	n.waitGroup.Wrap(n.lookupLoop)       //处理与nsqlookupd进程的交互。和lookupd建立长连接，每隔15s ping一下lookupd，新增或者删除topic的时候通知到lookupd，新增或者删除channel的时候通知到lookupd，动态的更新options
 	if n.getOpts().StatsdAddress != "" { //如果配置了获取nsqd状态统计的接收地址，才会打开这个统计协程。
 		n.waitGroup.Wrap(n.statsdLoop) //还有状态统计处理 go routine
@@ -290,11 +354,24 @@ func (n *NSQD) Main() error {
 
 type meta struct {
 	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
-		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
+		Name           string        `json:"name"`
+		Paused         bool          `json:"paused"`
+		RetentionTime  time.Duration `json:"retention_time,omitempty"`
+		RetentionBytes int64         `json:"retention_bytes,omitempty"`
+		Config         QueueConfig   `json:"config"`
+		DepthBytes     int64         `json:"depth_bytes,omitempty"`
+		Channels       []struct {
+			Name            string      `json:"name"`
+			Paused          bool        `json:"paused"`
+			MaxAttempts     uint16      `json:"max_attempts,omitempty"`
+			DeadLetterTopic string      `json:"dead_letter_topic,omitempty"`
+			Filter          string      `json:"filter,omitempty"`
+			Ordered         bool        `json:"ordered,omitempty"`
+			Config          QueueConfig `json:"config"`
+			OldestTimestamp int64       `json:"oldest_timestamp,omitempty"`
+			DepthBytes      int64       `json:"depth_bytes,omitempty"`
+
+			PushSubscriptions []PushConfig `json:"push_subscriptions,omitempty"`
 		} `json:"channels"`
 	} `json:"topics"`
 }
@@ -357,19 +434,47 @@ func (n *NSQD) LoadMetadata() error {
 			continue
 		}
 		//根据topic或channel的名称获取对应的实例的方法为nsqd.GetTopic和topic.GetChannel方法
-		topic := n.GetTopic(t.Name) //获取指向该topic对象的指针(nsqd/topic.go中Topic struct),如果topic不存在，会自动创建一个
-		if t.Paused {               //topic暂停使用，标注到topic对象中
+		topic := n.getTopic(t.Name, t.Config) //获取指向该topic对象的指针(nsqd/topic.go中Topic struct),如果topic不存在，会自动创建一个
+		if t.Paused {                         //topic暂停使用，标注到topic对象中
 			topic.Pause() //nolint设置paused属性，对于topic而言，若paused属性被设置，则它不会将由生产者发布的消息写入到关联的channel的消息队列。
 		}
+		topic.SetRetention(t.RetentionTime, t.RetentionBytes)
+		topic.restoreDepthBytes(t.DepthBytes)
 		for _, c := range t.Channels {
 			if !protocol.IsValidChannelName(c.Name) {
 				n.logf(LOG_WARN, "skipping creation of invalid channel %s", c.Name)
 				continue
 			}
-			channel := topic.GetChannel(c.Name) //获取与该topic关联的channel列表
+			channel, _ := topic.getChannel(c.Name, c.Config, nil) //获取与该topic关联的channel列表
 			if c.Paused {
 				channel.Pause() //nolint设置paused属性，对channel而言，若其paused属性被设置，则那些订阅了此channel的客户端不会被推送消息（这点在后面的源码中可以验证）
 			}
+			if c.MaxAttempts > 0 {
+				channel.SetDeadLetter(c.MaxAttempts, c.DeadLetterTopic)
+			}
+			if c.Filter != "" {
+				filter, err := parseMsgFilter(c.Filter)
+				if err != nil {
+					n.logf(LOG_WARN, "ignoring invalid filter %q of channel %s - %s", c.Filter, c.Name, err)
+				} else {
+					channel.SetFilter(filter)
+				}
+			}
+			if c.Ordered {
+				channel.SetOrdered(true)
+			}
+			channel.restoreOldest(c.OldestTimestamp)
+			channel.restoreDepthBytes(c.DepthBytes)
+			channel.loadDeferred()
+			for _, cfg := range c.PushSubscriptions {
+				err := cfg.validate(n.getOpts())
+				if err == nil {
+					err = channel.AddPushSubscription(cfg)
+				}
+				if err != nil {
+					n.logf(LOG_WARN, "skipping push subscription of channel %s to %s - %s", c.Name, cfg.URL, err)
+				}
+			}
 		}
 		topic.Start() //最后调用topic.Start方法向topic.startChan通道中压入一条消息，消息会在topic.messagePump方法中被取出，以表明topic可以开始进入消息队列处理的主循环。
 	}
@@ -395,6 +500,16 @@ func (n *NSQD) PersistMetadata() error { //是加载元数据的逆操作
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
 		topicData["paused"] = topic.IsPaused()
+		if retentionTime, retentionBytes := topic.Retention(); retentionTime > 0 || retentionBytes > 0 {
+			topicData["retention_time"] = retentionTime
+			topicData["retention_bytes"] = retentionBytes
+		}
+		if config := topic.Config(); config != (QueueConfig{}) {
+			topicData["config"] = config
+		}
+		if depthBytes := topic.DepthBytes(); depthBytes > 0 {
+			topicData["depth_bytes"] = depthBytes
+		}
 		channels := []interface{}{}
 		topic.Lock()
 		for _, channel := range topic.channelMap {
@@ -406,6 +521,28 @@ func (n *NSQD) PersistMetadata() error { //是加载元数据的逆操作
 			channelData := make(map[string]interface{})
 			channelData["name"] = channel.name
 			channelData["paused"] = channel.IsPaused()
+			if channel.maxAttempts > 0 {
+				channelData["max_attempts"] = channel.maxAttempts
+				channelData["dead_letter_topic"] = channel.deadLetterTopic
+			}
+			if channel.filter != nil {
+				channelData["filter"] = channel.filter.String()
+			}
+			if channel.Ordered() {
+				channelData["ordered"] = true
+			}
+			if config := channel.Config(); config != (QueueConfig{}) {
+				channelData["config"] = config
+			}
+			if oldest := channel.oldestPendingTimestamp(); oldest > 0 {
+				channelData["oldest_timestamp"] = oldest
+			}
+			if depthBytes := channel.pendingDepthBytes(); depthBytes > 0 {
+				channelData["depth_bytes"] = depthBytes
+			}
+			if subs := channel.PushSubscriptions(); len(subs) > 0 {
+				channelData["push_subscriptions"] = subs
+			}
 			channels = append(channels, channelData)
 			channel.Unlock()
 		}
@@ -449,6 +586,22 @@ func (n *NSQD) Exit() {
 		n.httpsListener.Close()
 	}
 
+	// stop the push subscriptions before closing the topics under the lock,
+	// they may need it to dead-letter a message
+	var channels []*Channel
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			channels = append(channels, channel)
+		}
+		topic.RUnlock()
+	}
+	n.RUnlock()
+	for _, channel := range channels {
+		channel.closePushConsumers()
+	}
+
 	n.Lock()
 	err := n.PersistMetadata() //将元数据写入本地磁盘
 	if err != nil {
@@ -471,6 +624,11 @@ func (n *NSQD) Exit() {
 // to return a pointer to a Topic object (potentially new)
 //根据名称获取topic实例，函数会先简单获取一把读锁看topic是否已经存在，如果已经存在直接返回，如果不存在就到后面的创建，初始化流程。
 func (n *NSQD) GetTopic(topicName string) *Topic {
+	return n.getTopic(topicName, QueueConfig{})
+}
+
+// getTopic is GetTopic with the config overrides of a new topic
+func (n *NSQD) getTopic(topicName string, config QueueConfig) *Topic {
 	// most likely, we already have this topic, so try read lock first.
 	n.RLock() //先用读锁锁着确保topicMap中的内容不被改变，看一下有没有。读锁占用的情况下会阻止写，不会阻止读，多个 goroutine 可以同时获取读锁。
 	t, ok := n.topicMap[topicName]
@@ -493,7 +651,7 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 	}
 	//创建一个topic结构，并且里面初始化好diskqueue, 加入到NSQD的topicmap里面
 	//创建topic的时候，会开启消息协程。这个里面会创建topic的messagePump协程接受消息，还会通知lookup加入新的topic，。
-	t = NewTopic(topicName, &context{n}, deleteCallback)
+	t = NewTopic(topicName, config, &context{n}, deleteCallback)
 	n.topicMap[topicName] = t
 
 	n.Unlock()
@@ -552,6 +710,80 @@ func (n *NSQD) GetExistingTopic(topicName string) (*Topic, error) {
 	return topic, nil
 }
 
+var errTopicNotFound = errors.New("topic does not exist")
+
+// getImplicitTopic is GetTopic for the publishes, subscriptions and HTTP calls
+// using a topic, it is only created if the auto-creation policy allows it
+func (n *NSQD) getImplicitTopic(topicName string) (*Topic, error) {
+	if n.canAutoCreateTopic(topicName) {
+		return n.GetTopic(topicName), nil
+	}
+	topic, err := n.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, errTopicNotFound
+	}
+	return topic, nil
+}
+
+// putMessages publishes msgs to topic, with PutMessageDedupe for a single
+// message. A topic deleted since it was resolved (e.g. for being idle) is
+// resolved again and the messages published to the topic that replaces it,
+// which is returned, rather than failing as exiting.
+func (n *NSQD) putMessages(topic *Topic, msgs []*Message, dedupeKey string) (*Topic, error) {
+	for {
+		var err error
+		if len(msgs) == 1 {
+			_, err = topic.PutMessageDedupe(msgs[0], dedupeKey)
+		} else {
+			_, err = topic.PutMessagesDedupe(msgs, dedupeKey)
+		}
+		if err != errExiting || !n.retryExiting() {
+			return topic, err
+		}
+		topic, err = n.getImplicitTopic(topic.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			m.ID = topic.GenerateID()
+		}
+	}
+}
+
+// retryExiting waits before retrying with a topic or channel found exiting,
+// until it is replaced once deleted. It returns false when nsqd is exiting,
+// the topics and channels closed then are never replaced.
+func (n *NSQD) retryExiting() bool {
+	select {
+	case <-n.exitChan:
+		return false
+	case <-time.After(time.Millisecond):
+		return true
+	}
+}
+
+func (n *NSQD) canAutoCreateTopic(topicName string) bool {
+	if n.getOpts().AutoCreateTopics {
+		return true
+	}
+	for _, re := range n.autoCreateTopicPatterns {
+		if re.MatchString(topicName) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicMaxMsgSize returns the MaxMsgSize in effect for topicName, without
+// creating the topic
+func (n *NSQD) topicMaxMsgSize(topicName string) int64 {
+	topic, err := n.GetExistingTopic(topicName)
+	if err != nil {
+		return n.getOpts().MaxMsgSize
+	}
+	return topic.config.maxMsgSize()
+}
+
 // DeleteExistingTopic removes a topic only if it exists
 func (n *NSQD) DeleteExistingTopic(topicName string) error {
 	n.RLock()
@@ -821,5 +1053,50 @@ func buildTLSConfig(opts *Options) (*tls.Config, error) {
 }
 
 func (n *NSQD) IsAuthEnabled() bool {
-	return len(n.getOpts().AuthHTTPAddresses) != 0
+	return len(n.getOpts().AuthHTTPAddresses) != 0 || n.getOpts().AuthFile != "" || n.jwt != nil
+}
+
+// getAuthFile returns the authorizations of --auth-file, nil if not set
+func (n *NSQD) getAuthFile() *auth.File {
+	authFile, _ := n.authFile.Load().(*auth.File)
+	return authFile
+}
+
+// queryAuth returns the auth state of a secret and/or TLS client certificate
+// common name: JWTs are validated locally, others looked up in --auth-file
+// before querying authd
+func (n *NSQD) queryAuth(remoteIP string, tlsEnabled bool, commonName string, secret string) (*auth.State, error) {
+	if n.jwt != nil && auth.IsJWT(secret) {
+		return n.jwt.Verify(secret)
+	}
+
+	opts := n.getOpts()
+	if authFile := n.getAuthFile(); authFile != nil {
+		if authState, ok := authFile.Lookup(tlsEnabled, commonName, secret); ok {
+			return authState, nil
+		}
+		if len(opts.AuthHTTPAddresses) == 0 {
+			return nil, errors.New("no authorizations in auth file")
+		}
+	}
+
+	return n.queryAuthd(remoteIP, tlsEnabled, commonName, secret)
+}
+
+// ReloadAuthFile reloads --auth-file, keeping the authorizations previously
+// loaded if it is invalid. Clients authenticated before keep their
+// authorizations until their TTL expires.
+func (n *NSQD) ReloadAuthFile() error {
+	path := n.getOpts().AuthFile
+	if path == "" {
+		return nil
+	}
+	authFile, err := auth.LoadFile(path)
+	if err != nil {
+		n.logf(LOG_ERROR, "failed to reload auth file %s - %s", path, err)
+		return err
+	}
+	n.authFile.Store(authFile)
+	n.logf(LOG_INFO, "reloaded auth file %s", path)
+	return nil
 }
@@ -240,6 +240,132 @@ func TestPauseMetadata(t *testing.T) {
 	test.Equal(t, false, isPaused(nsqd, 0, 0))
 }
 
+func TestDeferredMetadata(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "deferred_metadata" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	nsqd.PersistMetadata()
+
+	msg := NewMessage(topic.GenerateID(), []byte("later"))
+	err := channel.StartDeferredTimeout(msg, time.Hour)
+	test.Nil(t, err)
+	due := channel.deferredPQ[0].Priority
+
+	nsqd.Exit()
+
+	// start up a new nsqd w/ the same folder
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	err = nsqd.LoadMetadata()
+	test.Nil(t, err)
+
+	topic, err = nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	// the message is still deferred until its original due time
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, 1, len(channel.deferredMessages))
+	test.Equal(t, due, channel.deferredPQ[0].Priority)
+	test.Equal(t, msg.Body, channel.deferredPQ[0].Value.(*Message).Body)
+}
+
+func TestConfigMetadata(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "config_metadata" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	endpoint := fmt.Sprintf("http://%s/topic/config?topic=%s&mem_queue_size=5&msg_timeout=30s&max_msg_size=2048",
+		httpAddr, topicName)
+	err := http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	test.Nil(t, err)
+	endpoint = fmt.Sprintf("http://%s/channel/config?topic=%s&channel=ch&max_channel_consumers=1&msg_timeout=",
+		httpAddr, topicName)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	test.Nil(t, err)
+	endpoint = fmt.Sprintf("http://%s/channel/config?topic=%s&channel=ch&max_msg_size=1",
+		httpAddr, topicName)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).POSTV1(endpoint)
+	test.NotNil(t, err)
+
+	nsqd.Exit()
+
+	// start up a new nsqd w/ the same folder
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	err = nsqd.LoadMetadata()
+	test.Nil(t, err)
+
+	topic, err = nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	test.Equal(t, int64(2048), *topic.Config().MaxMsgSize)
+	test.Equal(t, int64(2048), nsqd.topicMaxMsgSize(topicName))
+	test.Equal(t, opts.MaxMsgSize, nsqd.topicMaxMsgSize("other"))
+	test.Equal(t, 5, cap(topic.memoryMsgChan))
+
+	// the channel inherits what it does not override
+	test.Equal(t, 5, cap(channel.memoryMsgChan))
+	test.Equal(t, 30*time.Second, channel.MsgTimeout())
+	test.Equal(t, 1, channel.MaxChannelConsumers())
+	test.Equal(t, int64(1), *channel.Config().MaxChannelConsumers)
+	test.Nil(t, channel.Config().MsgTimeout)
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, int64(5), *stats[0].Config.MemQueueSize)
+	test.Equal(t, int64(1), *stats[0].Channels[0].Config.MaxChannelConsumers)
+}
+
+func TestQuotaMetadata(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "quota_metadata" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	maxBytes := int64(8)
+	topic.SetConfig(QueueConfig{MaxBytes: &maxBytes})
+	topic.Pause()
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Nil(t, channel.PutMessage(NewMessage(topic.GenerateID(), []byte("queued"))))
+	msg := NewMessage(topic.GenerateID(), []byte("in-flight"))
+	test.Nil(t, channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout))
+
+	nsqd.Exit()
+
+	// start up a new nsqd w/ the same folder
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	err := nsqd.LoadMetadata()
+	test.Nil(t, err)
+
+	topic, err = nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel, err = topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	// the messages left in the backends still count towards the quotas
+	test.Equal(t, int64(8), topic.DepthBytes())
+	test.Equal(t, int64(15), channel.DepthBytes())
+	test.Equal(t, errQuotaExceeded, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+}
+
 func mustStartNSQLookupd(opts *nsqlookupd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqlookupd.NSQLookupd) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
@@ -278,6 +404,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts := NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.NSQLookupdTCPAddresses = []string{lookupd1.RealTCPAddr().String()}
 	nsqd.swapOpts(newOpts)
 	nsqd.triggerOptsNotification()
@@ -295,6 +422,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts = NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.NSQLookupdTCPAddresses = []string{lookupd2.RealTCPAddr().String(), lookupd3.RealTCPAddr().String()}
 	nsqd.swapOpts(newOpts)
 	nsqd.triggerOptsNotification()
@@ -418,6 +546,8 @@ func TestCluster(t *testing.T) {
 func TestSetHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
 	nsqd, err := New(opts)
 	test.Nil(t, err)
 	defer nsqd.Exit()
@@ -439,3 +569,150 @@ func TestSetHealth(t *testing.T) {
 	test.Equal(t, "OK", nsqd.GetHealth())
 	test.Equal(t, true, nsqd.IsHealthy())
 }
+
+func TestDiskSpaceGuard(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("disk_guard" + strconv.Itoa(int(time.Now().Unix())))
+	ephemeralTopic := nsqd.GetTopic("disk_guard#ephemeral")
+
+	opts.DiskHardLimit = 1 << 62
+	nsqd.swapOpts(opts)
+	nsqd.checkDiskSpace()
+	test.Equal(t, "full", nsqd.getDiskStats().Status)
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	test.Equal(t, errDiskFull, topic.PutMessage(msg))
+	// dead-letters are moved from a channel, not published
+	test.Nil(t, topic.putDeadLetter(msg))
+	msg = NewMessage(ephemeralTopic.GenerateID(), []byte("test"))
+	test.Nil(t, ephemeralTopic.PutMessage(msg))
+
+	opts.DiskHardLimit = 0
+	nsqd.swapOpts(opts)
+	nsqd.checkDiskSpace()
+	test.Equal(t, "ok", nsqd.getDiskStats().Status)
+
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	test.Nil(t, topic.PutMessage(msg))
+}
+
+func TestIdleExpiry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ChannelIdleTimeout = time.Hour
+	opts.TopicIdleTimeout = time.Hour
+	opts.IdleWarningPeriod = time.Hour
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	expire := func(idleSince *int64) {
+		atomic.StoreInt64(idleSince, time.Now().Add(-2*time.Hour).UnixNano())
+	}
+
+	topicName := "idle_expiry" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	idleChannel := topic.GetChannel("idle")
+	busyChannel := topic.GetChannel("busy")
+	client := newClientV2(0, nil, &context{nsqd})
+	test.Nil(t, busyChannel.AddClient(client.ID, client))
+
+	// the idle channel enters its warning period, the busy one is in use
+	nsqd.checkIdle()
+	test.NotEqual(t, int64(0), NewChannelStats(idleChannel, nil, 0).IdleExpiresAt)
+	test.Equal(t, int64(0), NewChannelStats(busyChannel, nil, 1).IdleExpiresAt)
+	test.Equal(t, int64(0), NewTopicStats(topic, nil).IdleExpiresAt)
+
+	expire(&idleChannel.idleSince)
+	nsqd.checkIdle()
+	_, err := topic.GetExistingChannel("idle")
+	test.NotNil(t, err)
+	_, err = topic.GetExistingChannel("busy")
+	test.Nil(t, err)
+
+	busyChannel.RemoveClient(client.ID)
+	nsqd.checkIdle()
+	expire(&busyChannel.idleSince)
+	nsqd.checkIdle()
+	_, err = topic.GetExistingChannel("busy")
+	test.NotNil(t, err)
+
+	// the topic without channels is idle until a publish
+	nsqd.checkIdle()
+	test.NotEqual(t, int64(0), NewTopicStats(topic, nil).IdleExpiresAt)
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	nsqd.checkIdle()
+	test.Equal(t, int64(0), NewTopicStats(topic, nil).IdleExpiresAt)
+
+	nsqd.checkIdle()
+	expire(&topic.idleSince)
+	nsqd.checkIdle()
+	_, err = nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+
+	// with the pause action idle channels are kept, paused
+	opts.IdleAction = idleActionPause
+	nsqd.swapOpts(opts)
+	topic = nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("paused")
+	nsqd.checkIdle()
+	expire(&channel.idleSince)
+	nsqd.checkIdle()
+	_, err = topic.GetExistingChannel("paused")
+	test.Nil(t, err)
+	test.Equal(t, true, channel.IsPaused())
+	test.Equal(t, int64(0), NewChannelStats(channel, nil, 0).IdleExpiresAt)
+}
+
+func TestIdleDeleteRace(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "idle_delete_race" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	// a client added after the channel was found idle keeps it
+	client := newClientV2(0, nil, &context{nsqd})
+	test.Nil(t, channel.AddClient(client.ID, client))
+	test.Equal(t, false, topic.deleteIdleChannel(channel))
+	test.Equal(t, false, channel.Exiting())
+	channel.RemoveClient(client.ID)
+	test.Equal(t, true, topic.deleteIdleChannel(channel))
+	test.Equal(t, true, channel.Exiting())
+	_, err := topic.GetExistingChannel("ch")
+	test.NotNil(t, err)
+
+	// so does a message published after the topic was found idle
+	messageCount := atomic.LoadUint64(&topic.messageCount)
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test"))))
+	test.Equal(t, false, nsqd.deleteIdleTopic(topic, messageCount))
+	test.Equal(t, false, topic.Exiting())
+
+	// a publish to the deleted topic goes to the one replacing it
+	test.Equal(t, true, nsqd.deleteIdleTopic(topic, messageCount+1))
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	newTopic, err := nsqd.putMessages(topic, []*Message{msg}, "")
+	test.Nil(t, err)
+	test.NotEqual(t, topic, newTopic)
+	test.Equal(t, newTopic, nsqd.GetTopic(topicName))
+	test.Equal(t, int64(1), newTopic.Depth())
+}
+
+func TestIdleCheckInterval(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.IdleCheckInterval = 0
+	_, err := New(opts)
+	test.Equal(t, "invalid --idle-check-interval 0s (must be > 0)", err.Error())
+}
@@ -25,6 +25,13 @@ type Options struct {
 	BroadcastAddress         string        `flag:"broadcast-address"`
 	NSQLookupdTCPAddresses   []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"` //一个nsqd可连接到多个nsqlookupd实例
 	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
+	AuthFile                 string        `flag:"auth-file"`
+	AuthJWTHMACKeyFile       string        `flag:"auth-jwt-hmac-key-file"`
+	AuthJWTPublicKeyFiles    []string      `flag:"auth-jwt-public-key-file" cfg:"auth_jwt_public_key_files"`
+	AuthJWTIssuer            string        `flag:"auth-jwt-issuer"`
+	AuthJWTAudience          string        `flag:"auth-jwt-audience"`
+	AuthHTTPHedgeDelay       time.Duration `flag:"auth-http-hedge-delay"`
+	AuthStaleTTL             time.Duration `flag:"auth-stale-ttl"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
 
@@ -35,6 +42,28 @@ type Options struct {
 	SyncEvery       int64         `flag:"sync-every"`
 	SyncTimeout     time.Duration `flag:"sync-timeout"`
 
+	// free space on the DataPath volume below which to warn (soft) and to
+	// reject publishes (hard), 0 disables
+	DiskSoftLimit     int64         `flag:"disk-soft-limit"`
+	DiskHardLimit     int64         `flag:"disk-hard-limit"`
+	DiskCheckInterval time.Duration `flag:"disk-check-interval"`
+
+	// implicit creation of topics by publishes, subscriptions and HTTP calls,
+	// when disabled only topics matching one of AutoCreateTopicPatterns are.
+	// It does not cover channels, a subscription to an existing topic still
+	// creates its channel
+	AutoCreateTopics        bool     `flag:"auto-create-topics"`
+	AutoCreateTopicPatterns []string `flag:"auto-create-topic-pattern" cfg:"auto_create_topic_patterns"`
+
+	// durable channels without clients and topics without channels nor
+	// publishes for their idle timeout (0 disables) are deleted or paused
+	// (IdleAction), the IdleWarningPeriod before that is shown in /stats
+	ChannelIdleTimeout time.Duration `flag:"channel-idle-timeout"`
+	TopicIdleTimeout   time.Duration `flag:"topic-idle-timeout"`
+	IdleAction         string        `flag:"idle-action"`
+	IdleWarningPeriod  time.Duration `flag:"idle-warning-period"`
+	IdleCheckInterval  time.Duration `flag:"idle-check-interval"`
+
 	QueueScanInterval        time.Duration
 	QueueScanRefreshInterval time.Duration
 	QueueScanSelectionCount  int
@@ -48,6 +77,8 @@ type Options struct {
 	MaxBodySize   int64         `flag:"max-body-size"`
 	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
 	ClientTimeout time.Duration
+	DedupeWindow  time.Duration `flag:"dedupe-window"`
+	MaxDedupeKeys int           `flag:"max-dedupe-keys"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -58,12 +89,25 @@ type Options struct {
 	OutputBufferTimeout    time.Duration `flag:"output-buffer-timeout"`
 	MaxChannelConsumers    int           `flag:"max-channel-consumers"`
 
+	// HTTP consumer sessions
+	HTTPConsumerSessionTimeout time.Duration `flag:"http-consumer-session-timeout"`
+
+	// origins (besides its own) of the browser pages allowed to open a
+	// WebSocket (/ws), "*" allows any
+	WebSocketAllowedOrigins []string `flag:"websocket-allowed-origin" cfg:"websocket_allowed_origins"`
+
+	// push subscriptions may only POST to one of PushAllowedHosts (host or
+	// host:port), none disables them
+	PushAllowedHosts   []string `flag:"push-allowed-host" cfg:"push_allowed_hosts"`
+	MaxPushConcurrency int      `flag:"max-push-concurrency"`
+
 	// statsd integration
 	StatsdAddress       string        `flag:"statsd-address"`
 	StatsdPrefix        string        `flag:"statsd-prefix"`
 	StatsdInterval      time.Duration `flag:"statsd-interval"`
 	StatsdMemStats      bool          `flag:"statsd-mem-stats"`
 	StatsdUDPPacketSize int           `flag:"statsd-udp-packet-size"`
+	StatsdTags          bool          `flag:"statsd-tags"`
 
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
@@ -106,6 +150,10 @@ func NewOptions() *Options {
 
 		NSQLookupdTCPAddresses: make([]string, 0), //[]string{"0.0.0.0:4161"},在此处设值没有用，只能通过命令行或者http设置下去。
 		AuthHTTPAddresses:      make([]string, 0),
+		AuthJWTPublicKeyFiles:  make([]string, 0),
+
+		AuthHTTPHedgeDelay: 500 * time.Millisecond,
+		AuthStaleTTL:       5 * time.Minute,
 
 		HTTPClientConnectTimeout: 2 * time.Second,
 		HTTPClientRequestTimeout: 5 * time.Second,
@@ -115,6 +163,15 @@ func NewOptions() *Options {
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
 
+		DiskCheckInterval: 10 * time.Second,
+
+		AutoCreateTopics:        true,
+		AutoCreateTopicPatterns: make([]string, 0),
+
+		IdleAction:        idleActionDelete,
+		IdleWarningPeriod: time.Hour,
+		IdleCheckInterval: time.Minute,
+
 		QueueScanInterval:        100 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
 		QueueScanSelectionCount:  20,
@@ -127,6 +184,8 @@ func NewOptions() *Options {
 		MaxBodySize:   5 * 1024 * 1024,
 		MaxReqTimeout: 1 * time.Hour,
 		ClientTimeout: 60 * time.Second,
+		DedupeWindow:  2 * time.Minute,
+		MaxDedupeKeys: 10000,
 
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
@@ -136,6 +195,13 @@ func NewOptions() *Options {
 		OutputBufferTimeout:    250 * time.Millisecond,
 		MaxChannelConsumers:    0,
 
+		HTTPConsumerSessionTimeout: 60 * time.Second,
+
+		WebSocketAllowedOrigins: make([]string, 0),
+
+		PushAllowedHosts:   make([]string, 0),
+		MaxPushConcurrency: 16,
+
 		StatsdPrefix:        "nsq.%s",
 		StatsdInterval:      60 * time.Second,
 		StatsdMemStats:      true,
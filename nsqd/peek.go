@@ -0,0 +1,275 @@
+package nsqd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+)
+
+// number of messages returned by the peek endpoints, by default and at most
+const (
+	defaultPeekCount = 10
+	maxPeekCount     = 1000
+)
+
+// peekMemoryMsgChan returns the next n messages in memoryMsgChan by receiving
+// all of them and sending them back, in order.
+//
+// The caller must keep every sender out (the messages received by consumers
+// meanwhile are simply not returned), so that there is room to send them all
+// back and nothing gets in between.
+func peekMemoryMsgChan(memoryMsgChan chan *Message, n int) []*Message {
+	var queued []*Message
+	for {
+		select {
+		case msg := <-memoryMsgChan:
+			queued = append(queued, msg)
+		default:
+			goto sendBack
+		}
+	}
+
+sendBack:
+	for _, msg := range queued {
+		memoryMsgChan <- msg
+	}
+	if n > len(queued) {
+		n = len(queued)
+	}
+	return queued[:n]
+}
+
+// peekDiskQueue returns the next n messages of the diskqueue name by reading
+// its files directly.
+//
+// The read position is the one of the last sync of the diskqueue, and
+// messages written since are not on disk yet, so the result may include a
+// few messages already read and miss the most recent ones.
+func peekDiskQueue(dataPath string, name string, n int) ([]*Message, error) {
+	var depth, readFileNum, readPos, writeFileNum, writePos int64
+
+	f, err := os.Open(path.Join(dataPath, fmt.Sprintf("%s.diskqueue.meta.dat", name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n", &depth, &readFileNum, &readPos, &writeFileNum, &writePos)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*Message
+	for fileNum := readFileNum; fileNum <= writeFileNum && len(msgs) < n; fileNum++ {
+		fileName := path.Join(dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", name, fileNum))
+		pos := int64(0)
+		if fileNum == readFileNum {
+			pos = readPos
+		}
+		msgs, err = readDiskQueueFile(fileName, pos, msgs, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// readDiskQueueFile appends the messages of a diskqueue file from pos to
+// msgs, up to n messages, stopping at the first incomplete record
+func readDiskQueueFile(fileName string, pos int64, msgs []*Message, n int) ([]*Message, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// read (and removed) in the meantime
+			return msgs, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	if pos > 0 {
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := bufio.NewReader(f)
+	var header [4]byte
+	for len(msgs) < n {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			break
+		}
+		size := int32(binary.BigEndian.Uint32(header[:]))
+		if size < minValidMsgLength {
+			break
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			break
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// PeekMessage is a message as returned by the peek endpoints
+type PeekMessage struct {
+	ID        string            `json:"id"`
+	Body      []byte            `json:"body"`
+	Timestamp int64             `json:"timestamp"`
+	Attempts  uint16            `json:"attempts"`
+	Headers   map[string]string `json:"headers,omitempty"`
+
+	// in-flight messages
+	ClientID int64 `json:"client_id,omitempty"`
+	Deadline int64 `json:"deadline,omitempty"`
+
+	// deferred messages
+	DeliverAt int64 `json:"deliver_at,omitempty"`
+}
+
+func newPeekMessage(msg *Message) PeekMessage {
+	return PeekMessage{
+		ID:        string(msg.ID[:]),
+		Body:      msg.Body,
+		Timestamp: msg.Timestamp,
+		Attempts:  msg.Attempts,
+		Headers:   msg.Headers,
+	}
+}
+
+func newPeekMessages(msgs []*Message) []PeekMessage {
+	peeked := make([]PeekMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		peeked = append(peeked, newPeekMessage(msg))
+	}
+	return peeked
+}
+
+// PeekResult holds the messages peeked at in each of the sets of a topic or
+// channel
+type PeekResult struct {
+	Memory   []PeekMessage `json:"memory"`
+	Backend  []PeekMessage `json:"backend"`
+	InFlight []PeekMessage `json:"in_flight,omitempty"`
+	Deferred []PeekMessage `json:"deferred,omitempty"`
+}
+
+// Peek returns the next n messages queued in the topic
+func (t *Topic) Peek(n int) (PeekResult, error) {
+	var backend []*Message
+	if !t.ephemeral {
+		var err error
+		backend, err = peekDiskQueue(t.ctx.nsqd.getOpts().DataPath, t.name, n)
+		if err != nil {
+			return PeekResult{}, err
+		}
+	}
+	// PutMessage(s) send under the read lock
+	t.Lock()
+	memory := peekMemoryMsgChan(t.memoryMsgChan, n)
+	t.Unlock()
+	return PeekResult{
+		Memory:  newPeekMessages(memory),
+		Backend: newPeekMessages(backend),
+	}, nil
+}
+
+// Peek returns the next n messages queued in the channel, along with the
+// first n in-flight messages (by timeout) and deferred messages (by due time)
+func (c *Channel) Peek(n int) (PeekResult, error) {
+	c.inFlightMutex.Lock()
+	inFlight := make([]*Message, 0, len(c.inFlightMessages))
+	for _, msg := range c.inFlightMessages {
+		inFlight = append(inFlight, msg)
+	}
+	sort.Slice(inFlight, func(i, j int) bool { return inFlight[i].pri < inFlight[j].pri })
+	if len(inFlight) > n {
+		inFlight = inFlight[:n]
+	}
+	result := PeekResult{InFlight: make([]PeekMessage, 0, len(inFlight))}
+	for _, msg := range inFlight {
+		pm := newPeekMessage(msg)
+		pm.ClientID = msg.clientID
+		pm.Deadline = msg.pri
+		result.InFlight = append(result.InFlight, pm)
+	}
+	c.inFlightMutex.Unlock()
+
+	type deferredMessage struct {
+		msg *Message
+		due int64
+	}
+	var deferred []deferredMessage
+	c.deferredMutex.Lock()
+	for _, item := range c.deferredMessages {
+		deferred = append(deferred, deferredMessage{item.Value.(*Message), item.Priority})
+	}
+	c.deferredMutex.Unlock()
+	sort.Slice(deferred, func(i, j int) bool { return deferred[i].due < deferred[j].due })
+	if len(deferred) > n {
+		deferred = deferred[:n]
+	}
+	result.Deferred = make([]PeekMessage, 0, len(deferred))
+	for _, d := range deferred {
+		pm := newPeekMessage(d.msg)
+		pm.DeliverAt = d.due
+		result.Deferred = append(result.Deferred, pm)
+	}
+
+	// PutMessage sends under the read lock, the requeues and deferred or held
+	// messages becoming ready under the exitMutex read lock
+	c.exitMutex.Lock()
+	c.Lock()
+	memory := peekMemoryMsgChan(c.memoryMsgChan, n)
+	c.Unlock()
+	c.exitMutex.Unlock()
+	result.Memory = newPeekMessages(memory)
+
+	if !c.ephemeral {
+		// the diskqueue's read position can be behind, skip the messages read
+		// since that are still in flight or deferred
+		backend, err := peekDiskQueue(c.ctx.nsqd.getOpts().DataPath,
+			getBackendName(c.topicName, c.name), n+len(result.InFlight)+len(result.Deferred))
+		if err != nil {
+			return PeekResult{}, err
+		}
+		result.Backend = make([]PeekMessage, 0, n)
+		for _, msg := range backend {
+			if len(result.Backend) == n {
+				break
+			}
+			if c.isPending(msg.ID) {
+				continue
+			}
+			result.Backend = append(result.Backend, newPeekMessage(msg))
+		}
+	}
+	return result, nil
+}
+
+// isPending returns whether the message id is in flight or deferred
+func (c *Channel) isPending(id MessageID) bool {
+	c.inFlightMutex.Lock()
+	_, ok := c.inFlightMessages[id]
+	c.inFlightMutex.Unlock()
+	if ok {
+		return true
+	}
+	c.deferredMutex.Lock()
+	_, ok = c.deferredMessages[id]
+	c.deferredMutex.Unlock()
+	return ok
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"sync/atomic"
@@ -133,7 +134,7 @@ func (p *protocolV2) SendMessage(client *clientV2, msg *Message) error {
 	p.ctx.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): writing msg(%s) to client(%s) - %s", msg.ID, client, msg.Body)
 	var buf = &bytes.Buffer{}
 
-	_, err := msg.WriteTo(buf)
+	_, err := msg.WriteToVersion(buf, client.msgFormat())
 	if err != nil {
 		return err
 	}
@@ -205,6 +206,8 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 		return p.MPUB(client, params)
 	case bytes.Equal(params[0], []byte("DPUB")):
 		return p.DPUB(client, params)
+	case bytes.Equal(params[0], []byte("HPUB")):
+		return p.HPUB(client, params)
 	case bytes.Equal(params[0], []byte("NOP")): //若客户端空闲，则对服务端心跳的回复为此命令
 		return p.NOP(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
@@ -309,6 +312,7 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) { //pu
 			// 而置为nil的原因是，在SUB命令请求方法中第一行即为检查此客户端是否处于 stateInit 状态，
 			// 而调用 SUB 了之后，状态变为 stateSubscribed
 			subEventChan = nil //表示再也不能被触发，除非有新的订阅，但是subChannel不为nil
+			msgTimeout = client.channelMsgTimeout(subChannel)
 			// 当 nsqd 收到 client 发送的 IDENTIFY 请求时，会设置此 client的属性信息，然后将信息 push 到	identifyEventChan。
 			// 因此此处就会收到一条消息，同样将 identifyEventChan 重置为nil，这表明只能从 identifyEventChan 通道中接收一次消息，因为在一次连接过程中，只允许客户端初始化一次。
 			// 在IDENTIFY命令处理请求中可看到在第一行时进行了检查，若此时客户端的状态不是 stateInit，则会报错。
@@ -337,6 +341,9 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) { //pu
 			}
 
 			msgTimeout = identifyData.MsgTimeout
+			if subChannel != nil {
+				msgTimeout = client.channelMsgTimeout(subChannel)
+			}
 		case <-heartbeatChan: //消费者生产者共有。由于有定时器在，所以此for循环不会出现all goroutine are asleep的错误。
 			//定时向客户端发送心跳消息，由HeartbeatInterval确定
 			err = p.Send(client, frameTypeResponse, heartbeatBytes)
@@ -350,15 +357,18 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) { //pu
 			// 若其大于 客户端发送过来的数字 sampleRate，则 client 虽然订阅了此 channel，且此 channel中也有消息了，但是不会发送给此 client。
 			// 这里就体现了 官方文档 中所说的，当一个 channel 被 client 订阅时，它会将收到的消息随机发送给这一组 client 中的一个。
 			// 而且，就算只有一个 client，从程序中来看，也不一定能够获取到此消息，具体情况也与 client 编写的程序规则相关
-			if sampleRate > 0 && rand.Int31n(100) > sampleRate { //通过生成一个0到100范围内的随机数，若此随机数小于SampleRate则此消息会发送给此客户端
-				continue
-			}
-
 			msg, err := decodeMessage(b) // 将消息解码
 			if err != nil {
 				p.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
 				continue
 			}
+			subChannel.dequeued(msg)
+			if sampleRate > 0 && rand.Int31n(100) > sampleRate { //通过生成一个0到100范围内的随机数，若此随机数小于SampleRate则此消息会发送给此客户端
+				continue
+			}
+			if !subChannel.FilterMessage(msg) || !subChannel.acquireOrderingKey(msg) {
+				continue
+			}
 			msg.Attempts++ //消息尝试发送的次数msg.Attempts，注意： 当消息发送的次数超过一定限制时，可由 client 自己在应用程序中做处理
 			//subChannel就是要发送消息的channel
 			//inflight功能用来保证消息的一次到达，所有发送给客户端，但是没收到FIN确认的消息都放到这里面。
@@ -371,9 +381,13 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) { //pu
 			}
 			flushed = false
 		case msg := <-memoryMsgChan: //消费者独有 9. 从 memoryMsgChan 队列中收到了消息
+			subChannel.dequeued(msg)
 			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
 				continue
 			}
+			if !subChannel.FilterMessage(msg) || !subChannel.acquireOrderingKey(msg) {
+				continue
+			}
 			msg.Attempts++
 			// 填充消息的消费者ID、投送时间、优先级，然后调用pushInFlightMessage函数将消息放入inFlightMessages字典中。最后调用addToInFlightPQ将消息放入inFlightPQ队列中。
 			// 至此，消息投递流程完成，接下来需要等待消费者对投送结果的反馈。消费者通过发送FIN、REQ、TOUCH来回复对消息的处理结果。
@@ -459,6 +473,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		deflateLevel = max
 	}
 	snappy := p.ctx.nsqd.getOpts().SnappyEnabled && identifyData.Snappy
+	msgHeaders := identifyData.MsgHeaders
 
 	if deflate && snappy {
 		return nil, protocol.NewFatalClientErr(nil, "E_IDENTIFY_FAILED", "cannot enable both deflate and snappy compression")
@@ -478,6 +493,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired        bool   `json:"auth_required"`
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		MsgHeaders          bool   `json:"msg_headers"`
 	}{
 		MaxRdyCount:         p.ctx.nsqd.getOpts().MaxRdyCount,
 		Version:             version.Binary,
@@ -492,6 +508,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired:        p.ctx.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
 		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		MsgHeaders:          msgHeaders,
 	})
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -502,6 +519,10 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
 	}
 
+	if msgHeaders {
+		atomic.StoreInt32(&client.MsgHeaders, 1)
+	}
+
 	if tlsv1 {
 		p.ctx.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] upgrading connection to TLS", client)
 		err = client.UpgradeTLS()
@@ -578,7 +599,9 @@ func (p *protocolV2) AUTH(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "AUTH failed to read body")
 	}
 
-	if client.HasAuthorizations() {
+	// a client authorized by a JWT may AUTH again with a new token before it
+	// expires
+	if client.HasAuthorizations() && !client.isJWTAuth() {
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "AUTH already set")
 	}
 
@@ -642,6 +665,8 @@ func (p *protocolV2) CheckAuth(client *clientV2, cmd, topicName, channelName str
 
 //客户端在指定的 topic 上订阅消息
 //消费者使用TCP协议，发送SUB topic channel命令订阅某个channel，NSQD会获取需要订阅的topic和channel，然后将client添加到相应的channel中，通知c.SubEventChan
+//SUB <topic_name> <channel_name> [filter]\n  （filter 见 msgFilter，不能含空格；作用于整个 channel：
+//仅在 SUB 新建 channel 时设置，已有 channel 的 filter 不同则报错）
 func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	// 1.做一些校验工作，只有当 client 处于 stateInit 状态才能订阅某个 topic 的 channel，
 	// 换言之，当一个client订阅了某个channel之后，它的状态会被更新为stateSubscribed，因此不能再订阅 channel 了。
@@ -669,6 +694,17 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL",
 			fmt.Sprintf("SUB channel name %q is not valid", channelName))
 	}
+	// 可选的第三个参数为消息过滤表达式，不匹配的消息会被自动 FIN
+	var filter *msgFilter
+	if len(params) > 3 {
+		var err error
+		filter, err = parseMsgFilter(string(params[3]))
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_FILTER",
+				fmt.Sprintf("SUB filter %q is not valid - %s", params[3], err))
+		}
+	}
+
 	// 3. 同时检查此客户端是否有订阅的权限
 	if err := p.CheckAuth(client, "SUB", topicName, channelName); err != nil {
 		return nil, err
@@ -681,18 +717,37 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	var channel *Channel
 	for {
 		//获取topic和channel实例
-		topic := p.ctx.nsqd.GetTopic(topicName)
-		channel = topic.GetChannel(channelName)
+		topic, err := p.ctx.nsqd.getImplicitTopic(topicName)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_TOPIC_NOT_FOUND",
+				fmt.Sprintf("SUB topic %s does not exist", topicName))
+		}
+		var isNew bool
+		channel, isNew = topic.getChannel(channelName, QueueConfig{}, filter)
+		if filter != nil && !isNew && channel.Filter() != filter.String() {
+			// the filter applies to every subscriber of the channel
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_FILTER",
+				fmt.Sprintf("SUB filter %q conflicts with the filter %q of channel %s:%s",
+					filter, channel.Filter(), topicName, channelName))
+		}
+		if isNew && filter != nil && !channel.ephemeral {
+			// persist the filter, the channel's own Notify may have run before
+			p.ctx.nsqd.Lock()
+			p.ctx.nsqd.PersistMetadata()
+			p.ctx.nsqd.Unlock()
+		}
 		// 5. 调用 channel的 AddClient 方法添加指定客户端，NSQD结构体中存储的是发布者的client,在channel中存的client是消费者的。
 		if err := channel.AddClient(client.ID, client); err != nil { //将client加入到相应的channel中
 			return nil, protocol.NewFatalClientErr(nil, "E_TOO_MANY_CHANNEL_CONSUMERS",
 				fmt.Sprintf("channel consumers for %s:%s exceeds limit of %d",
-					topicName, channelName, p.ctx.nsqd.getOpts().MaxChannelConsumers))
+					topicName, channelName, channel.MaxChannelConsumers()))
 		}
-		// 6. 若此 channel 或 topic 为ephemeral，并且channel或topic正在退出，则移除此client
-		if (channel.ephemeral && channel.Exiting()) || (topic.ephemeral && topic.Exiting()) {
+		// 6. 若此 channel 或 topic 正在退出（ephemeral 或 idle 被删除），则移除此client并重试
+		if channel.Exiting() || topic.Exiting() {
 			channel.RemoveClient(client.ID)
-			time.Sleep(1 * time.Millisecond)
+			if !p.ctx.nsqd.retryExiting() {
+				return nil, protocol.NewFatalClientErr(nil, "E_SUB_FAILED", "SUB failed exiting")
+			}
 			continue
 		}
 		break
@@ -845,8 +900,9 @@ func (p *protocolV2) NOP(client *clientV2, params [][]byte) ([]byte, error) {
 }
 
 //客户端发送消息的形式：
-//PUB <topic_name>\n
+//PUB <topic_name> [dedupe_key]\n
 //[ 4-byte size in bytes ][ N-byte binary data ]
+//带 dedupe_key 时，窗口期内重复发布同一个 key 的消息会直接回复 OK 而不再入队
 //这是用tcp的方式来PUB,但是和用http的方式大同小异，详情见http的doPUB
 func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 	var err error
@@ -860,6 +916,11 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
 			fmt.Sprintf("PUB topic name %q is not valid", topicName))
 	}
+
+	dedupeKey, err := readDedupeKey(params, 2, "PUB")
+	if err != nil {
+		return nil, err
+	}
 	//前面被读走了命令的第一行，下面开始读命令的第二行:数据长度 具体数据
 	bodyLen, err := readLen(client.Reader, client.lenSlice) // 2. 先读取消息体长度bodyLen，并在长度上进行校验, 在client 请求的下一行开始, 头4个字节是消息体长度
 	if err != nil {
@@ -871,9 +932,10 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("PUB invalid message body size %d", bodyLen))
 	}
 
-	if int64(bodyLen) > p.ctx.nsqd.getOpts().MaxMsgSize {
+	maxMsgSize := p.ctx.nsqd.topicMaxMsgSize(topicName)
+	if int64(bodyLen) > maxMsgSize {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
-			fmt.Sprintf("PUB message too big %d > %d", bodyLen, p.ctx.nsqd.getOpts().MaxMsgSize))
+			fmt.Sprintf("PUB message too big %d > %d", bodyLen, maxMsgSize))
 	}
 
 	messageBody := make([]byte, bodyLen)             //建立缓冲区，并将此长度的消息读入
@@ -887,12 +949,15 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 	//get一下topic，如果没有会自动创建，并且开启topic的消息循环，开始从lookupd同步消息
-	topic := p.ctx.nsqd.GetTopic(topicName)
+	topic, err := p.ctx.nsqd.getImplicitTopic(topicName)
+	if err != nil {
+		return nil, pubError("PUB", err)
+	}
 	// 6. 构造一条 message，并将此 message 投递到此 topic 的消息队列中
-	msg := NewMessage(topic.GenerateID(), messageBody) //GenerateID产生一个消息的唯一标识符
-	err = topic.PutMessage(msg)                        //实际上就是topic.put,将消息放入t.memoryMsgChan或者磁盘后就返回了。客户端流程结束.
+	msg := NewMessage(topic.GenerateID(), messageBody)                 //GenerateID产生一个消息的唯一标识符
+	_, err = p.ctx.nsqd.putMessages(topic, []*Message{msg}, dedupeKey) //实际上就是topic.put,将消息放入t.memoryMsgChan或者磁盘后就返回了。客户端流程结束.
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
+		return nil, pubError("PUB", err)
 	}
 
 	client.PublishedMessage(topicName, 1) // 7. 修改此client发送消息的计数。
@@ -901,6 +966,7 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 }
 
 //MPUB一次性发布多条消息，DPUB用于发布延时投递的消息等等
+//二者的消息都不带消息头，带消息头的消息用 HPUB 发布（或 HTTP /pub、/mpub 的 header 参数）
 func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -914,11 +980,14 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("E_BAD_TOPIC MPUB topic name %q is not valid", topicName))
 	}
 
-	if err := p.CheckAuth(client, "MPUB", topicName, ""); err != nil {
+	dedupeKey, err := readDedupeKey(params, 2, "MPUB")
+	if err != nil {
 		return nil, err
 	}
 
-	topic := p.ctx.nsqd.GetTopic(topicName)
+	if err := p.CheckAuth(client, "MPUB", topicName, ""); err != nil {
+		return nil, err
+	}
 
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
@@ -935,18 +1004,29 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("MPUB body too big %d > %d", bodyLen, p.ctx.nsqd.getOpts().MaxBodySize))
 	}
 
+	topic, err := p.ctx.nsqd.getImplicitTopic(topicName)
+	if err != nil {
+		// skip the body, the connection remains usable
+		_, readErr := io.CopyN(ioutil.Discard, client.Reader, int64(bodyLen))
+		if readErr != nil {
+			return nil, protocol.NewFatalClientErr(readErr, "E_BAD_BODY", "MPUB failed to read body")
+		}
+		return nil, pubError("MPUB", err)
+	}
+
 	messages, err := readMPUB(client.Reader, client.lenSlice, topic,
-		p.ctx.nsqd.getOpts().MaxMsgSize, p.ctx.nsqd.getOpts().MaxBodySize)
+		topic.config.maxMsgSize(), p.ctx.nsqd.getOpts().MaxBodySize)
 	if err != nil {
 		return nil, err
 	}
 
 	// if we've made it this far we've validated all the input,
-	// the only possible error is that the topic is exiting during
-	// this next call (and no messages will be queued in that case)
-	err = topic.PutMessages(messages)
+	// the only possible errors are that nsqd is exiting during
+	// this next call or the topic is over its quota (and no messages will
+	// be queued in either case)
+	_, err = p.ctx.nsqd.putMessages(topic, messages, dedupeKey)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
+		return nil, pubError("MPUB", err)
 	}
 
 	client.PublishedMessage(topicName, uint64(len(messages)))
@@ -967,6 +1047,11 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("DPUB topic name %q is not valid", topicName))
 	}
 
+	dedupeKey, err := readDedupeKey(params, 3, "DPUB")
+	if err != nil {
+		return nil, err
+	}
+
 	timeoutMs, err := protocol.ByteToBase10(params[2])
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_INVALID",
@@ -990,9 +1075,10 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("DPUB invalid message body size %d", bodyLen))
 	}
 
-	if int64(bodyLen) > p.ctx.nsqd.getOpts().MaxMsgSize {
+	maxMsgSize := p.ctx.nsqd.topicMaxMsgSize(topicName)
+	if int64(bodyLen) > maxMsgSize {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
-			fmt.Sprintf("DPUB message too big %d > %d", bodyLen, p.ctx.nsqd.getOpts().MaxMsgSize))
+			fmt.Sprintf("DPUB message too big %d > %d", bodyLen, maxMsgSize))
 	}
 
 	messageBody := make([]byte, bodyLen)
@@ -1005,12 +1091,97 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
-	topic := p.ctx.nsqd.GetTopic(topicName)
+	topic, err := p.ctx.nsqd.getImplicitTopic(topicName)
+	if err != nil {
+		return nil, pubError("DPUB", err)
+	}
 	msg := NewMessage(topic.GenerateID(), messageBody)
 	msg.deferred = timeoutDuration
-	err = topic.PutMessage(msg)
+	_, err = p.ctx.nsqd.putMessages(topic, []*Message{msg}, dedupeKey)
+	if err != nil {
+		return nil, pubError("DPUB", err)
+	}
+
+	client.PublishedMessage(topicName, 1)
+
+	return okBytes, nil
+}
+
+//发布带消息头的消息：
+//HPUB <topic_name> [dedupe_key]\n
+//[ 4-byte size in bytes ][ 2-byte header count ]([ 1-byte key len ][ key ][ 2-byte value len ][ value ])*[ N-byte binary data ]
+//size 包含消息头和消息体
+func (p *protocolV2) HPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "HPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("HPUB topic name %q is not valid", topicName))
+	}
+
+	dedupeKey, err := readDedupeKey(params, 2, "HPUB")
+	if err != nil {
+		return nil, err
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "HPUB failed to read message body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("HPUB invalid message body size %d", bodyLen))
+	}
+
+	maxMsgSize := p.ctx.nsqd.topicMaxMsgSize(topicName)
+	if int64(bodyLen) > maxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("HPUB message too big %d > %d", bodyLen, maxMsgSize))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "HPUB failed to read message body")
+	}
+
+	headers, n, err := readMsgHeaders(body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "HPUB "+err.Error())
+	}
+	err = validateMsgHeaders(headers)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "HPUB "+err.Error())
+	}
+	if n == len(body) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE", "HPUB invalid message body size 0")
+	}
+	if size := int64(len(body)-n) + msgHeadersSize(headers); size > maxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("HPUB message too big %d > %d", size, maxMsgSize))
+	}
+
+	if err := p.CheckAuth(client, "HPUB", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	topic, err := p.ctx.nsqd.getImplicitTopic(topicName)
+	if err != nil {
+		return nil, pubError("HPUB", err)
+	}
+	msg := NewMessage(topic.GenerateID(), body[n:])
+	if len(headers) > 0 {
+		msg.Headers = headers
+	}
+	_, err = p.ctx.nsqd.putMessages(topic, []*Message{msg}, dedupeKey)
+	if err != nil {
+		return nil, pubError("HPUB", err)
 	}
 
 	client.PublishedMessage(topicName, 1)
@@ -1018,6 +1189,34 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	return okBytes, nil
 }
 
+// pubError returns the client error for a publish that failed with err, a
+// publish refused for lack of space or to a topic that does not exist does
+// not close the connection
+func pubError(cmd string, err error) error {
+	switch err {
+	case errTopicNotFound:
+		return protocol.NewClientErr(err, "E_TOPIC_NOT_FOUND", cmd+" failed "+err.Error())
+	case errQuotaExceeded:
+		return protocol.NewClientErr(err, "E_QUOTA_EXCEEDED", cmd+" failed "+err.Error())
+	case errDiskFull:
+		return protocol.NewClientErr(err, "E_DISK_FULL", cmd+" failed "+err.Error())
+	}
+	return protocol.NewFatalClientErr(err, "E_"+cmd+"_FAILED", cmd+" failed "+err.Error())
+}
+
+// readDedupeKey returns the optional dedupe key param of a publish command
+func readDedupeKey(params [][]byte, i int, cmd string) (string, error) {
+	if len(params) <= i {
+		return "", nil
+	}
+	dedupeKey := string(params[i])
+	if !isValidDedupeKey(dedupeKey) {
+		return "", protocol.NewFatalClientErr(nil, "E_BAD_DEDUPE_KEY",
+			fmt.Sprintf("%s dedupe key %q is not valid", cmd, dedupeKey))
+	}
+	return dedupeKey, nil
+}
+
 //TOUCH命令请求，即重置消息的超时时间
 func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
@@ -1034,9 +1233,7 @@ func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
 	}
 
-	client.writeLock.RLock()
-	msgTimeout := client.MsgTimeout
-	client.writeLock.RUnlock()
+	msgTimeout := client.channelMsgTimeout(client.Channel)
 	err = client.Channel.TouchMessage(client.ID, *id, msgTimeout)
 	if err != nil {
 		return nil, protocol.NewClientErr(err, "E_TOUCH_FAILED",
@@ -4,8 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -19,6 +27,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -26,6 +35,7 @@ import (
 
 	"nsq/internal/protocol"
 	"nsq/internal/test"
+	"nsq/internal/websocket"
 
 	"github.com/golang/snappy"
 	"github.com/nsqio/go-nsq"
@@ -55,6 +65,20 @@ func mustStartNSQD(opts *Options) (*net.TCPAddr, *net.TCPAddr, *NSQD) {
 	return nsqd.RealTCPAddr(), nsqd.RealHTTPAddr(), nsqd
 }
 
+// waitClientsClosed waits for the IOLoops of the closed connections to exit,
+// they log to the test
+func waitClientsClosed(nsqd *NSQD) {
+	for i := 0; i < 100; i++ {
+		nsqd.clientLock.RLock()
+		n := len(nsqd.clients)
+		nsqd.clientLock.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func mustConnectNSQD(tcpAddr *net.TCPAddr) (net.Conn, error) {
 	conn, err := net.DialTimeout("tcp", tcpAddr.String(), time.Second)
 	if err != nil {
@@ -162,6 +186,103 @@ func TestBasicV2(t *testing.T) {
 	test.Equal(t, uint16(1), msgOut.Attempts)
 }
 
+// exercise the V2 protocol over a WebSocket of the HTTP server
+func TestWebSocketV2(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_ws_v2" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := websocket.Dial(httpAddr.String(), "/ws", time.Second)
+	test.Nil(t, err)
+	defer conn.Close()
+	conn.Write(nsq.MagicV2)
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, []byte("test body"), msgOut.Body)
+
+	_, err = nsq.Finish(nsq.MessageID(msgOut.ID)).WriteTo(conn)
+	test.Nil(t, err)
+	_, err = nsq.Nop().WriteTo(conn)
+	test.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		stats := nsqd.GetStats(topicName, "ch", true)
+		if stats[0].Channels[0].Clients[0].FinishCount == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stats := nsqd.GetStats(topicName, "ch", true)
+	test.Equal(t, 0, stats[0].Channels[0].InFlightCount)
+	test.Equal(t, uint64(1), stats[0].Channels[0].Clients[0].FinishCount)
+}
+
+// tbLogFunc adapts a function to the test.NewTestLogger interface
+type tbLogFunc func(...interface{})
+
+func (f tbLogFunc) Log(args ...interface{}) { f(args...) }
+
+func TestWebSocketOrigin(t *testing.T) {
+	// the upgraded connections are closed before sending the protocol magic
+	closed := make(chan struct{}, 10)
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(tbLogFunc(func(args ...interface{}) {
+		if strings.Contains(fmt.Sprint(args...), "failed to read protocol version") {
+			closed <- struct{}{}
+			return
+		}
+		t.Log(args...)
+	}))
+	opts.WebSocketAllowedOrigins = []string{"https://admin.example"}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	for origin, status := range map[string]int{
+		"":                                   http.StatusSwitchingProtocols,
+		"http://" + httpAddr.String():        http.StatusSwitchingProtocols,
+		"https://admin.example":              http.StatusSwitchingProtocols,
+		"https://evil.example":               http.StatusForbidden,
+		"https://admin.example.evil.example": http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/ws", httpAddr), nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, status, resp.StatusCode)
+	}
+
+	for i := 0; i < 3; i++ {
+		<-closed
+	}
+}
+
 func TestMultipleConsumerV2(t *testing.T) {
 	msgChan := make(chan *Message)
 
@@ -564,6 +685,51 @@ func TestSizeLimits(t *testing.T) {
 	test.Equal(t, fmt.Sprintf("E_BAD_MESSAGE MPUB message too big 101 > 100"), string(data))
 }
 
+func TestTopicAutoCreate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AutoCreateTopics = false
+	opts.AutoCreateTopicPatterns = []string{"^auto_"}
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn, nil, frameTypeResponse)
+
+	// refused without closing the connection
+	_, err = nsq.Publish("test_topic_auto_create", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_TOPIC_NOT_FOUND PUB failed topic does not exist")
+	cmd, _ := nsq.MultiPublish("test_topic_auto_create", [][]byte{[]byte("m1"), []byte("m2")})
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_TOPIC_NOT_FOUND MPUB failed topic does not exist")
+	_, err = nsqd.GetExistingTopic("test_topic_auto_create")
+	test.NotNil(t, err)
+
+	_, err = nsq.Publish("auto_test_topic", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	nsqd.GetTopic("test_topic_auto_create")
+	_, err = nsq.Publish("test_topic_auto_create", []byte("test")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	conn.Close()
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn, nil, frameTypeResponse)
+	_, err = nsq.Subscribe("test_topic_unknown", "ch").WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_TOPIC_NOT_FOUND SUB topic test_topic_unknown does not exist")
+	conn.Close()
+	waitClientsClosed(nsqd)
+}
+
 func TestDPUB(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -607,6 +773,217 @@ func TestDPUB(t *testing.T) {
 	test.Equal(t, fmt.Sprintf("E_INVALID DPUB timeout 3600100 out of range 0-3600000"), string(data))
 }
 
+func TestHPUB(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_hpub_v2" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("v1")
+	topic.GetChannel("v2")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	headers := map[string]string{"content-type": "text/plain", "trace-id": "abc"}
+	var body bytes.Buffer
+	writeMsgHeaders(&body, headers)
+	body.WriteString("test body")
+	cmd := &nsq.Command{Name: []byte("HPUB"), Params: [][]byte{[]byte(topicName)}, Body: body.Bytes()}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	// a client that negotiated msg_headers receives the v2 frame
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	data := identify(t, conn2, map[string]interface{}{"msg_headers": true}, frameTypeResponse)
+	r := struct {
+		MsgHeaders bool `json:"msg_headers"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.MsgHeaders)
+	sub(t, conn2, topicName, "v2")
+	_, err = nsq.Ready(1).WriteTo(conn2)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn2)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, byte(msgV2Magic), data[0])
+	msgOut, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, headers, msgOut.Headers)
+	test.Equal(t, []byte("test body"), msgOut.Body)
+
+	// older clients keep receiving the v1 frame
+	conn3, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn3.Close()
+	identify(t, conn3, nil, frameTypeResponse)
+	sub(t, conn3, topicName, "v1")
+	_, err = nsq.Ready(1).WriteTo(conn3)
+	test.Nil(t, err)
+	resp, err = nsq.ReadResponse(conn3)
+	test.Nil(t, err)
+	frameType, data, err = nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, err = decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(msgOut.Headers))
+	test.Equal(t, []byte("test body"), msgOut.Body)
+
+	conn.Close()
+	conn2.Close()
+	conn3.Close()
+	waitClientsClosed(nsqd)
+}
+
+func TestPUBDedupe(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxDedupeKeys = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_pub_dedupe" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	pub := func(key string) {
+		cmd := &nsq.Command{Name: []byte("PUB"),
+			Params: [][]byte{[]byte(topicName), []byte(key)}, Body: []byte("test body")}
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+
+	pub("a")
+	pub("a")
+	pub("b")
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&topic.dedupeHitCount))
+
+	// only the newest MaxDedupeKeys keys are remembered
+	pub("c")
+	pub("a")
+	test.Equal(t, int64(4), topic.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&topic.dedupeHitCount))
+
+	// the key covers the whole MPUB batch
+	cmd, err := nsq.MultiPublish(topicName, [][]byte{[]byte("m1"), []byte("m2")})
+	test.Nil(t, err)
+	cmd.Params = append(cmd.Params, []byte("c"))
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, int64(4), topic.Depth())
+	test.Equal(t, uint64(2), atomic.LoadUint64(&topic.dedupeHitCount))
+}
+
+func TestSUBFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_sub_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	expr := "header.type==order&&body.region!=eu||body.priority"
+
+	subFilter := func(filter string) (int32, []byte) {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		cmd := &nsq.Command{Name: []byte("SUB"), Params: [][]byte{
+			[]byte(topicName), []byte("ch"), []byte(filter)}}
+		_, err = cmd.WriteTo(conn)
+		test.Nil(t, err)
+		resp, _ := nsq.ReadResponse(conn)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		return frameType, data
+	}
+
+	// the SUB creating the channel sets its filter
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	cmd := &nsq.Command{Name: []byte("SUB"), Params: [][]byte{
+		[]byte(topicName), []byte("ch"), []byte(expr)}}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, expr, channel.Filter())
+
+	for _, m := range []struct {
+		headers map[string]string
+		body    string
+	}{
+		{map[string]string{"type": "order"}, `{"region":"eu"}`},
+		{map[string]string{"type": "refund"}, `{"region":"us"}`},
+		{nil, `not json`},
+		{map[string]string{"type": "order"}, `{"region":"us"}`},
+		{nil, `{"priority":true}`},
+	} {
+		msg := NewMessage(topic.GenerateID(), []byte(m.body))
+		msg.Headers = m.headers
+		topic.PutMessage(msg)
+	}
+
+	// only the matching messages are delivered
+	_, err = nsq.Ready(5).WriteTo(conn)
+	test.Nil(t, err)
+	for _, body := range []string{`{"region":"us"}`, `{"priority":true}`} {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msgOut, _ := decodeMessage(data)
+		test.Equal(t, []byte(body), msgOut.Body)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = nsq.ReadResponse(conn)
+	test.NotNil(t, err)
+	test.Equal(t, uint64(3), atomic.LoadUint64(&channel.filteredCount))
+
+	// a later SUB may repeat the channel's filter, not change it
+	frameType, data := subFilter(expr)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, "OK", string(data))
+	frameType, data = subFilter("header.type==refund")
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.HasPrefix(string(data), "E_BAD_FILTER"))
+	test.Equal(t, expr, channel.Filter())
+
+	// invalid
+	frameType, data = subFilter("region==eu")
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.HasPrefix(string(data), "E_BAD_FILTER"))
+
+	conn.Close()
+	waitClientsClosed(nsqd)
+}
+
 func TestTouch(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -1495,6 +1872,257 @@ func TestClientAuth(t *testing.T) {
 	runAuthTest(t, authResponse, authSecret, authError, authSuccess, tlsEnabled, commonName)
 }
 
+func TestClientAuthdCache(t *testing.T) {
+	// the first auth server is slow and fails, the second is queried after
+	// the hedge delay
+	slowAuthd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(500)
+	}))
+	defer slowAuthd.Close()
+	var queries, deny int32
+	authd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		if atomic.LoadInt32(&deny) == 1 {
+			w.WriteHeader(403)
+			return
+		}
+		fmt.Fprint(w, `{"ttl":1, "authorizations":
+			[{"topic":"test", "channels":[".*"], "permissions":["subscribe","publish"]}]}`)
+	}))
+	defer authd.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthHTTPAddresses = []string{
+		strings.TrimPrefix(slowAuthd.URL, "http://"),
+		strings.TrimPrefix(authd.URL, "http://"),
+	}
+	opts.AuthHTTPHedgeDelay = 20 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	start := time.Now()
+	authState, err := nsqd.queryAuth("127.0.0.1", false, "", "secret")
+	test.Nil(t, err)
+	test.Equal(t, true, authState.IsAllowed("test", "ch"))
+	test.Equal(t, true, time.Since(start) < 250*time.Millisecond)
+
+	_, err = nsqd.queryAuth("127.0.0.1", false, "", "secret")
+	test.Nil(t, err)
+	test.Equal(t, int32(1), atomic.LoadInt32(&queries))
+
+	// denied once expired
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt32(&deny, 1)
+	_, err = nsqd.queryAuth("127.0.0.1", false, "", "secret")
+	test.NotNil(t, err)
+
+	atomic.StoreInt32(&deny, 0)
+	_, err = nsqd.queryAuth("127.0.0.1", false, "", "secret")
+	test.Nil(t, err)
+
+	// still authorized once expired while no auth server answers
+	time.Sleep(1100 * time.Millisecond)
+	authd.Close()
+	authState, err = nsqd.queryAuth("127.0.0.1", false, "", "secret")
+	test.Nil(t, err)
+	test.Equal(t, false, authState.IsExpired())
+	_, err = nsqd.queryAuth("127.0.0.1", false, "", "other")
+	test.NotNil(t, err)
+
+	stats := nsqd.getAuthStats()
+	test.Equal(t, uint64(5), stats.Queries)
+	test.Equal(t, uint64(3), stats.Errors)
+	test.Equal(t, uint64(1), stats.CacheHits)
+	test.Equal(t, uint64(1), stats.StaleHits)
+	test.Equal(t, 5, stats.Latency.Count)
+}
+
+func TestClientAuthFile(t *testing.T) {
+	authFile, err := ioutil.TempFile("", "nsqd-auth")
+	test.Nil(t, err)
+	defer os.Remove(authFile.Name())
+	writeAuthFile := func(data string) {
+		err := ioutil.WriteFile(authFile.Name(), []byte(data), 0600)
+		test.Nil(t, err)
+	}
+	writeAuthFile(`{"secrets": {
+		"s1": {"ttl": 3600, "identity": "s1", "authorizations":
+			[{"topic": "test", "channels": [".*"], "permissions": ["subscribe", "publish"]}]},
+		"s2": {"ttl": 3600, "authorizations":
+			[{"topic": "test", "channels": [], "permissions": ["publish"]}]}
+	}}`)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthFile = authFile.Name()
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	connect := func() net.Conn {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		identify(t, conn, nil, frameTypeResponse)
+		return conn
+	}
+	closeConn := func(conn net.Conn) {
+		conn.Close()
+		waitClientsClosed(nsqd)
+	}
+
+	conn := connect()
+	authCmd(t, conn, "s1", `{"identity":"s1","identity_url":"","permission_count":1}`)
+	sub(t, conn, "test", "ch")
+	closeConn(conn)
+
+	conn = connect()
+	authCmd(t, conn, "s2", `{"identity":"","identity_url":"","permission_count":1}`)
+	subFail(t, conn, "test", "ch")
+	closeConn(conn)
+
+	conn = connect()
+	authCmd(t, conn, "s3", "")
+	readValidate(t, conn, frameTypeError, "E_AUTH_FAILED AUTH failed")
+	closeConn(conn)
+
+	// s3 is added on reload
+	writeAuthFile(`{"secrets": {
+		"s3": {"ttl": 3600, "authorizations":
+			[{"topic": "test", "channels": [".*"], "permissions": ["subscribe"]}]}
+	}}`)
+	test.Nil(t, nsqd.ReloadAuthFile())
+
+	conn = connect()
+	authCmd(t, conn, "s3", `{"identity":"","identity_url":"","permission_count":1}`)
+	sub(t, conn, "test", "ch")
+	closeConn(conn)
+
+	// an invalid file is not loaded
+	writeAuthFile(`{"secrets": {"s4": {"ttl": 0, "authorizations": []}}}`)
+	test.NotNil(t, nsqd.ReloadAuthFile())
+
+	conn = connect()
+	authCmd(t, conn, "s3", `{"identity":"","identity_url":"","permission_count":1}`)
+	closeConn(conn)
+}
+
+// signJWT returns a token of claims signed with an HMAC key ([]byte) or an
+// ECDSA P-256 private key
+func signJWT(t *testing.T, key interface{}, claims map[string]interface{}) string {
+	alg := "HS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	test.Nil(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(crand.Reader, key, digest[:])
+		test.Nil(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestClientAuthJWT(t *testing.T) {
+	hmacKey := []byte("testkey")
+	hmacKeyFile, err := ioutil.TempFile("", "nsqd-jwt-hmac")
+	test.Nil(t, err)
+	defer os.Remove(hmacKeyFile.Name())
+	hmacKeyFile.Write(hmacKey)
+	hmacKeyFile.Close()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	test.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	test.Nil(t, err)
+	publicKeyFile, err := ioutil.TempFile("", "nsqd-jwt-public")
+	test.Nil(t, err)
+	defer os.Remove(publicKeyFile.Name())
+	pem.Encode(publicKeyFile, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	publicKeyFile.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthJWTHMACKeyFile = hmacKeyFile.Name()
+	opts.AuthJWTPublicKeyFiles = []string{publicKeyFile.Name()}
+	opts.AuthJWTAudience = "nsqd"
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	claims := func(ttl time.Duration) map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "alice",
+			"aud": []string{"nsqd"},
+			"exp": time.Now().Add(ttl).Unix(),
+			"authorizations": []map[string]interface{}{
+				{"topic": "test", "channels": []string{".*"}, "permissions": []string{"subscribe"}},
+			},
+		}
+	}
+	authSuccess := `{"identity":"alice","identity_url":"","permission_count":1}`
+
+	var conns []net.Conn
+	connect := func() net.Conn {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		conns = append(conns, conn)
+		identify(t, conn, nil, frameTypeResponse)
+		return conn
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		waitClientsClosed(nsqd)
+	}()
+
+	for _, key := range []interface{}{ecKey, hmacKey} {
+		conn := connect()
+		authCmd(t, conn, signJWT(t, key, claims(time.Hour)), authSuccess)
+		sub(t, conn, "test", "ch")
+	}
+
+	// expired, signed with another key, for another audience
+	badAudience := claims(time.Hour)
+	badAudience["aud"] = "other"
+	for _, token := range []string{
+		signJWT(t, hmacKey, claims(-time.Minute)),
+		signJWT(t, []byte("otherkey"), claims(time.Hour)),
+		signJWT(t, hmacKey, badAudience),
+	} {
+		conn := connect()
+		authCmd(t, conn, token, "")
+		readValidate(t, conn, frameTypeError, "E_AUTH_FAILED AUTH failed")
+	}
+
+	// the token can be renewed, an expired one fails the next command
+	conn := connect()
+	authCmd(t, conn, signJWT(t, hmacKey, claims(time.Hour)), authSuccess)
+	// exp is in seconds, at least 1s ahead
+	authCmd(t, conn, signJWT(t, hmacKey, claims(2*time.Second)), authSuccess)
+	time.Sleep(2100 * time.Millisecond)
+	_, err = nsq.Subscribe("test", "ch").WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_AUTH_FAILED AUTH failed")
+}
+
 func runAuthTest(t *testing.T, authResponse string, authSecret string, authError string,
 	authSuccess string, tlsEnabled bool, commonName string) {
 	var err error
@@ -1603,6 +2231,8 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
 	opts.LogLevel = LOG_DEBUG
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
 
 	nsqd, err := New(opts)
 	test.Nil(t, err)
@@ -1619,6 +2249,8 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	b.StopTimer()
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(b)
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
 	nsqd, _ := New(opts)
 	ctx := &context{nsqd}
 	p := &protocolV2{ctx}
@@ -0,0 +1,374 @@
+package nsqd
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nsq/internal/http_api"
+	"nsq/internal/util"
+	"nsq/internal/version"
+)
+
+// push subscription defaults
+const (
+	defaultPushConcurrency = 1
+	defaultPushTimeout     = 30 * time.Second
+	defaultPushBackoff     = time.Second
+	defaultPushMaxBackoff  = 10 * time.Minute
+)
+
+// PushConfig is a push subscription of a channel: nsqd POSTs each message
+// to URL, a 2xx response FINs it and anything else requeues it after a
+// backoff doubling with every attempt (from Backoff, up to MaxBackoff)
+type PushConfig struct {
+	URL         string        `json:"url"`
+	Concurrency int           `json:"concurrency"`
+	Timeout     time.Duration `json:"timeout"`
+	Backoff     time.Duration `json:"backoff"`
+	MaxBackoff  time.Duration `json:"max_backoff"`
+}
+
+func (cfg PushConfig) validate(opts *Options) error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("INVALID_URL")
+	}
+	if !isPushHostAllowed(opts, u) {
+		return errors.New("URL_NOT_ALLOWED")
+	}
+	if cfg.Concurrency <= 0 || cfg.Concurrency > opts.MaxPushConcurrency {
+		return errors.New("INVALID_CONCURRENCY")
+	}
+	if cfg.Timeout <= 0 || cfg.Timeout > opts.MaxMsgTimeout {
+		return errors.New("INVALID_TIMEOUT")
+	}
+	if cfg.Backoff < 0 || cfg.Backoff > opts.MaxReqTimeout ||
+		cfg.MaxBackoff < cfg.Backoff || cfg.MaxBackoff > opts.MaxReqTimeout {
+		return errors.New("INVALID_BACKOFF")
+	}
+	return nil
+}
+
+// isPushHostAllowed returns whether the host (or host:port) of u is one of
+// the PushAllowedHosts, none allowing no push subscriptions at all
+func isPushHostAllowed(opts *Options, u *url.URL) bool {
+	for _, host := range opts.PushAllowedHosts {
+		if strings.EqualFold(host, u.Hostname()) || strings.EqualFold(host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// pushConsumer is a Consumer of a channel delivering its messages over HTTP,
+// it shows in the channel's stats as one of its clients
+type pushConsumer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID          int64
+	config      PushConfig
+	channel     *Channel
+	ctx         *context
+	client      *http.Client
+	connectTime time.Time
+
+	sync.RWMutex
+	stateChan chan struct{} // closed (and replaced) when the channel is paused or unpaused
+
+	exitChan  chan int
+	exitOnce  sync.Once
+	waitGroup util.WaitGroupWrapper
+
+	// canceled on Close, aborting the requests in progress
+	reqCtx    gocontext.Context
+	reqCancel gocontext.CancelFunc
+}
+
+func newPushConsumer(c *Channel, cfg PushConfig) *pushConsumer {
+	reqCtx, reqCancel := gocontext.WithCancel(gocontext.Background())
+	return &pushConsumer{
+		ID:      atomic.AddInt64(&c.ctx.nsqd.clientIDSequence, 1),
+		config:  cfg,
+		channel: c,
+		ctx:     c.ctx,
+		client: &http.Client{
+			Transport: http_api.NewDeadlineTransport(cfg.Timeout, cfg.Timeout),
+			Timeout:   cfg.Timeout,
+		},
+		connectTime: time.Now(),
+		stateChan:   make(chan struct{}),
+		exitChan:    make(chan int),
+		reqCtx:      reqCtx,
+		reqCancel:   reqCancel,
+	}
+}
+
+func (p *pushConsumer) String() string {
+	return fmt.Sprintf("PUSH(%s)", p.config.URL)
+}
+
+func (p *pushConsumer) start() {
+	for i := 0; i < p.config.Concurrency; i++ {
+		p.waitGroup.Wrap(p.pushLoop)
+	}
+}
+
+// pushLoop delivers the channel's messages one at a time, like a client with
+// a RDY count of 1
+func (p *pushConsumer) pushLoop() {
+	c := p.channel
+	for {
+		var memoryMsgChan chan *Message
+		var backendMsgChan <-chan []byte
+		p.RLock()
+		stateChan := p.stateChan
+		p.RUnlock()
+		if !c.IsPaused() {
+			memoryMsgChan = c.memoryMsgChan
+			backendMsgChan = c.backend.ReadChan()
+		}
+
+		var msg *Message
+		select {
+		case msg = <-memoryMsgChan:
+			c.dequeued(msg)
+		case b := <-backendMsgChan:
+			var err error
+			msg, err = decodeMessage(b)
+			if err != nil {
+				p.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				continue
+			}
+			c.dequeued(msg)
+		case <-stateChan:
+			continue
+		case <-p.exitChan:
+			return
+		}
+
+		if !c.FilterMessage(msg) || !c.acquireOrderingKey(msg) {
+			continue
+		}
+		msg.Attempts++
+
+		// the message must not time out while the request is still running
+		msgTimeout := c.MsgTimeout()
+		if msgTimeout <= p.config.Timeout {
+			msgTimeout = p.config.Timeout + time.Second
+		}
+		err := c.StartInFlightTimeout(msg, p.ID, msgTimeout)
+		if err != nil {
+			continue
+		}
+		atomic.AddInt64(&p.InFlightCount, 1)
+		atomic.AddUint64(&p.MessageCount, 1)
+
+		if p.push(msg) {
+			if c.FinishMessage(p.ID, msg.ID) == nil {
+				atomic.AddUint64(&p.FinishCount, 1)
+				atomic.AddInt64(&p.InFlightCount, -1)
+			}
+			continue
+		}
+		select {
+		case <-p.exitChan:
+			// aborted by Close, back to the queue right away (rather than
+			// through RequeueMessage, which may dead-letter it)
+			c.RescheduleMessage(msg.ID, 0) //nolint
+			return
+		default:
+		}
+		if c.RequeueMessage(p.ID, msg.ID, p.backoff(msg.Attempts)) == nil {
+			atomic.AddUint64(&p.RequeueCount, 1)
+			atomic.AddInt64(&p.InFlightCount, -1)
+		}
+	}
+}
+
+// push POSTs msg to the subscription's URL, returning whether it succeeded
+func (p *pushConsumer) push(msg *Message) bool {
+	req, err := http.NewRequestWithContext(p.reqCtx, "POST", p.config.URL, bytes.NewReader(msg.Body))
+	if err != nil {
+		p.ctx.nsqd.logf(LOG_ERROR, "%s: failed to create request - %s", p, err)
+		return false
+	}
+	for k, v := range msg.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("nsqd/%s", version.Binary))
+	req.Header.Set("X-NSQ-Topic", p.channel.topicName)
+	req.Header.Set("X-NSQ-Channel", p.channel.name)
+	req.Header.Set("X-NSQ-Message-ID", string(msg.ID[:]))
+	req.Header.Set("X-NSQ-Attempts", strconv.Itoa(int(msg.Attempts)))
+	req.Header.Set("X-NSQ-Timestamp", strconv.FormatInt(msg.Timestamp, 10))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.ctx.nsqd.logf(LOG_WARN, "%s: failed to push message %s - %s", p, msg.ID, err)
+		return false
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		p.ctx.nsqd.logf(LOG_WARN, "%s: failed to push message %s - got status %d",
+			p, msg.ID, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// backoff returns the requeue delay of a message after a failed attempt
+func (p *pushConsumer) backoff(attempts uint16) time.Duration {
+	backoff := p.config.Backoff
+	for i := uint16(1); i < attempts && backoff < p.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.config.MaxBackoff {
+		backoff = p.config.MaxBackoff
+	}
+	return backoff
+}
+
+func (p *pushConsumer) stateChanged() {
+	p.Lock()
+	close(p.stateChan)
+	p.stateChan = make(chan struct{})
+	p.Unlock()
+}
+
+func (p *pushConsumer) Pause() {
+	p.stateChanged()
+}
+
+func (p *pushConsumer) UnPause() {
+	p.stateChanged()
+}
+
+// Close stops the push loops, aborting the requests in progress, and waits
+// for them to have put their message back in the queue
+func (p *pushConsumer) Close() error {
+	p.exitOnce.Do(func() {
+		close(p.exitChan)
+		p.reqCancel()
+	})
+	p.waitGroup.Wait()
+	return nil
+}
+
+func (p *pushConsumer) TimedOutMessage() {
+	atomic.AddInt64(&p.InFlightCount, -1)
+}
+
+func (p *pushConsumer) Empty() {
+	atomic.StoreInt64(&p.InFlightCount, 0)
+}
+
+func (p *pushConsumer) Stats() ClientStats {
+	u, _ := url.Parse(p.config.URL)
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return ClientStats{
+		Version:       "push",
+		RemoteAddress: net.JoinHostPort(host, port),
+		ClientID:      p.config.URL,
+		Hostname:      host,
+		UserAgent:     fmt.Sprintf("nsqd/%s push", version.Binary),
+		State:         stateSubscribed,
+		ReadyCount:    int64(p.config.Concurrency),
+		InFlightCount: atomic.LoadInt64(&p.InFlightCount),
+		MessageCount:  atomic.LoadUint64(&p.MessageCount),
+		FinishCount:   atomic.LoadUint64(&p.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&p.RequeueCount),
+		ConnectTime:   p.connectTime.Unix(),
+		TLS:           u.Scheme == "https",
+	}
+}
+
+// AddPushSubscription starts pushing the channel's messages as configured,
+// replacing any subscription to the same URL
+func (c *Channel) AddPushSubscription(cfg PushConfig) error {
+	p := newPushConsumer(c, cfg)
+	err := c.AddClient(p.ID, p)
+	if err != nil {
+		return err
+	}
+
+	// pushMutex is taken under the channel lock (see PersistMetadata)
+	c.pushMutex.Lock()
+	old, ok := c.pushConsumers[cfg.URL]
+	c.pushConsumers[cfg.URL] = p
+	c.pushMutex.Unlock()
+
+	if ok {
+		c.RemoveClient(old.ID)
+		old.Close()
+	}
+	p.start()
+	return nil
+}
+
+// RemovePushSubscription stops pushing the channel's messages to rawURL
+func (c *Channel) RemovePushSubscription(rawURL string) error {
+	c.pushMutex.Lock()
+	p, ok := c.pushConsumers[rawURL]
+	delete(c.pushConsumers, rawURL)
+	c.pushMutex.Unlock()
+
+	if !ok {
+		return errors.New("push subscription does not exist")
+	}
+	c.RemoveClient(p.ID)
+	return p.Close()
+}
+
+// closePushConsumers stops pushing the channel's messages, the subscriptions
+// are kept in its metadata.
+//
+// The push loops requeue their message under the exitMutex (and may publish
+// it to the dead-letter topic, under the NSQD lock), so this is done before
+// any of them is taken
+func (c *Channel) closePushConsumers() {
+	c.pushMutex.Lock()
+	consumers := make([]*pushConsumer, 0, len(c.pushConsumers))
+	for _, p := range c.pushConsumers {
+		consumers = append(consumers, p)
+	}
+	c.pushMutex.Unlock()
+
+	for _, p := range consumers {
+		p.Close()
+	}
+}
+
+// PushSubscriptions returns the channel's push subscriptions
+func (c *Channel) PushSubscriptions() []PushConfig {
+	c.pushMutex.Lock()
+	defer c.pushMutex.Unlock()
+
+	subs := make([]PushConfig, 0, len(c.pushConsumers))
+	for _, p := range c.pushConsumers {
+		subs = append(subs, p.config)
+	}
+	return subs
+}
@@ -0,0 +1,142 @@
+package nsqd
+
+import (
+	"sync"
+	"time"
+)
+
+// QueueConfig is the set of Options a topic or a channel can override,
+// nil fields are inherited (a channel from its topic, a topic from Options).
+//
+// MemQueueSize and SyncEvery size the memory queue and the backend when the
+// topic/channel is created, so changes to them apply after a restart.
+// MaxMsgSize only applies to topics.
+type QueueConfig struct {
+	MemQueueSize        *int64         `json:"mem_queue_size,omitempty"`
+	MaxMsgSize          *int64         `json:"max_msg_size,omitempty"`
+	SyncEvery           *int64         `json:"sync_every,omitempty"`
+	MsgTimeout          *time.Duration `json:"msg_timeout,omitempty"`
+	MaxChannelConsumers *int64         `json:"max_channel_consumers,omitempty"`
+
+	// quota on the messages queued (memory + backend), 0 is unlimited
+	MaxDepth       *int64  `json:"max_depth,omitempty"`
+	MaxBytes       *int64  `json:"max_bytes,omitempty"`
+	OverflowPolicy *string `json:"overflow_policy,omitempty"`
+}
+
+// queueConfig holds the QueueConfig of a topic or channel and resolves the
+// values in effect
+type queueConfig struct {
+	sync.RWMutex
+	cfg    QueueConfig
+	parent *queueConfig // the topic's, for a channel
+	ctx    *context
+}
+
+func newQueueConfig(ctx *context, parent *queueConfig, cfg QueueConfig) *queueConfig {
+	return &queueConfig{
+		cfg:    cfg,
+		parent: parent,
+		ctx:    ctx,
+	}
+}
+
+func (q *queueConfig) Get() QueueConfig {
+	q.RLock()
+	defer q.RUnlock()
+	return q.cfg
+}
+
+func (q *queueConfig) Set(cfg QueueConfig) {
+	q.Lock()
+	q.cfg = cfg
+	q.Unlock()
+}
+
+func (q *queueConfig) memQueueSize() int64 {
+	opts := q.ctx.nsqd.getOpts()
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.MemQueueSize != nil {
+			return *c.MemQueueSize
+		}
+	}
+	return opts.MemQueueSize
+}
+
+func (q *queueConfig) maxMsgSize() int64 {
+	opts := q.ctx.nsqd.getOpts()
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.MaxMsgSize != nil {
+			return *c.MaxMsgSize
+		}
+	}
+	return opts.MaxMsgSize
+}
+
+func (q *queueConfig) syncEvery() int64 {
+	opts := q.ctx.nsqd.getOpts()
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.SyncEvery != nil {
+			return *c.SyncEvery
+		}
+	}
+	return opts.SyncEvery
+}
+
+func (q *queueConfig) msgTimeout() time.Duration {
+	opts := q.ctx.nsqd.getOpts()
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.MsgTimeout != nil {
+			return *c.MsgTimeout
+		}
+	}
+	return opts.MsgTimeout
+}
+
+func (q *queueConfig) maxChannelConsumers() int {
+	opts := q.ctx.nsqd.getOpts()
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.MaxChannelConsumers != nil {
+			return int(*c.MaxChannelConsumers)
+		}
+	}
+	return opts.MaxChannelConsumers
+}
+
+func (q *queueConfig) maxDepth() int64 {
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.MaxDepth != nil {
+			return *c.MaxDepth
+		}
+	}
+	return 0
+}
+
+func (q *queueConfig) maxBytes() int64 {
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.MaxBytes != nil {
+			return *c.MaxBytes
+		}
+	}
+	return 0
+}
+
+func (q *queueConfig) overflowPolicy() string {
+	for ; q != nil; q = q.parent {
+		if c := q.Get(); c.OverflowPolicy != nil {
+			return *c.OverflowPolicy
+		}
+	}
+	return overflowReject
+}
+
+// backendMaxMsgSize is the largest message a topic or channel backend accepts,
+// MaxMsgSize can be raised per topic (up to MaxBodySize) after the backend
+// was created
+func backendMaxMsgSize(opts *Options) int32 {
+	maxMsgSize := opts.MaxMsgSize
+	if opts.MaxBodySize > maxMsgSize {
+		maxMsgSize = opts.MaxBodySize
+	}
+	return int32(maxMsgSize) + minValidMsgLength
+}
@@ -0,0 +1,82 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// overflow policies of a topic or channel over its MaxDepth/MaxBytes quota
+const (
+	overflowReject     = "reject"      // publishes fail with E_QUOTA_EXCEEDED
+	overflowDropOldest = "drop-oldest" // the oldest queued messages are dropped
+	overflowDropNewest = "drop-newest" // the new messages are dropped
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+func isValidOverflowPolicy(policy string) bool {
+	switch policy {
+	case overflowReject, overflowDropOldest, overflowDropNewest:
+		return true
+	}
+	return false
+}
+
+// overQuota returns whether queueing n more messages of size bytes on a queue
+// currently holding depth messages of depthBytes would exceed its quota
+func (q *queueConfig) overQuota(depth int64, depthBytes int64, n int64, size int64) bool {
+	maxDepth, maxBytes := q.maxDepth(), q.maxBytes()
+	return (maxDepth > 0 && depth+n > maxDepth) ||
+		(maxBytes > 0 && depthBytes+size > maxBytes)
+}
+
+// subDepthBytes decrements a queue's byte count, which is restored from the
+// metadata on restart and may be off after a crash
+func subDepthBytes(depthBytes *int64, n int64) {
+	for {
+		old := atomic.LoadInt64(depthBytes)
+		v := old - n
+		if v < 0 {
+			v = 0
+		}
+		if atomic.CompareAndSwapInt64(depthBytes, old, v) {
+			return
+		}
+	}
+}
+
+// memoryQueue returns the memory queue a message put on a queue with the given
+// overflow policy may go to, nil when it has to go to the backend
+//
+// a drop-oldest queue writes to its backend as long as it holds any messages,
+// so that the ones in the memory queue are always the oldest
+func memoryQueue(policy string, memoryMsgChan chan *Message, backend BackendQueue) chan *Message {
+	if policy == overflowDropOldest && backend.Depth() > 0 {
+		return nil
+	}
+	return memoryMsgChan
+}
+
+// dropOldestMessage removes the next message of a drop-oldest queue's memory
+// queue, or of its backend once the memory queue is empty (see memoryQueue).
+// The dropped message is nil if it could not be decoded
+func dropOldestMessage(memoryMsgChan chan *Message, backend BackendQueue) (*Message, bool) {
+	select {
+	case msg := <-memoryMsgChan:
+		return msg, true
+	default:
+	}
+	if backend.Depth() == 0 {
+		return nil, false
+	}
+	select {
+	case b := <-backend.ReadChan():
+		msg, err := decodeMessage(b)
+		if err != nil {
+			return nil, true
+		}
+		return msg, true
+	default:
+		return nil, false
+	}
+}
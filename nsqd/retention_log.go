@@ -0,0 +1,441 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nsq/internal/lg"
+)
+
+type retentionSegment struct {
+	seq     int64
+	size    int64
+	count   int64
+	firstTS int64 // Timestamp of the first message in the segment
+	lastTS  int64 // Timestamp of the last message in the segment
+}
+
+// retentionLog keeps a copy of every message a topic has handed to its
+// channels, for as long as the topic's retention window (time and/or bytes)
+// allows, so that channels can be rewound to "messages since T".
+//
+// Messages are appended to numbered segment files of at most MaxBytesPerFile
+// bytes each, every record being len (int32) + message (see Message.WriteTo).
+// Retention is enforced a whole segment at a time, oldest first, on every
+// append and every SyncTimeout (see retentionLoop), which also writes out the
+// buffered appends.
+//
+// Nothing is written while retention is disabled (the default).
+//
+// All methods are safe to call on a nil *retentionLog (ephemeral topics).
+type retentionLog struct {
+	sync.Mutex
+
+	name            string
+	dataPath        string
+	maxBytesPerFile int64
+	retentionTime   time.Duration
+	retentionBytes  int64
+
+	segments []*retentionSegment
+	file     *os.File      // the last segment, opened for appending
+	w        *bufio.Writer // buffers the appends to file
+	buf      bytes.Buffer
+	logf     lg.AppLogFunc
+}
+
+func newRetentionLog(name string, dataPath string, maxBytesPerFile int64, logf lg.AppLogFunc) (*retentionLog, error) {
+	l := &retentionLog{
+		name:            name,
+		dataPath:        dataPath,
+		maxBytesPerFile: maxBytesPerFile,
+		logf:            logf,
+	}
+
+	fileNames, err := filepath.Glob(path.Join(dataPath, name+".retention.*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range fileNames {
+		var seq int64
+		suffix := strings.TrimPrefix(path.Base(fn), name+".retention.")
+		_, err := fmt.Sscanf(suffix, "%d.dat", &seq)
+		if err != nil {
+			continue
+		}
+		seg := &retentionSegment{seq: seq}
+		err = l.scanSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].seq < l.segments[j].seq
+	})
+	return l, nil
+}
+
+func (l *retentionLog) segmentFileName(seq int64) string {
+	return path.Join(l.dataPath, fmt.Sprintf("%s.retention.%06d.dat", l.name, seq))
+}
+
+// scanSegment reads a segment's records to recover its stats, truncating
+// any partial record left at the end by a crash
+func (l *retentionLog) scanSegment(seg *retentionSegment) error {
+	fileName := l.segmentFileName(seg.seq)
+	err := l.readSegment(seg.seq, -1, func(msg *Message, size int64) error {
+		if seg.count == 0 {
+			seg.firstTS = msg.Timestamp
+		}
+		seg.lastTS = msg.Timestamp
+		seg.size += size
+		seg.count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != seg.size {
+		l.logf(LOG_WARN, "RETENTION(%s): truncating corrupt tail of %s", l.name, fileName)
+		return os.Truncate(fileName, seg.size)
+	}
+	return nil
+}
+
+// readSegment calls fn for every complete record in the first limit bytes of
+// a segment (or the whole segment when limit < 0)
+func (l *retentionLog) readSegment(seq int64, limit int64, fn func(*Message, int64) error) error {
+	f, err := os.Open(l.segmentFileName(seq))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// trimmed in the meantime
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var rd io.Reader = f
+	if limit >= 0 {
+		rd = io.LimitReader(f, limit)
+	}
+	r := bufio.NewReader(rd)
+	var header [4]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return nil
+		}
+		size := int32(binary.BigEndian.Uint32(header[:]))
+		if size < minValidMsgLength {
+			return nil
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return nil
+		}
+		err = fn(msg, int64(len(header)+len(data)))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SetRetention updates the retention window, a zero retentionTime and
+// retentionBytes disables retention and removes every retained message
+func (l *retentionLog) SetRetention(retentionTime time.Duration, retentionBytes int64) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	l.retentionTime = retentionTime
+	l.retentionBytes = retentionBytes
+	if !l.enabled() {
+		l.removeSegments(len(l.segments))
+		return
+	}
+	l.trim()
+}
+
+func (l *retentionLog) Retention() (time.Duration, int64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.retentionTime, l.retentionBytes
+}
+
+func (l *retentionLog) enabled() bool {
+	return l.retentionTime > 0 || l.retentionBytes > 0
+}
+
+// Append retains msg if retention is enabled
+func (l *retentionLog) Append(msg *Message) error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.enabled() {
+		return nil
+	}
+
+	l.buf.Reset()
+	l.buf.Write([]byte{0, 0, 0, 0})
+	msg.WriteTo(&l.buf)
+	b := l.buf.Bytes()
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-4))
+	size := int64(len(b))
+
+	var seg *retentionSegment
+	if len(l.segments) > 0 {
+		seg = l.segments[len(l.segments)-1]
+	}
+	if seg == nil || (seg.size > 0 && seg.size+size > l.maxBytesPerFile) {
+		var seq int64
+		if seg != nil {
+			seq = seg.seq + 1
+		}
+		err := l.closeFile()
+		if err != nil {
+			return err
+		}
+		seg = &retentionSegment{seq: seq}
+		l.segments = append(l.segments, seg)
+	}
+	if l.file == nil {
+		f, err := os.OpenFile(l.segmentFileName(seg.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		l.file = f
+		l.w = bufio.NewWriter(f)
+	}
+
+	_, err := l.w.Write(b)
+	if err != nil {
+		return err
+	}
+	if seg.count == 0 {
+		seg.firstTS = msg.Timestamp
+	}
+	seg.lastTS = msg.Timestamp
+	seg.size += size
+	seg.count++
+
+	l.trim()
+	return nil
+}
+
+// trim removes the oldest segments that fall outside of the retention window
+func (l *retentionLog) trim() {
+	var totalBytes int64
+	for _, seg := range l.segments {
+		totalBytes += seg.size
+	}
+	expired := time.Now().Add(-l.retentionTime).UnixNano()
+
+	n := 0
+	for _, seg := range l.segments {
+		if l.retentionBytes > 0 && totalBytes > l.retentionBytes {
+			totalBytes -= seg.size
+			n++
+			continue
+		}
+		if l.retentionTime > 0 && seg.lastTS < expired {
+			totalBytes -= seg.size
+			n++
+			continue
+		}
+		break
+	}
+	l.removeSegments(n)
+}
+
+// removeSegments deletes the n oldest segments
+func (l *retentionLog) removeSegments(n int) {
+	if n == 0 {
+		return
+	}
+	if n == len(l.segments) && l.file != nil {
+		l.file.Close()
+		l.file = nil
+		l.w = nil
+	}
+	for _, seg := range l.segments[:n] {
+		err := os.Remove(l.segmentFileName(seg.seq))
+		if err != nil && !os.IsNotExist(err) {
+			l.logf(LOG_ERROR, "RETENTION(%s): failed to remove segment %d - %s", l.name, seg.seq, err)
+		}
+	}
+	l.segments = append(l.segments[:0], l.segments[n:]...)
+}
+
+// Stats returns the number and size of the retained messages and the
+// Timestamp of the oldest one
+func (l *retentionLog) Stats() (int64, int64, int64) {
+	if l == nil {
+		return 0, 0, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	var count, size, oldest int64
+	for _, seg := range l.segments {
+		if seg.count > 0 && oldest == 0 {
+			oldest = seg.firstTS
+		}
+		count += seg.count
+		size += seg.size
+	}
+	return count, size, oldest
+}
+
+// Replay calls fn, in order, for every retained message with a Timestamp
+// at or after since (nanoseconds since epoch)
+//
+// Only the messages retained when Replay is called are visited.
+func (l *retentionLog) Replay(since int64, fn func(*Message) error) error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	if l.w != nil {
+		err := l.w.Flush()
+		if err != nil {
+			l.Unlock()
+			return err
+		}
+	}
+	segments := make([]retentionSegment, 0, len(l.segments))
+	for _, seg := range l.segments {
+		if seg.lastTS >= since {
+			segments = append(segments, *seg)
+		}
+	}
+	l.Unlock()
+
+	for _, seg := range segments {
+		err := l.readSegment(seg.seq, seg.size, func(msg *Message, _ int64) error {
+			if msg.Timestamp < since {
+				return nil
+			}
+			return fn(msg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes out the buffered appends and removes the segments that
+// expired since the last append
+func (l *retentionLog) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	if !l.enabled() {
+		return nil
+	}
+	l.trim()
+	if l.w == nil {
+		return nil
+	}
+	return l.w.Flush()
+}
+
+// Close closes the segment being appended to
+func (l *retentionLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	return l.closeFile()
+}
+
+// closeFile flushes, syncs and closes the segment being appended to
+func (l *retentionLog) closeFile() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if err == nil {
+		err = l.file.Sync()
+	}
+	l.file.Close()
+	l.file = nil
+	l.w = nil
+	return err
+}
+
+// Delete removes every segment from disk
+func (l *retentionLog) Delete() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	l.removeSegments(len(l.segments))
+	return nil
+}
+
+// retentionLoop periodically writes out the retention logs' buffered appends
+// and expires their old segments, even on topics without publishes
+func (n *NSQD) retentionLoop() {
+	ticker := time.NewTicker(n.getOpts().SyncTimeout)
+	for {
+		select {
+		case <-ticker.C:
+			n.RLock()
+			topics := make([]*Topic, 0, len(n.topicMap))
+			for _, t := range n.topicMap {
+				topics = append(topics, t)
+			}
+			n.RUnlock()
+			for _, t := range topics {
+				err := t.retention.Flush()
+				if err != nil {
+					n.logf(LOG_ERROR, "TOPIC(%s): failed to flush retention log - %s", t.name, err)
+				}
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logf(LOG_INFO, "RETENTION: closing")
+	ticker.Stop()
+}
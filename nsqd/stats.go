@@ -4,6 +4,7 @@ import (
 	"runtime"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"nsq/internal/quantile"
 )
@@ -17,10 +18,29 @@ type TopicStats struct {
 	MessageBytes uint64         `json:"message_bytes"`
 	Paused       bool           `json:"paused"`
 
+	DedupeHitCount uint64 `json:"dedupe_hit_count"`
+
+	DepthBytes         int64  `json:"depth_bytes"`
+	QuotaRejectedCount uint64 `json:"quota_rejected_count"`
+	QuotaDroppedCount  uint64 `json:"quota_dropped_count"`
+
+	RetentionTime  int64 `json:"retention_time"`
+	RetentionBytes int64 `json:"retention_bytes"`
+	RetainedCount  int64 `json:"retained_count"`
+	RetainedBytes  int64 `json:"retained_bytes"`
+
+	IdleExpiresAt int64 `json:"idle_expires_at,omitempty"`
+
+	Config QueueConfig `json:"config"`
+
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	retentionTime, retentionBytes := t.Retention()
+	retainedCount, retainedBytes, _ := t.retention.Stats()
+	opts := t.ctx.nsqd.getOpts()
+
 	return TopicStats{
 		TopicName:    t.name,
 		Channels:     channels,
@@ -30,6 +50,21 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 		MessageBytes: atomic.LoadUint64(&t.messageBytes),
 		Paused:       t.IsPaused(),
 
+		DedupeHitCount: atomic.LoadUint64(&t.dedupeHitCount),
+
+		DepthBytes:         t.DepthBytes(),
+		QuotaRejectedCount: atomic.LoadUint64(&t.quotaRejects),
+		QuotaDroppedCount:  atomic.LoadUint64(&t.quotaDrops),
+
+		RetentionTime:  int64(retentionTime),
+		RetentionBytes: retentionBytes,
+		RetainedCount:  retainedCount,
+		RetainedBytes:  retainedBytes,
+
+		IdleExpiresAt: idleExpiresAt(opts, atomic.LoadInt64(&t.idleSince), opts.TopicIdleTimeout),
+
+		Config: t.Config(),
+
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
 }
@@ -47,6 +82,26 @@ type ChannelStats struct {
 	Clients       []ClientStats `json:"clients"`
 	Paused        bool          `json:"paused"`
 
+	MaxAttempts     uint16 `json:"max_attempts"`
+	DeadLetterTopic string `json:"dead_letter_topic"`
+	DeadLetterCount uint64 `json:"dead_letter_count"`
+
+	Filter        string `json:"filter"`
+	FilteredCount uint64 `json:"filtered_count"`
+
+	Ordered   bool `json:"ordered"`
+	HeldCount int  `json:"held_count"`
+
+	DepthBytes        int64  `json:"depth_bytes"`
+	QuotaDroppedCount uint64 `json:"quota_dropped_count"`
+
+	OldestMessageTimestamp int64         `json:"oldest_message_timestamp"`
+	OldestMessageAge       time.Duration `json:"oldest_message_age"`
+
+	IdleExpiresAt int64 `json:"idle_expires_at,omitempty"`
+
+	Config QueueConfig `json:"config"`
+
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
@@ -57,6 +112,16 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 	c.deferredMutex.Lock()
 	deferred := len(c.deferredMessages)
 	c.deferredMutex.Unlock()
+	maxAttempts, deadLetterTopic := c.DeadLetter()
+	opts := c.ctx.nsqd.getOpts()
+	var oldestAge time.Duration
+	oldest := c.OldestMessageTimestamp()
+	if oldest > 0 {
+		oldestAge = time.Duration(time.Now().UnixNano() - oldest)
+		if oldestAge < 0 {
+			oldestAge = 0
+		}
+	}
 
 	return ChannelStats{
 		ChannelName:   c.name,
@@ -71,6 +136,26 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 		Clients:       clients,
 		Paused:        c.IsPaused(),
 
+		MaxAttempts:     maxAttempts,
+		DeadLetterTopic: deadLetterTopic,
+		DeadLetterCount: atomic.LoadUint64(&c.deadLetterCount),
+
+		Filter:        c.Filter(),
+		FilteredCount: atomic.LoadUint64(&c.filteredCount),
+
+		Ordered:   c.Ordered(),
+		HeldCount: c.HeldCount(),
+
+		DepthBytes:        c.DepthBytes(),
+		QuotaDroppedCount: atomic.LoadUint64(&c.quotaDrops),
+
+		OldestMessageTimestamp: oldest,
+		OldestMessageAge:       oldestAge,
+
+		IdleExpiresAt: idleExpiresAt(opts, atomic.LoadInt64(&c.idleSince), opts.ChannelIdleTimeout),
+
+		Config: c.Config(),
+
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"strconv"
 	"time"
 
 	"nsq/internal/statsd"
@@ -45,6 +46,9 @@ func (n *NSQD) statsdLoop() {
 			sw := writers.NewSpreadWriter(conn, interval-time.Second, n.exitChan)
 			bw := writers.NewBoundaryBufferedWriter(sw, n.getOpts().StatsdUDPPacketSize) // StatsdUDPPacketSize: 508
 			client := statsd.NewClient(bw, prefix)
+			if n.getOpts().StatsdTags {
+				client = statsd.NewTaggedClient(bw, prefix, "host:"+n.statsdHost())
+			}
 
 			n.logf(LOG_INFO, "STATSD: pushing stats to %s", addr)
 
@@ -58,24 +62,22 @@ func (n *NSQD) statsdLoop() {
 						break
 					}
 				}
+				topicClient := statsdTopicClient(client, topic.TopicName)
+
 				diff := topic.MessageCount - lastTopic.MessageCount
-				stat := fmt.Sprintf("topic.%s.message_count", topic.TopicName)
-				client.Incr(stat, int64(diff))
+				topicClient.Incr("message_count", int64(diff))
 
 				diff = topic.MessageBytes - lastTopic.MessageBytes
-				stat = fmt.Sprintf("topic.%s.message_bytes", topic.TopicName)
-				client.Incr(stat, int64(diff))
+				topicClient.Incr("message_bytes", int64(diff))
 
-				stat = fmt.Sprintf("topic.%s.depth", topic.TopicName)
-				client.Gauge(stat, topic.Depth)
+				topicClient.Gauge("depth", topic.Depth)
 
-				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
-				client.Gauge(stat, topic.BackendDepth)
+				topicClient.Gauge("backend_depth", topic.BackendDepth)
 
 				for _, item := range topic.E2eProcessingLatency.Percentiles {
-					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
+					stat := fmt.Sprintf("e2e_processing_latency_%.0f", item["quantile"]*100.0)
 					//我们可以将该值转换为int64，因为值1是我们将拥有的最小分辨率，所以不存在精度损失
-					client.Gauge(stat, int64(item["value"]))
+					topicClient.Gauge(stat, int64(item["value"]))
 				}
 
 				for _, channel := range topic.Channels { // channel 统计信息
@@ -87,36 +89,35 @@ func (n *NSQD) statsdLoop() {
 							break
 						}
 					}
+					channelClient := statsdChannelClient(client, topic.TopicName, channel.ChannelName)
+
 					diff := channel.MessageCount - lastChannel.MessageCount
-					stat := fmt.Sprintf("topic.%s.channel.%s.message_count", topic.TopicName, channel.ChannelName)
-					client.Incr(stat, int64(diff))
+					channelClient.Incr("message_count", int64(diff))
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.depth", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, channel.Depth)
+					channelClient.Gauge("depth", channel.Depth)
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, channel.BackendDepth)
+					channelClient.Gauge("backend_depth", channel.BackendDepth)
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, int64(channel.InFlightCount))
+					channelClient.Gauge("in_flight_count", int64(channel.InFlightCount))
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.deferred_count", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, int64(channel.DeferredCount))
+					channelClient.Gauge("deferred_count", int64(channel.DeferredCount))
 
 					diff = channel.RequeueCount - lastChannel.RequeueCount
-					stat = fmt.Sprintf("topic.%s.channel.%s.requeue_count", topic.TopicName, channel.ChannelName)
-					client.Incr(stat, int64(diff))
+					channelClient.Incr("requeue_count", int64(diff))
 
 					diff = channel.TimeoutCount - lastChannel.TimeoutCount
-					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
-					client.Incr(stat, int64(diff))
+					channelClient.Incr("timeout_count", int64(diff))
+
+					diff = channel.DeadLetterCount - lastChannel.DeadLetterCount
+					channelClient.Incr("dead_letter_count", int64(diff))
 
-					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, int64(channel.ClientCount))
+					channelClient.Gauge("clients", int64(channel.ClientCount))
+
+					channelClient.Gauge("oldest_message_age", int64(channel.OldestMessageAge/time.Millisecond))
 
 					for _, item := range channel.E2eProcessingLatency.Percentiles {
-						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", topic.TopicName, channel.ChannelName, item["quantile"]*100.0)
-						client.Gauge(stat, int64(item["value"]))
+						stat := fmt.Sprintf("e2e_processing_latency_%.0f", item["quantile"]*100.0)
+						channelClient.Gauge(stat, int64(item["value"]))
 					}
 				}
 			}
@@ -149,6 +150,31 @@ exit:
 	n.logf(LOG_INFO, "STATSD: closing")
 }
 
+// statsdTopicClient returns a client sending the stats of topicName, as
+// "topic.<topic>.<stat>" or, with tags, as "topic.<stat>" tagged with the topic
+func statsdTopicClient(client *statsd.Client, topicName string) *statsd.Client {
+	if client.Tagged() {
+		return client.With("topic.", "topic:"+topicName)
+	}
+	return client.With(fmt.Sprintf("topic.%s.", topicName))
+}
+
+// statsdChannelClient returns a client sending the stats of channelName, as
+// "topic.<topic>.channel.<channel>.<stat>" or, with tags, as "channel.<stat>"
+// tagged with the topic and channel
+func statsdChannelClient(client *statsd.Client, topicName string, channelName string) *statsd.Client {
+	if client.Tagged() {
+		return client.With("channel.", "topic:"+topicName, "channel:"+channelName)
+	}
+	return client.With(fmt.Sprintf("topic.%s.channel.%s.", topicName, channelName))
+}
+
+// statsdHost is the value of the host tag, the broadcast address and HTTP port
+func (n *NSQD) statsdHost() string {
+	port := strconv.Itoa(n.RealHTTPAddr().Port)
+	return net.JoinHostPort(n.getOpts().BroadcastAddress, port)
+}
+
 func percentile(perc float64, arr []uint64, length int) uint64 {
 	if length == 0 {
 		return 0
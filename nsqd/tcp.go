@@ -14,7 +14,12 @@ type tcpServer struct {
 //由此可见p.ctx.nsqd是一个全局的结构体，运行的所有的服务（topic/channel的一切行为）都是在p.ctx.nsqd创建之后，所以他能被所有服务使用。
 func (p *tcpServer) Handle(clientConn net.Conn) {
 	p.ctx.nsqd.logf(LOG_INFO, "TCP: new client(%s)", clientConn.RemoteAddr())
+	p.handleProtocol(clientConn)
+}
 
+// handleProtocol serves a client connection from its protocol magic on, for
+// TCP clients and the WebSockets of the HTTP server alike
+func (p *tcpServer) handleProtocol(clientConn net.Conn) {
 	//nsq已经和客户端约定了必须要发送4字节的protocolMagic来表明使用的协议版本。
 	buf := make([]byte, 4)
 	//因为一般的read就算没有读到指定长度也会返回，一般需要循环读取，所以此处用ReadFull表示必须读到指定长度的数据后再返回。
@@ -20,14 +20,24 @@ import (
 //每一个topic后面会有一个消息协程负责处理这个topic的事务。
 type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	messageCount uint64 // 此 topic 所包含的消息的总数（内存+磁盘）
-	messageBytes uint64 // 此 topic 所包含的消息的总大小（内存+磁盘）
+	messageCount   uint64 // 此 topic 所包含的消息的总数（内存+磁盘）
+	messageBytes   uint64 // 此 topic 所包含的消息的总大小（内存+磁盘）
+	dedupeHitCount uint64 // 因 dedupe key 重复而被忽略的发布次数
+	depthBytes     int64  // 队列中（内存+磁盘）消息体的总大小，重启后从元数据恢复
+	quotaRejects   uint64 // 因超出配额而被拒绝的发布次数
+	quotaDrops     uint64 // 因超出配额而被丢弃的消息数
+
+	idleSince        int64  // 开始空闲（无 channel 且无发布）的时间（UnixNano），活跃时为 0
+	idleMessageCount uint64 // 上次空闲检查时的 messageCount，用于发现其间的发布
 
 	sync.RWMutex //读写channel的时候要用到的锁
 
 	name              string
 	channelMap        map[string]*Channel   //最主要的变量在于channelMap，这是这个topic拥有的所有channel集合。
 	backend           BackendQueue          //backend是对应的持久化磁盘存储的队列。用interface表示一个结构体和方法的集合，只要实现了这个接口中的方法，那么就是BackendQueue。
+	retention         *retentionLog         // 已投递给 channel 的消息的保留日志，用于 channel 回放（ephemeral topic 为 nil）
+	dedupe            *dedupeWindow         // 最近发布时使用过的 dedupe key
+	config            *queueConfig          // 此 topic 覆盖的配置项，channel 未覆盖的项从这里继承
 	memoryMsgChan     chan *Message         //memoryMsgChan 是这个topic对应的内存队列，即消息在内存中的通道
 	startChan         chan int              // 消息处理循环开关
 	exitChan          chan int              // topic 消息处理循环退出开关
@@ -50,12 +60,13 @@ type Topic struct {
 // 其一，nsqd.Start->nsqd.LoadMetadata->nsqd.GetTopic->NewTopic；
 // 其二，httpServer.getTopicFromQuery->nsqd.GetTopic->NewTopic；
 // 其三，protocolV2.PUB/SUB->nsqd.GetTopic这三条调用路径。
-func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topic {
+func NewTopic(topicName string, config QueueConfig, ctx *context, deleteCallback func(*Topic)) *Topic {
 	//初始化一个topic结构，并且设置其backend持久化结构，然后开启消息监听协程messagePump,处理消息。
+	qc := newQueueConfig(ctx, nil, config)
 	t := &Topic{
 		name:              topicName,
 		channelMap:        make(map[string]*Channel),
-		memoryMsgChan:     make(chan *Message, ctx.nsqd.getOpts().MemQueueSize),
+		memoryMsgChan:     make(chan *Message, qc.memQueueSize()),
 		startChan:         make(chan int, 1), //卧槽竟然是缓冲channel
 		exitChan:          make(chan int),    //make(chan int, 0)和make(chan int)有没有区别
 		channelUpdateChan: make(chan int),
@@ -64,6 +75,8 @@ func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topi
 		pauseChan:         make(chan int),
 		deleteCallback:    deleteCallback, //topic删除函数，其实是DeleteExistingTopic
 		idFactory:         NewGUIDFactory(ctx.nsqd.getOpts().ID),
+		dedupe:            newDedupeWindow(ctx.nsqd.getOpts().DedupeWindow, ctx.nsqd.getOpts().MaxDedupeKeys),
+		config:            qc,
 	}
 	//HasPrefix检查字符串前缀开头，HasSuffix检查字符串后缀结尾。
 	if strings.HasSuffix(topicName, "#ephemeral") { //临时topic以#ephemeral开头，没有持久化机制，只放入内存中，所以其backend其实是个黑洞，直接丢掉
@@ -80,14 +93,21 @@ func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topi
 		//diskQueue是从nsq项目中抽取而来，将它单独作为一个项目go-diskqueue。它本身比较简单，只有一个源文件diskqueue.go。
 		t.backend = diskqueue.New( //注意这个diskQueue是一个私有的，必须通过其自带方法才能访问。小写都是针对包而言的，所有的小写都不能被其他包访问，但是能被本包访问。这里的New是大写，也就是说通过暴露出来的方法来操作包的私有化变量。
 			topicName,
-			ctx.nsqd.getOpts().DataPath,        // 数据存储路径，当前目录或指定的目录
-			ctx.nsqd.getOpts().MaxBytesPerFile, // 存储文件的最大字节数
-			int32(minValidMsgLength),           // 最小的有效消息的长度
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength, // 最大的有效消息的长度
-			ctx.nsqd.getOpts().SyncEvery,                           // 单次同步刷新消息的数量，即当消息数量达到 SyncEvery 的数量时，需要执行刷新动作（否则会留在操作系统缓冲区）
-			ctx.nsqd.getOpts().SyncTimeout,                         // 两次同步刷新的时间间隔，即两次同步操作的最大间隔
-			dqLogf,                                                 // 日志
+			ctx.nsqd.getOpts().DataPath,           // 数据存储路径，当前目录或指定的目录
+			ctx.nsqd.getOpts().MaxBytesPerFile,    // 存储文件的最大字节数
+			int32(minValidMsgLength),              // 最小的有效消息的长度
+			backendMaxMsgSize(ctx.nsqd.getOpts()), // 最大的有效消息的长度
+			qc.syncEvery(),                        // 单次同步刷新消息的数量，即当消息数量达到 SyncEvery 的数量时，需要执行刷新动作（否则会留在操作系统缓冲区）
+			ctx.nsqd.getOpts().SyncTimeout,        // 两次同步刷新的时间间隔，即两次同步操作的最大间隔
+			dqLogf,                                // 日志
 		)
+
+		var err error
+		t.retention, err = newRetentionLog(topicName, ctx.nsqd.getOpts().DataPath,
+			ctx.nsqd.getOpts().MaxBytesPerFile, ctx.nsqd.logf)
+		if err != nil {
+			ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to open retention log - %s", t.name, err)
+		}
 	}
 
 	t.waitGroup.Wrap(t.messagePump) //异步开启消息监听循环messagePump协程，这是最重要的一步。阻塞等待被唤醒。
@@ -113,8 +133,19 @@ func (t *Topic) Exiting() bool {
 // for the given Topic
 // 根据 channel 名称返回 channel 实例，且有可能是新建的。线程安全方法。
 func (t *Topic) GetChannel(channelName string) *Channel {
+	channel, _ := t.getChannel(channelName, QueueConfig{}, nil)
+	return channel
+}
+
+// getChannel is GetChannel with the config overrides and the filter (if any)
+// of a new channel, it also returns whether the channel is new
+func (t *Topic) getChannel(channelName string, config QueueConfig, filter *msgFilter) (*Channel, bool) {
 	t.Lock()
-	channel, isNew := t.getOrCreateChannel(channelName) //拿到channel
+	channel, isNew := t.getOrCreateChannel(channelName, config) //拿到channel
+	if isNew && filter != nil {
+		// before the messagePump sends it any message
+		channel.SetFilter(filter)
+	}
 	t.Unlock()
 
 	if isNew {
@@ -127,12 +158,12 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 		}
 	}
 
-	return channel
+	return channel, isNew
 }
 
 // this expects the caller to handle locking
 // 根据 channel 名称获取指定的 channel，若不存在，则创建一个新的 channel 实例。非线程安全
-func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
+func (t *Topic) getOrCreateChannel(channelName string, config QueueConfig) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName] //获取一个channel，如果没有就新建它
 	//调用方已经对topic加锁了t.Lock()， 所以不需要加锁
 	if !ok {
@@ -141,7 +172,7 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			t.DeleteExistingChannel(c.name)
 		}
 		//不存在，初始化一个channel，设置持久化结构等
-		channel = NewChannel(t.name, channelName, t.ctx, deleteCallback) //NewChannel新建流程比较简单，也没有topic那种创建后端异步队列的流程
+		channel = NewChannel(t.name, channelName, newQueueConfig(t.ctx, t.config, config), t.ctx, deleteCallback) //NewChannel新建流程比较简单，也没有topic那种创建后端异步队列的流程
 		t.channelMap[channelName] = channel
 		t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -194,11 +225,32 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 // 此方法由 httpServer.PUB 或 protocolV2.PUB 方法中调用，即生产者通过 http/tcp 投递消息到 topic
 //消息的发送操作是二进制的TCP PUB或者http的“/pub?topic=testtopic” 接口，后面其实都是调用的(t *Topic) PutMessage函数去真正发送一条消息到一个topic。
 func (t *Topic) PutMessage(m *Message) error {
+	return t.putMessage(m, true)
+}
+
+// putDeadLetter writes a message dead-lettered by one of nsqd's channels, it
+// is moved rather than published so the DiskHardLimit guard does not apply
+func (t *Topic) putDeadLetter(m *Message) error {
+	return t.putMessage(m, false)
+}
+
+// errExiting is returned by the publishes to a topic being closed or deleted
+var errExiting = errors.New("exiting")
+
+func (t *Topic) putMessage(m *Message, checkDiskSpace bool) error {
 	t.RLock()
 	defer t.RUnlock()
 	//简单看一下是不是我们正在退出状态，如果是就直接返回。这里使用了一个atomic Int32类型的exitFlag退出标志。
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+		return errExiting
+	}
+	if checkDiskSpace {
+		if err := t.checkDiskSpace(); err != nil {
+			return err
+		}
+	}
+	if ok, err := t.checkQuota(1, int64(len(m.Body))); !ok {
+		return err
 	}
 	//真正的发送消息函数是put, 我们知道topic存储目标有2个，一个原生内存管道memoryMsgChan，另外一个是持久化存储backend。怎么判别呢？
 	// 答案就是先看memoryMsgChan是否已经满了，如果满了就不能继续塞了，那就存到后端持久化存储里面去。
@@ -218,10 +270,20 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	t.RLock()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+		return errExiting
+	}
+	if err := t.checkDiskSpace(); err != nil {
+		return err
 	}
 
 	messageTotalBytes := 0
+	for _, m := range msgs {
+		messageTotalBytes += len(m.Body)
+	}
+	if ok, err := t.checkQuota(int64(len(msgs)), int64(messageTotalBytes)); !ok {
+		return err
+	}
+	messageTotalBytes = 0
 
 	for i, m := range msgs {
 		err := t.put(m)
@@ -238,20 +300,51 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	return nil
 }
 
+// PutMessageDedupe writes a Message to the queue unless dedupeKey was already
+// published to this topic within the dedupe window, returning whether it
+// was a duplicate. An empty dedupeKey disables the check.
+func (t *Topic) PutMessageDedupe(m *Message, dedupeKey string) (bool, error) {
+	return t.putDedupe(dedupeKey, func() error { return t.PutMessage(m) })
+}
+
+// PutMessagesDedupe is PutMessageDedupe for a batch, the key covers all msgs
+func (t *Topic) PutMessagesDedupe(msgs []*Message, dedupeKey string) (bool, error) {
+	return t.putDedupe(dedupeKey, func() error { return t.PutMessages(msgs) })
+}
+
+func (t *Topic) putDedupe(dedupeKey string, put func() error) (bool, error) {
+	if dedupeKey == "" {
+		return false, put()
+	}
+	if t.dedupe.Acquire(dedupeKey) {
+		atomic.AddUint64(&t.dedupeHitCount, 1)
+		return true, nil
+	}
+	err := put()
+	// 发布成功后才记录 key，发布失败则允许客户端用同一个 key 重试
+	t.dedupe.Release(dedupeKey, err == nil)
+	return false, err
+}
+
 //这里memoryMsgChan的大小我们可以通过--mem-queue-size参数来设置，上面这段代码的流程是如果memoryMsgChan还没有满的话
 //就把消息放到memoryMsgChan中，否则就放到backend(disk)中。
 func (t *Topic) put(m *Message) error {
 	// 这里巧妙利用了 chan 的特性
 	// 先写入memoryMsgChan这个队列,假如 memoryMsgChan已满, 不可写入
-	// golang 就会执行 default 语句,
+	// 就写入 backend,
 	//无论是memoryMsgChan还是backend中的消息，都在topic的messagePump中被读取到各个channel中去。
+	// 先计入队列大小，避免 messagePump 在计入前就已取走这条消息
+	atomic.AddInt64(&t.depthBytes, int64(len(m.Body)))
 	select {
-	case t.memoryMsgChan <- m: //将这条消息直接塞入内存管道，mesasgePump开始处理。
+	case memoryQueue(t.config.overflowPolicy(), t.memoryMsgChan, t.backend) <- m: //将这条消息直接塞入内存管道，mesasgePump开始处理。
 	default: //如果内存消息管道满了(memoryMsgChan的容量由 getOpts().MemQueueSize设置)，那么就放入到后面的持久化存储里面
 		b := bufferPoolGet()                          //从缓冲池中获取缓冲，可复用buffer，减少对象生成，阅读一下sync.Pool包
 		err := writeMessageToBackend(b, m, t.backend) //将消息写入持久化消息队列，backend是创建topic的时候建立的diskqueue
 		bufferPoolPut(b)                              // 将buffer放回缓存池
 		t.ctx.nsqd.SetHealth(err)                     //调用SetHealth函数将writeMessageToBackend的返回值写入errValue变量。
+		if err != nil || t.ephemeral {
+			subDepthBytes(&t.depthBytes, int64(len(m.Body)))
+		}
 		if err != nil {
 			t.ctx.nsqd.logf(LOG_ERROR,
 				"TOPIC(%s) ERROR: failed to write message to backend - %s",
@@ -262,10 +355,120 @@ func (t *Topic) put(m *Message) error {
 	return nil
 }
 
+// SetRetention sets how long (retentionTime) and/or how much (retentionBytes)
+// of the messages delivered to this topic's channels is kept around for
+// RewindChannel, zero for both disables retention
+func (t *Topic) SetRetention(retentionTime time.Duration, retentionBytes int64) {
+	t.retention.SetRetention(retentionTime, retentionBytes)
+}
+
+func (t *Topic) Retention() (time.Duration, int64) {
+	return t.retention.Retention()
+}
+
+// Config returns the topic's configuration overrides
+func (t *Topic) Config() QueueConfig {
+	return t.config.Get()
+}
+
+// SetConfig replaces the topic's configuration overrides
+func (t *Topic) SetConfig(config QueueConfig) {
+	t.config.Set(config)
+}
+
+// RewindChannel empties the channel and then re-queues every retained message
+// with a Timestamp at or after since (nanoseconds since epoch), returning the
+// number of messages re-queued
+//
+// Messages being delivered while rewinding may be received twice.
+func (t *Topic) RewindChannel(channelName string, since int64) (int64, error) {
+	channel, err := t.GetExistingChannel(channelName)
+	if err != nil {
+		return 0, err
+	}
+	err = channel.Empty()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err = t.retention.Replay(since, func(msg *Message) error {
+		err := channel.PutMessage(msg)
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): rewound channel(%s) to %s (%d messages)",
+		t.name, channelName, time.Unix(0, since), count)
+	return count, err
+}
+
 func (t *Topic) Depth() int64 {
 	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
 }
 
+// DepthBytes returns the size of the message bodies queued
+func (t *Topic) DepthBytes() int64 {
+	return atomic.LoadInt64(&t.depthBytes)
+}
+
+// restoreDepthBytes accounts for the size of the messages left in the backend
+// by a previous run
+func (t *Topic) restoreDepthBytes(n int64) {
+	if t.backend.Depth() > 0 {
+		atomic.StoreInt64(&t.depthBytes, n)
+	}
+}
+
+// checkDiskSpace returns errDiskFull when the DataPath volume is too full to
+// publish to this (non-ephemeral) topic
+func (t *Topic) checkDiskSpace() error {
+	if t.ephemeral {
+		return nil
+	}
+	return t.ctx.nsqd.diskSpaceErr()
+}
+
+// checkQuota applies the topic's and its channels' quotas to a publish of n
+// messages of size bytes, returning false when they are not to be queued
+// (with errQuotaExceeded when rejected)
+//
+// this expects the caller to handle locking
+func (t *Topic) checkQuota(n int64, size int64) (bool, error) {
+	for _, c := range t.channelMap {
+		if c.config.overflowPolicy() == overflowReject && c.overQuota(n, size) {
+			atomic.AddUint64(&t.quotaRejects, 1)
+			return false, errQuotaExceeded
+		}
+	}
+
+	if !t.config.overQuota(t.Depth(), t.DepthBytes(), n, size) {
+		return true, nil
+	}
+	switch t.config.overflowPolicy() {
+	case overflowDropNewest:
+		atomic.AddUint64(&t.quotaDrops, uint64(n))
+		return false, nil
+	case overflowDropOldest:
+		for t.config.overQuota(t.Depth(), t.DepthBytes(), n, size) {
+			dropped, ok := dropOldestMessage(t.memoryMsgChan, t.backend)
+			if !ok {
+				break
+			}
+			if dropped != nil {
+				subDepthBytes(&t.depthBytes, int64(len(dropped.Body)))
+			}
+			atomic.AddUint64(&t.quotaDrops, 1)
+		}
+		return true, nil
+	default:
+		atomic.AddUint64(&t.quotaRejects, 1)
+		return false, errQuotaExceeded
+	}
+}
+
 // messagePump selects over the in-memory and backend queue and
 // writes messages to every channel for this topic
 //当通过http或TCP来PUB消息的时候，会把消息写到topic的memoryMsgChan或Backend，然后通知Topic的messagePump来处理。而Topic的messagePump只在NewTopic的时候会被调用，而调用NewTopic有3条路。
@@ -314,12 +517,14 @@ func (t *Topic) messagePump() { //此函数只在NewTopic的时候被调用。
 	for {
 		select { //阻塞在这5个chan
 		case msg = <-memoryMsgChan: //内存队列,注意每个case互不干扰，msg的值不会进入到下面backendChan的case中
+			subDepthBytes(&t.depthBytes, int64(len(msg.Body)))
 		case buf = <-backendChan: //磁盘队列（文件里）
 			msg, err = decodeMessage(buf) //磁盘读出的消息要转换成和内存中一致的消息格式，即message的结构体形式。
 			if err != nil {
 				t.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
 				continue
 			}
+			subDepthBytes(&t.depthBytes, int64(len(msg.Body)))
 		case <-t.channelUpdateChan: //只在channel更新的时候才加锁获取channel,这样就避免了一次循环就加锁获取的低效操作。
 			//上面避免锁竞争, 缓存了这个topic已存在的所有channel。
 			chans = chans[:0]
@@ -350,6 +555,12 @@ func (t *Topic) messagePump() { //此函数只在NewTopic的时候被调用。
 		case <-t.exitChan: // 3.4 当调用 topic.exit 时会收到信号，以终止 topic 的消息处理循环
 			goto exit
 		}
+		err = t.retention.Append(msg)
+		if err != nil {
+			t.ctx.nsqd.logf(LOG_ERROR,
+				"TOPIC(%s) ERROR: failed to retain msg(%s) - %s",
+				t.name, msg.ID, err)
+		}
 		// 3. 往该tpoic对应的每个channel写入message，因为每个 channel 需要一个独立 msg，因此需要在拷贝时需要创建 msg 的副本，针对 msg 是否需要被延时投递来放到不同的队列(如果是deffermessage
 		// 的话放到对应的deffer queue中，否则放到该channel对应的memoryMsgChan中)。
 		for i, channel := range chans { //遍历每个channel,然后将消息一个个发送到channel的流程里面.看到没，此处就是将一条topic的消息多播到多有的channel,然后消费者通过订阅的channel读取，如果一个channel上面有多个consumer，则随机。
@@ -358,6 +569,7 @@ func (t *Topic) messagePump() { //此函数只在NewTopic的时候被调用。
 			if i > 0 {     // 若此 topic 只有一个 channel，则不需要显式地拷贝了，下面就是在显式拷贝。
 				chanMsg = NewMessage(msg.ID, msg.Body)
 				chanMsg.Timestamp = msg.Timestamp
+				chanMsg.Headers = msg.Headers
 				chanMsg.deferred = msg.deferred
 			}
 			// 将 msg push 到 channel 所维护的延时消息队列 deferred queue，等待消息的延时时间走完后，会把消息进一步放入到 in-flight queue 中
@@ -404,7 +616,11 @@ func (t *Topic) exit(deleted bool) error {
 	if !atomic.CompareAndSwapInt32(&t.exitFlag, 0, 1) { // 1. 保证目前还处于运行的状态
 		return errors.New("exiting")
 	}
+	return t.shutdown(deleted)
+}
 
+// shutdown is the rest of exit once the exitFlag is set
+func (t *Topic) shutdown(deleted bool) error {
 	if deleted { // 2. 当被　Delete　调用时，则需要先通知 lookupd 删除其对应的注册信息
 		t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): deleting", t.name)
 
@@ -432,6 +648,7 @@ func (t *Topic) exit(deleted bool) error {
 
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
+		t.retention.Delete()
 		//然后在通知后面的disqqueue进行清理删除
 		return t.backend.Delete()
 	}
@@ -449,6 +666,10 @@ func (t *Topic) exit(deleted bool) error {
 	// write anything leftover to disk
 	//如果还有内存消息没处理完需要写入后端的持久化设备，// 6. 将内存中的消息，即 t.memoryMsgChan 中的消息刷新到持久化存储
 	t.flush()
+	err := t.retention.Close()
+	if err != nil {
+		t.ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to close retention log - %s", t.name, err)
+	}
 	return t.backend.Close()
 }
 
@@ -463,6 +684,7 @@ func (t *Topic) Empty() error {
 	}
 
 finish:
+	atomic.StoreInt64(&t.depthBytes, 0)
 	return t.backend.Empty()
 }
 
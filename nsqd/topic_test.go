@@ -65,6 +65,19 @@ type errorRecoveredBackendQueue struct{ errorBackendQueue }
 
 func (d *errorRecoveredBackendQueue) Put([]byte) error { return nil }
 
+// memoryBackendQueue makes the messages written readable right away
+type memoryBackendQueue struct{ readChan chan []byte }
+
+func (d *memoryBackendQueue) Put(b []byte) error {
+	d.readChan <- append([]byte(nil), b...)
+	return nil
+}
+func (d *memoryBackendQueue) ReadChan() chan []byte { return d.readChan }
+func (d *memoryBackendQueue) Close() error          { return nil }
+func (d *memoryBackendQueue) Delete() error         { return nil }
+func (d *memoryBackendQueue) Depth() int64          { return int64(len(d.readChan)) }
+func (d *memoryBackendQueue) Empty() error          { return nil }
+
 func TestHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -195,6 +208,214 @@ func TestPause(t *testing.T) {
 	test.Equal(t, int64(1), channel.Depth())
 }
 
+func TestDedupeWindowPending(t *testing.T) {
+	d := newDedupeWindow(time.Minute, 10)
+	test.Equal(t, false, d.Acquire("k"))
+
+	// a duplicate waits for the first publish, and takes over if it failed
+	acquired := make(chan bool)
+	go func() {
+		acquired <- d.Acquire("k")
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("duplicate did not wait for the pending publish")
+	case <-time.After(50 * time.Millisecond):
+	}
+	d.Release("k", false)
+	test.Equal(t, false, <-acquired)
+
+	// once published, the key is a duplicate
+	d.Release("k", true)
+	test.Equal(t, true, d.Acquire("k"))
+	test.Equal(t, 1, d.Len())
+}
+
+func TestRetentionRewind(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxBytesPerFile = 50
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_retention" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.SetRetention(time.Hour, 0)
+	channel := topic.GetChannel("ch")
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("retained"))
+		msg.Timestamp = time.Now().Add(time.Duration(i-3) * time.Second).UnixNano()
+		err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		<-channel.memoryMsgChan
+		msgs = append(msgs, msg)
+	}
+
+	count, size, oldest := topic.retention.Stats()
+	test.Equal(t, int64(3), count)
+	test.Equal(t, msgs[0].Timestamp, oldest)
+
+	// rewind to the second message
+	n, err := topic.RewindChannel("ch", msgs[1].Timestamp)
+	test.Nil(t, err)
+	test.Equal(t, int64(2), n)
+	test.Equal(t, int64(2), channel.Depth())
+	test.Equal(t, msgs[1].ID, (<-channel.memoryMsgChan).ID)
+	test.Equal(t, msgs[2].ID, (<-channel.memoryMsgChan).ID)
+
+	// the byte limit drops the oldest segments (one message per segment)
+	topic.SetRetention(time.Hour, size-1)
+	count, _, oldest = topic.retention.Stats()
+	test.Equal(t, int64(2), count)
+	test.Equal(t, msgs[1].Timestamp, oldest)
+
+	// disabling retention drops everything
+	topic.SetRetention(0, 0)
+	count, _, _ = topic.retention.Stats()
+	test.Equal(t, int64(0), count)
+}
+
+func TestRetentionExpiry(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_retention_expiry" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.SetRetention(time.Second, 0)
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("retained"))
+	test.Nil(t, topic.PutMessage(msg))
+	<-channel.memoryMsgChan
+
+	// the buffered append is replayed
+	n, err := topic.RewindChannel("ch", 0)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), n)
+
+	// and expires without any further publish
+	time.Sleep(1100 * time.Millisecond)
+	test.Nil(t, topic.retention.Flush())
+	count, _, _ := topic.retention.Stats()
+	test.Equal(t, int64(0), count)
+}
+
+func TestTopicQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_quota" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	maxDepth := int64(2)
+	policy := overflowReject
+	topic.SetConfig(QueueConfig{MaxDepth: &maxDepth, OverflowPolicy: &policy})
+
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), []byte("test")))
+	}
+	test.Nil(t, topic.PutMessage(msgs[0]))
+	test.Nil(t, topic.PutMessage(msgs[1]))
+	test.Equal(t, errQuotaExceeded, topic.PutMessage(msgs[2]))
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, int64(8), topic.DepthBytes())
+
+	policy = overflowDropNewest
+	topic.SetConfig(QueueConfig{MaxDepth: &maxDepth, OverflowPolicy: &policy})
+	test.Nil(t, topic.PutMessage(msgs[2]))
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, msgs[0].ID, (<-topic.memoryMsgChan).ID)
+	test.Equal(t, msgs[1].ID, (<-topic.memoryMsgChan).ID)
+
+	policy = overflowDropOldest
+	topic.SetConfig(QueueConfig{MaxDepth: &maxDepth, OverflowPolicy: &policy})
+	for _, msg := range msgs {
+		test.Nil(t, topic.PutMessage(msg))
+	}
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, msgs[1].ID, (<-topic.memoryMsgChan).ID)
+	test.Equal(t, msgs[2].ID, (<-topic.memoryMsgChan).ID)
+
+	stats := NewTopicStats(topic, nil)
+	test.Equal(t, uint64(1), stats.QuotaRejectedCount)
+	test.Equal(t, uint64(2), stats.QuotaDroppedCount)
+
+	// a rejecting channel over its quota rejects the topic's publishes
+	topic.SetConfig(QueueConfig{})
+	channel := topic.GetChannel("ch")
+	maxBytes := int64(4)
+	policy = overflowReject
+	channel.SetConfig(QueueConfig{MaxBytes: &maxBytes, OverflowPolicy: &policy})
+	test.Nil(t, channel.PutMessage(msgs[0]))
+	test.Equal(t, errQuotaExceeded, topic.PutMessage(msgs[1]))
+	channel.dequeued(<-channel.memoryMsgChan)
+	test.Equal(t, int64(0), channel.DepthBytes())
+	test.Nil(t, topic.PutMessage(msgs[1]))
+}
+
+func TestTopicDropOldest(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_drop_oldest" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	backend := &memoryBackendQueue{readChan: make(chan []byte, 10)}
+	topic.backend = backend
+
+	maxDepth := int64(2)
+	policy := overflowDropOldest
+	topic.SetConfig(QueueConfig{MaxDepth: &maxDepth, OverflowPolicy: &policy})
+
+	newMsg := func() *Message {
+		return NewMessage(topic.GenerateID(), []byte("test"))
+	}
+	backendMsg := func() *Message {
+		msg, err := decodeMessage(<-backend.readChan)
+		test.Nil(t, err)
+		return msg
+	}
+
+	msgs := []*Message{newMsg(), newMsg(), newMsg(), newMsg()}
+	test.Nil(t, topic.PutMessage(msgs[0]))
+	test.Nil(t, topic.PutMessage(msgs[1]))
+
+	// the memory queue holds the oldest message, the new one goes to the
+	// backend behind the older ones
+	test.Nil(t, topic.PutMessage(msgs[2]))
+	test.Equal(t, 0, len(topic.memoryMsgChan))
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, int64(8), topic.DepthBytes())
+
+	// then the backend does
+	test.Nil(t, topic.PutMessage(msgs[3]))
+	test.Equal(t, int64(2), topic.Depth())
+	test.Equal(t, int64(8), topic.DepthBytes())
+	test.Equal(t, msgs[2].ID, backendMsg().ID)
+	test.Equal(t, msgs[3].ID, backendMsg().ID)
+
+	// the memory queue is used again once the backend is empty
+	topic.Empty()
+	test.Nil(t, topic.PutMessage(newMsg()))
+	test.Equal(t, 1, len(topic.memoryMsgChan))
+
+	stats := NewTopicStats(topic, nil)
+	test.Equal(t, uint64(2), stats.QuotaDroppedCount)
+}
+
 func BenchmarkTopicPut(b *testing.B) {
 	b.StopTimer()
 	topicName := "bench_topic_put" + strconv.Itoa(b.N)
@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 
 	"nsq/internal/http_api"
+	"nsq/internal/prometheus"
 	"nsq/internal/protocol"
 	"nsq/internal/version"
 
@@ -36,6 +37,7 @@ func newHTTPServer(ctx *Context) *httpServer {
 	//Decorate是个装饰器，第一个参数为需要被装饰的视图函数，从第二参数开始，都是装饰函数，最后返回装饰好的视图函数
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText)) //心跳检测，返回OK
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))             //获取版本信息
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, log, http_api.PlainText))
 
 	// v1 negotiate
 	router.Handle("GET", "/debug", http_api.Decorate(s.doDebug, log, http_api.V1))
@@ -334,6 +336,39 @@ func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request, ps httpro
 	}, nil
 }
 
+// doMetrics serves the registrations in the Prometheus text format
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	db := s.ctx.nsqlookupd.DB
+	opts := s.ctx.nsqlookupd.opts
+	e := prometheus.NewEncoder("nsqlookupd_")
+
+	producers := db.FindProducers("client", "", "").FilterByActive(opts.InactiveProducerTimeout, 0)
+	e.Gauge("producers", "Number of active nsqd nodes.", float64(len(producers)))
+
+	topics := db.FindRegistrations("topic", "*", "").Keys()
+	e.Gauge("topics", "Number of registered topics.", float64(len(topics)))
+	e.Gauge("channels", "Number of registered channels.", float64(len(db.FindRegistrations("channel", "*", "*"))))
+	for _, t := range topics {
+		topic := prometheus.Label{Name: "topic", Value: t}
+		topicProducers := db.FindProducers("topic", t, "")
+		tombstoned := 0
+		for _, p := range topicProducers {
+			if p.IsTombstoned(opts.TombstoneLifetime) {
+				tombstoned++
+			}
+		}
+		active := topicProducers.FilterByActive(opts.InactiveProducerTimeout, opts.TombstoneLifetime)
+		e.Gauge("topic_producers", "Number of active, not tombstoned, nsqd nodes of the topic.", float64(len(active)), topic)
+		e.Gauge("topic_tombstoned_producers", "Number of tombstoned nsqd nodes of the topic.", float64(tombstoned), topic)
+		e.Gauge("topic_channels", "Number of registered channels of the topic.",
+			float64(len(db.FindRegistrations("channel", t, "*"))), topic)
+	}
+
+	e.Runtime()
+	w.Header().Set("Content-Type", prometheus.ContentType)
+	return e.Bytes(), nil
+}
+
 func (s *httpServer) doDebug(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	s.ctx.nsqlookupd.DB.RLock()
 	defer s.ctx.nsqlookupd.DB.RUnlock()
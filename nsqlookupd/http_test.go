@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -126,6 +127,32 @@ func TestInfo(t *testing.T) {
 	test.Equal(t, version.Binary, info.Version)
 }
 
+func TestMetrics(t *testing.T) {
+	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupd1.Exit()
+
+	topicName := "sampletopicA" + strconv.Itoa(int(time.Now().Unix()))
+	nsqds[0].GetTopic(topicName).GetChannel("ch")
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/metrics", nsqlookupd1.RealHTTPAddr())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	metrics := string(body)
+	test.Equal(t, true, strings.Contains(metrics, "nsqlookupd_producers 1\n"))
+	test.Equal(t, true, strings.Contains(metrics, fmt.Sprintf("nsqlookupd_topic_producers{topic=%q} 1\n", topicName)))
+	test.Equal(t, true, strings.Contains(metrics, fmt.Sprintf("nsqlookupd_topic_channels{topic=%q} 1\n", topicName)))
+}
+
 func TestCreateTopic(t *testing.T) {
 	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)